@@ -0,0 +1,244 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// headerTransport adds the custom headers to every request and the
+// credentials only to requests for the crawled host, so they never leak to
+// third-party resources or redirect targets elsewhere.
+type headerTransport struct {
+	base     http.RoundTripper
+	crawler  *Crawler
+	headers  http.Header
+	user     string
+	password string
+	bearer   string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, vs := range t.headers {
+		req.Header.Del(k)
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if normalizeHost(req.URL.Scheme, req.URL.Host) == t.crawler.domain && req.Header.Get("Authorization") == "" {
+		switch {
+		case t.bearer != "":
+			req.Header.Set("Authorization", "Bearer "+t.bearer)
+		case t.user != "":
+			req.SetBasicAuth(t.user, t.password)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Jar wraps cookiejar.Jar, which can't enumerate its contents, and
+// remembers every cookie it was given so they can be written back out.
+type Jar struct {
+	*cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]*http.Cookie
+}
+
+func NewJar() (*Jar, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	return &Jar{Jar: jar, cookies: make(map[string]*http.Cookie)}, nil
+}
+
+// SetCookies records only the cookies the inner jar accepted, so that
+// SaveFile never writes out one it refused, such as a cookie for another
+// domain.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		stored := *c
+		if stored.Domain == "" {
+			stored.Domain = u.Hostname()
+		} else if !strings.HasPrefix(stored.Domain, ".") {
+			stored.Domain = "." + stored.Domain
+		}
+		if stored.Path == "" || !strings.HasPrefix(stored.Path, "/") {
+			stored.Path = defaultCookiePath(u.Path)
+		}
+		if stored.MaxAge > 0 {
+			stored.Expires = time.Now().Add(time.Duration(stored.MaxAge) * time.Second)
+		}
+		key := stored.Domain + "\t" + stored.Path + "\t" + stored.Name
+		if stored.MaxAge < 0 || (!stored.Expires.IsZero() && stored.Expires.Before(time.Now())) {
+			delete(j.cookies, key)
+			continue
+		}
+		if !j.accepted(&stored) {
+			continue
+		}
+		j.cookies[key] = &stored
+	}
+}
+
+// accepted reports whether the inner jar holds c, by asking it for the
+// cookies it would send to c's own domain and path.
+func (j *Jar) accepted(c *http.Cookie) bool {
+	check := &url.URL{Scheme: "http", Host: strings.TrimPrefix(c.Domain, "."), Path: c.Path}
+	if c.Secure {
+		check.Scheme = "https"
+	}
+	for _, have := range j.Jar.Cookies(check) {
+		if have.Name == c.Name && have.Value == c.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCookiePath is the path a cookie set without one gets: the
+// directory of the request path (RFC 6265, section 5.1.4).
+func defaultCookiePath(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+// LoadFile reads a Netscape cookies.txt file as written by curl, wget and
+// browser export extensions.
+func (j *Jar) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(line, "#HttpOnly_"); ok {
+			line, httpOnly = rest, true
+		}
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		c := &http.Cookie{
+			Domain:   fields[0],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if exp, err := strconv.ParseInt(fields[4], 10, 64); err == nil && exp > 0 {
+			c.Expires = time.Unix(exp, 0)
+		}
+		host := strings.TrimPrefix(c.Domain, ".")
+		if !strings.EqualFold(fields[1], "TRUE") {
+			// Host-only cookie: the jar must not see a Domain attribute.
+			c.Domain = ""
+		}
+		scheme := "http"
+		if c.Secure {
+			scheme = "https"
+		}
+		j.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: c.Path}, []*http.Cookie{c})
+	}
+	return scanner.Err()
+}
+
+func (j *Jar) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := j.write(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (j *Jar) write(w io.Writer) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	keys := make([]string, 0, len(j.cookies))
+	for k := range j.cookies {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Netscape HTTP Cookie File")
+	for _, k := range keys {
+		c := j.cookies[k]
+		prefix := ""
+		if c.HttpOnly {
+			prefix = "#HttpOnly_"
+		}
+		var exp int64
+		if !c.Expires.IsZero() {
+			exp = c.Expires.Unix()
+		}
+		fmt.Fprintf(bw, "%s%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			prefix, c.Domain, boolField(strings.HasPrefix(c.Domain, ".")), c.Path,
+			boolField(c.Secure), exp, c.Name, c.Value)
+	}
+	return bw.Flush()
+}
+
+func boolField(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+// formLogin posts the given url-encoded form before the crawl starts so the
+// session cookies end up in the jar.
+func (c *Crawler) formLogin(ctx context.Context, loginURL, data string) error {
+	form, err := url.ParseQuery(data)
+	if err != nil {
+		return fmt.Errorf("login data: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("login failed: %s", resp.Status)
+	}
+	c.logln("[LOGIN]", loginURL, resp.Status)
+	return nil
+}
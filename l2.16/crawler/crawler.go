@@ -0,0 +1,699 @@
+// Package crawler mirrors a web site: it follows links from a start page,
+// downloads pages and their resources into a Storage and rewrites the
+// pages so the copy works offline.
+package crawler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+type Job struct {
+	URL      string
+	Referrer string
+	Depth    int
+}
+
+type Options struct {
+	Depth       int
+	Workers     int
+	MaxFileSize int64
+	Timeout     time.Duration
+
+	// Storage receives the mirrored files. Defaults to an in-memory store.
+	Storage Storage
+	// Transport is the innermost round tripper; defaults to a clone of
+	// http.DefaultTransport honouring Proxy.
+	Transport http.RoundTripper
+	Proxy     *url.URL
+	Jar       http.CookieJar
+
+	Headers  http.Header
+	User     string
+	Password string
+	Bearer   string
+
+	LoginURL  string
+	LoginData string
+
+	// AcceptEncoding is sent with every request; responses are decoded
+	// before they are stored. Defaults to DefaultAcceptEncoding.
+	AcceptEncoding string
+
+	WARC       *WARCWriter
+	Sitemaps   bool
+	Feeds      []string
+	Spider     bool
+	Report     bool
+	SortQuery  bool
+	DropParams []string
+	Dedup      bool
+	// Heuristics also follows links that only JavaScript would load:
+	// <noscript> markup, lazy-loading data-* attributes, JSON-LD and
+	// path-like string literals in inline and linked scripts.
+	Heuristics bool
+
+	// Log receives one line per fetched URL. Nil discards them.
+	Log io.Writer
+
+	OnRequest  func(*http.Request)
+	OnResponse func(*http.Response)
+	// OnLink is called for every in-scope link before it is fetched.
+	// Returning false leaves the link untouched and unfollowed.
+	OnLink func(from, to string, page bool) bool
+}
+
+// Crawler holds the state of one crawl. Create it with New and call Run
+// once; the report and storage stay readable afterwards.
+type Crawler struct {
+	opts   Options
+	client *http.Client
+	norm   normalizer
+	domain string
+	log    io.Writer
+	logMu  sync.Mutex
+	report *Report
+	// manifest is nil in spider mode, where nothing is kept.
+	manifest *Manifest
+
+	robots robotsRules
+
+	visited   map[string]bool
+	visitedMu sync.Mutex
+
+	fetches   map[string]*fetchResult
+	fetchesMu sync.Mutex
+
+	hashes   map[string]string
+	hashesMu sync.Mutex
+
+	seenSitemaps   map[string]bool
+	seenSitemapsMu sync.Mutex
+
+	frontier *frontier
+	workers  []*workerStats
+}
+
+type fetchResult struct {
+	done        chan struct{}
+	Name        string
+	FinalURL    string
+	ContentType string
+	IsHTML      bool
+	Duplicate   bool
+}
+
+var (
+	errDuplicate  = errors.New("duplicate content")
+	errUnsafeName = errors.New("path leaves the mirror")
+)
+
+func New(opts Options) (*Crawler, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 5
+	}
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = 5 * 1024 * 1024
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Storage == nil {
+		opts.Storage = NewMemoryStorage()
+	}
+	if len(opts.Feeds) > 0 {
+		opts.Sitemaps = true
+	}
+
+	c := &Crawler{
+		opts:         opts,
+		norm:         normalizer{sortQuery: opts.SortQuery, dropParams: opts.DropParams},
+		log:          opts.Log,
+		visited:      make(map[string]bool),
+		fetches:      make(map[string]*fetchResult),
+		hashes:       make(map[string]string),
+		seenSitemaps: make(map[string]bool),
+		frontier:     newFrontier(),
+		workers:      make([]*workerStats, opts.Workers),
+	}
+	for i := range c.workers {
+		c.workers[i] = &workerStats{id: i + 1}
+	}
+	if c.log == nil {
+		c.log = io.Discard
+	}
+	if opts.Report || opts.Spider {
+		c.report = NewReport()
+	}
+	if !opts.Spider {
+		c.manifest = NewManifest()
+	}
+
+	rt := opts.Transport
+	if rt == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if opts.Proxy != nil {
+			t.Proxy = http.ProxyURL(opts.Proxy)
+		}
+		// decodeTransport does the decompression, so the archived bodies
+		// are byte-for-byte what the server sent.
+		t.DisableCompression = true
+		rt = t
+	}
+	if opts.WARC != nil {
+		rt = &warcTransport{base: rt, writer: opts.WARC, maxBody: opts.MaxFileSize, log: c.logln}
+	}
+	if opts.AcceptEncoding == "" {
+		opts.AcceptEncoding = DefaultAcceptEncoding
+	}
+	rt = &decodeTransport{base: rt, acceptEncoding: opts.AcceptEncoding}
+	if opts.OnRequest != nil || opts.OnResponse != nil {
+		rt = &hookTransport{base: rt, onRequest: opts.OnRequest, onResponse: opts.OnResponse}
+	}
+	rt = &headerTransport{
+		base:     rt,
+		crawler:  c,
+		headers:  opts.Headers,
+		user:     opts.User,
+		password: opts.Password,
+		bearer:   opts.Bearer,
+	}
+	c.client = &http.Client{Transport: rt, Jar: opts.Jar, Timeout: opts.Timeout}
+	return c, nil
+}
+
+// Report returns the crawl report, or nil unless Options.Report or
+// Options.Spider was set.
+func (c *Crawler) Report() *Report {
+	return c.report
+}
+
+// Run crawls from startURL until the frontier is exhausted or ctx is
+// cancelled. Files being written when ctx is cancelled are discarded.
+func (c *Crawler) Run(ctx context.Context, startURL string) error {
+	start, err := c.norm.normalize(startURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	u, _ := url.Parse(start)
+	if u.Host == "" {
+		return fmt.Errorf("invalid url: %q has no host", startURL)
+	}
+	c.domain = u.Host
+
+	if c.opts.LoginURL != "" {
+		if err := c.formLogin(ctx, c.opts.LoginURL, c.opts.LoginData); err != nil {
+			return err
+		}
+	}
+
+	c.loadRobots(ctx, start)
+
+	fr := c.frontier
+
+	stop := context.AfterFunc(ctx, fr.Close)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for _, ws := range c.workers {
+		wg.Add(1)
+		go func(ws *workerStats) {
+			defer wg.Done()
+			c.worker(withWorker(ctx, ws), fr)
+		}(ws)
+	}
+
+	fr.Hold()
+	fr.Push(Job{URL: start, Depth: c.opts.Depth})
+	if c.opts.Sitemaps {
+		c.seedFrontier(ctx, start, c.opts.Feeds, c.opts.Depth, fr)
+	}
+	fr.Done()
+
+	wg.Wait()
+	// Pages downloaded before a cancellation but not yet processed still
+	// get their links rewritten; nothing new is fetched for them.
+	for jobs := fr.TakeDropped(); len(jobs) > 0; jobs = fr.TakeDropped() {
+		for _, job := range jobs {
+			c.processPage(ctx, job, fr)
+		}
+	}
+	if c.manifest != nil {
+		// Written even after cancellation: it describes exactly the files
+		// that were committed.
+		if err := c.store(ManifestName, c.manifest.WriteJSON); err != nil {
+			c.logln("[ERR]", ManifestName, err)
+		}
+	}
+	return ctx.Err()
+}
+
+func (c *Crawler) logln(a ...any) {
+	c.logMu.Lock()
+	defer c.logMu.Unlock()
+	fmt.Fprintln(c.log, a...)
+}
+
+func (c *Crawler) worker(ctx context.Context, fr *frontier) {
+	ws := workerFrom(ctx)
+	for {
+		job, ok := fr.Pop()
+		if !ok {
+			return
+		}
+		ws.setURL(job.URL)
+		c.processPage(ctx, job, fr)
+		ws.setURL("")
+		ws.done.Add(1)
+		fr.Done()
+	}
+}
+
+func (c *Crawler) processPage(ctx context.Context, job Job, fr *frontier) {
+	rawurl, referrer, depth := job.URL, job.Referrer, job.Depth
+	if depth < 0 {
+		return
+	}
+
+	c.visitedMu.Lock()
+	if c.visited[rawurl] {
+		c.visitedMu.Unlock()
+		return
+	}
+	c.visited[rawurl] = true
+	c.visitedMu.Unlock()
+
+	if !c.isAllowedByRobots(rawurl) {
+		c.logln("[ROBOTS BLOCKED]", rawurl)
+		if c.report != nil {
+			c.report.Add(ReportEntry{URL: rawurl, Skipped: "robots.txt"}, referrer)
+		}
+		return
+	}
+
+	res := c.fetch(ctx, rawurl, referrer)
+	if res.Name == "" || !res.IsHTML || res.Duplicate {
+		return
+	}
+	if res.FinalURL != rawurl {
+		c.visitedMu.Lock()
+		seen := c.visited[res.FinalURL]
+		c.visited[res.FinalURL] = true
+		c.visitedMu.Unlock()
+		if seen {
+			return
+		}
+	}
+	name := res.Name
+
+	f, err := c.opts.Storage.Open(name)
+	if err != nil {
+		return
+	}
+	content, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+	doc, enc, bom, err := parseHTML(content, res.ContentType)
+	if err != nil {
+		return
+	}
+
+	base := res.FinalURL
+	if b := findBase(doc); b != nil {
+		if resolved := c.resolveURL(res.FinalURL, getAttr(b, "href")); resolved != "" {
+			base = resolved
+		}
+		removeAttr(b, "href")
+	}
+
+	rewrite := func(ref string, page bool) string {
+		resURL := c.resolveURL(base, ref)
+		if resURL == "" || !c.inScope(resURL) {
+			return ref
+		}
+		if c.opts.OnLink != nil && !c.opts.OnLink(rawurl, resURL, page) {
+			return ref
+		}
+		if !c.isAllowedByRobots(resURL) {
+			if page {
+				// processPage reports it as blocked.
+				fr.Push(Job{URL: resURL, Referrer: rawurl, Depth: depth - 1})
+			}
+			return ref
+		}
+		target := c.fetch(ctx, resURL, rawurl)
+		if page {
+			fr.Push(Job{URL: resURL, Referrer: rawurl, Depth: depth - 1})
+		}
+		if target.Name == "" {
+			return ref
+		}
+		rel := relativeLink(name, target.Name)
+		if parsed, err := url.Parse(strings.TrimSpace(ref)); err == nil && parsed.Fragment != "" {
+			rel += "#" + parsed.EscapedFragment()
+		}
+		return rel
+	}
+
+	var walker func(*html.Node)
+	walker = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if c.opts.Sitemaps && isFeedLink(n) {
+				if feedURL := c.resolveURL(base, getAttr(n, "href")); feedURL != "" && c.inScope(feedURL) {
+					c.enqueueSitemap(ctx, feedURL, depth, fr)
+				}
+			}
+			for i := range n.Attr {
+				attr := &n.Attr[i]
+				kind := refKindOf(n, *attr)
+				if kind == refNone && c.opts.Heuristics {
+					kind = lazyRefKind(*attr)
+				}
+				switch kind {
+				case refAsset:
+					attr.Val = rewrite(attr.Val, false)
+				case refPage:
+					attr.Val = rewrite(attr.Val, true)
+				case refSrcset:
+					cands := parseSrcset(attr.Val)
+					for j := range cands {
+						cands[j].URL = rewrite(cands[j].URL, false)
+					}
+					attr.Val = formatSrcset(cands)
+				case refRefresh:
+					if delay, target, ok := parseRefresh(attr.Val); ok {
+						attr.Val = delay + "; url=" + rewrite(target, true)
+					}
+				}
+			}
+		}
+		if n.Type == html.ElementNode && c.opts.Heuristics {
+			c.followScriptLinks(n, name, rewrite, walker)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walker(c)
+		}
+	}
+	walker(doc)
+
+	if err := c.store(name, func(w io.Writer) error {
+		return renderHTML(w, doc, enc, bom)
+	}); err != nil {
+		c.logln("[ERR]", err)
+	}
+}
+
+// store writes one file through Storage, committing it only if write
+// succeeds so an interrupted crawl never leaves a truncated file behind.
+func (c *Crawler) store(name string, write func(io.Writer) error) error {
+	f, err := c.opts.Storage.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
+
+// fetch is downloadFile until ctx is cancelled. After that nothing new is
+// downloaded, but what already was is still returned, so that the pages
+// in the mirror get their links rewritten to it instead of keeping the
+// ones to the live site.
+func (c *Crawler) fetch(ctx context.Context, rawurl, referrer string) *fetchResult {
+	if ctx.Err() == nil {
+		return c.downloadFile(ctx, rawurl, referrer)
+	}
+	c.fetchesMu.Lock()
+	res, ok := c.fetches[rawurl]
+	c.fetchesMu.Unlock()
+	if !ok {
+		return &fetchResult{}
+	}
+	<-res.done
+	return res
+}
+
+// downloadFile fetches each URL at most once; concurrent and later callers
+// wait for and share the first result. Redirect targets are registered
+// under their own URL too, so both spellings map to one local file.
+func (c *Crawler) downloadFile(ctx context.Context, rawurl, referrer string) *fetchResult {
+	c.fetchesMu.Lock()
+	res, cached := c.fetches[rawurl]
+	if !cached {
+		res = &fetchResult{done: make(chan struct{}), FinalURL: rawurl}
+		c.fetches[rawurl] = res
+	}
+	c.fetchesMu.Unlock()
+
+	if cached {
+		<-res.done
+		if c.report != nil {
+			c.report.AddReferrer(rawurl, referrer)
+		}
+		return res
+	}
+	c.fetchFile(ctx, res, rawurl, referrer)
+	if res.Name != "" && c.manifest != nil {
+		c.manifest.Add(ManifestEntry{URL: rawurl, Name: res.Name, ContentType: res.ContentType})
+		if res.FinalURL != rawurl {
+			c.manifest.Add(ManifestEntry{URL: res.FinalURL, Name: res.Name, ContentType: res.ContentType})
+		}
+	}
+	close(res.done)
+	return res
+}
+
+func (c *Crawler) fetchFile(ctx context.Context, res *fetchResult, rawurl, referrer string) {
+	start := time.Now()
+	entry := ReportEntry{URL: rawurl}
+	defer func() {
+		if c.report != nil {
+			entry.DurationMs = time.Since(start).Milliseconds()
+			c.report.Add(entry, referrer)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logln("[ERR]", err)
+		entry.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	entry.Status = resp.StatusCode
+	entry.ContentType = contentType
+	entry.Redirects = redirectChain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		c.logln("[ERR]", rawurl, resp.Status)
+		return
+	}
+
+	if final, err := c.norm.normalize(resp.Request.URL.String()); err == nil && final != rawurl {
+		c.fetchesMu.Lock()
+		other, exists := c.fetches[final]
+		if !exists {
+			c.fetches[final] = res
+		}
+		c.fetchesMu.Unlock()
+		if exists {
+			<-other.done
+			res.Name, res.FinalURL, res.ContentType, res.IsHTML, res.Duplicate = other.Name, other.FinalURL, other.ContentType, other.IsHTML, other.Duplicate
+			return
+		}
+		c.logln("[REDIRECT]", rawurl, "->", final)
+		res.FinalURL = final
+	}
+
+	res.ContentType = contentType
+	res.IsHTML = strings.HasPrefix(contentType, "text/html")
+	reader := io.LimitReader(&countingReader{r: resp.Body, ws: workerFrom(ctx)}, c.opts.MaxFileSize)
+
+	if c.opts.Spider && !res.IsHTML {
+		entry.Size, err = io.Copy(io.Discard, reader)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		c.logln("[CHECK]", rawurl, resp.Status)
+		return
+	}
+
+	finalURL, _ := url.Parse(res.FinalURL)
+	name := NameFor(finalURL)
+	if name == "" {
+		c.logln("[ERR]", rawurl, errUnsafeName)
+		entry.Error = errUnsafeName.Error()
+		return
+	}
+
+	hash := sha256.New()
+	duplicateOf := ""
+	err = c.store(name, func(w io.Writer) error {
+		var err error
+		entry.Size, err = io.Copy(io.MultiWriter(w, hash), reader)
+		if err != nil {
+			return err
+		}
+		if !c.opts.Dedup {
+			return nil
+		}
+		sum := hex.EncodeToString(hash.Sum(nil))
+		c.hashesMu.Lock()
+		defer c.hashesMu.Unlock()
+		if orig, dup := c.hashes[sum]; dup && orig != name {
+			duplicateOf = orig
+			return errDuplicate
+		}
+		c.hashes[sum] = name
+		return nil
+	})
+	if duplicateOf != "" {
+		c.logln("[DUPLICATE]", rawurl, "->", duplicateOf)
+		res.Name, res.Duplicate = duplicateOf, true
+		return
+	}
+	if err != nil {
+		c.logln("[ERR]", rawurl, err)
+		entry.Error = err.Error()
+		return
+	}
+
+	if c.opts.Spider {
+		c.logln("[CHECK]", rawurl, resp.Status)
+	} else {
+		c.logln("[DOWNLOAD]", rawurl, "->", name)
+	}
+	res.Name = name
+}
+
+// nameEscaper keeps the characters out of storage names that would split
+// them, or the links to them, in the wrong place.
+var nameEscaper = strings.NewReplacer("/", "%2F", "#", "%23", "?", "%3F")
+
+// NameFor maps a URL onto a slash-separated storage name. The query string
+// becomes part of the file name after an '@', the way wget does on Windows.
+// Encoded slashes, '#' and '?' in the path and the query stay encoded.
+// Paths with a '..' segment, which would climb out of the host's
+// directory, get no name at all.
+func NameFor(u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, seg := range segments {
+		if s, err := url.PathUnescape(seg); err == nil {
+			seg = nameEscaper.Replace(s)
+		}
+		if seg == ".." {
+			return ""
+		}
+		segments[i] = seg
+	}
+	filePath := strings.Join(segments, "/")
+	if filePath == "" || strings.HasSuffix(filePath, "/") {
+		filePath += "index.html"
+	}
+	if u.RawQuery != "" {
+		filePath += "@" + nameEscaper.Replace(u.RawQuery)
+	}
+	return path.Join(u.Host, filePath)
+}
+
+// relativeName returns the link from the file `from` to the file `to`,
+// both given as storage names.
+func relativeName(from, to string) string {
+	fromDir := strings.Split(path.Dir(from), "/")
+	toParts := strings.Split(to, "/")
+	i := 0
+	for i < len(fromDir) && i < len(toParts)-1 && fromDir[i] == toParts[i] {
+		i++
+	}
+	var parts []string
+	for range fromDir[i:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, toParts[i:]...)
+	return strings.Join(parts, "/")
+}
+
+// relativeLink is relativeName escaped for use as a URL: a browser must
+// find the file under the very name it was stored as, '%', '#' and '?'
+// included.
+func relativeLink(from, to string) string {
+	parts := strings.Split(relativeName(from, to), "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	link := strings.Join(parts, "/")
+	if first, _, _ := strings.Cut(link, "/"); strings.Contains(first, ":") {
+		// Keep a name like "a:b" from reading as a scheme.
+		link = "./" + link
+	}
+	return link
+}
+
+func (c *Crawler) inScope(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	return u.Host == "" || u.Host == c.domain
+}
+
+func (c *Crawler) resolveURL(base string, href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "mailto:") || strings.HasPrefix(href, "javascript:") ||
+		strings.HasPrefix(href, "data:") || strings.HasPrefix(href, "tel:") {
+		return ""
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	resolved, err := c.norm.normalize(baseURL.ResolveReference(u).String())
+	if err != nil {
+		return ""
+	}
+	return resolved
+}
+
+type hookTransport struct {
+	base       http.RoundTripper
+	onRequest  func(*http.Request)
+	onResponse func(*http.Response)
+}
+
+func (t *hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.onRequest != nil {
+		t.onRequest(req)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && t.onResponse != nil {
+		t.onResponse(resp)
+	}
+	return resp, err
+}
@@ -0,0 +1,1028 @@
+package crawler
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func newTestSite(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	page := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("/{$}", page(`<html><head><link rel="stylesheet" href="/css/site.css"></head>
+<body><a href="/docs/">docs</a><a href="/old">old</a><a href="/private/x.html">private</a><a href="/media/">media</a>
+<img src="img/logo.png" srcset="img/logo.png 1x, img/logo@2x.png 2x"></body></html>`))
+	mux.HandleFunc("/docs/{$}", page(`<a href="../">home</a><a href="page.html#top">page</a>`))
+	mux.HandleFunc("/docs/page.html", page(`<p>page</p>`))
+	mux.HandleFunc("/new", page(`<p>moved here</p>`))
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/private/x.html", page(`<p>secret</p>`))
+	// The media page resolves its links against <base> and holds one of
+	// each other kind of reference the crawler rewrites.
+	mux.HandleFunc("/media/{$}", page(`<html><head><base href="/docs/"><meta http-equiv="refresh" content="5; url=/new"></head>
+<body><a href="page.html">page</a>
+<video src="/media/clip.mp4" poster="/img/logo.png"><source src="/media/clip.webm" type="video/webm"></video>
+<audio src="/media/sound.mp3"></audio>
+<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="/img/icons.svg#star"></use><a xlink:href="/new"><text>new</text></a></svg>
+<form action="/search"><input type="image" src="/img/logo@2x.png"></form></body></html>`))
+	mux.HandleFunc("/search", page(`<p>results</p>`))
+	for _, media := range []string{"/media/clip.mp4", "/media/clip.webm", "/media/sound.mp3", "/img/icons.svg"} {
+		mux.HandleFunc(media, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			fmt.Fprint(w, "media")
+		})
+	}
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	mux.HandleFunc("/css/site.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		fmt.Fprint(w, "body{}")
+	})
+	for _, img := range []string{"/img/logo.png", "/img/logo@2x.png"} {
+		mux.HandleFunc(img, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "png")
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func hostOf(srv *httptest.Server) string {
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestCrawlMirrorsSiteIntoMemory(t *testing.T) {
+	srv := newTestSite(t)
+	store := NewMemoryStorage()
+	c, err := New(Options{Depth: 2, Storage: store})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := c.Run(context.Background(), srv.URL+"/"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	host := hostOf(srv)
+	for _, name := range []string{"index.html", "docs/index.html", "docs/page.html", "new", "css/site.css", "img/logo.png", "img/logo@2x.png",
+		"media/index.html", "media/clip.mp4", "media/clip.webm", "media/sound.mp3", "img/icons.svg", "search"} {
+		if _, ok := store.Get(host + "/" + name); !ok {
+			t.Errorf("expected %s to be mirrored, have %v", name, store.Names())
+		}
+	}
+	if _, ok := store.Get(host + "/private/x.html"); ok {
+		t.Errorf("robots.txt disallowed page was mirrored")
+	}
+
+	index, _ := store.Get(host + "/index.html")
+	for _, want := range []string{`href="css/site.css"`, `href="docs/index.html"`, `href="new"`, `srcset="img/logo.png 1x, img/logo@2x.png 2x"`} {
+		if !strings.Contains(string(index), want) {
+			t.Errorf("index.html missing %s:\n%s", want, index)
+		}
+	}
+	docs, _ := store.Get(host + "/docs/index.html")
+	if !strings.Contains(string(docs), `href="../index.html"`) || !strings.Contains(string(docs), `href="page.html#top"`) {
+		t.Errorf("docs/index.html not rewritten:\n%s", docs)
+	}
+	media, _ := store.Get(host + "/media/index.html")
+	if strings.Contains(string(media), `href="/docs/"`) {
+		t.Errorf("media/index.html keeps its <base href>:\n%s", media)
+	}
+	for _, want := range []string{
+		`href="../docs/page.html"`,
+		`content="5; url=../new"`,
+		`<video src="clip.mp4" poster="../img/logo.png">`,
+		`<source src="clip.webm"`,
+		`<audio src="sound.mp3">`,
+		`<use xlink:href="../img/icons.svg#star">`,
+		`<a xlink:href="../new">`,
+		`<form action="../search">`,
+		`<input type="image" src="../img/logo@2x.png"/>`,
+	} {
+		if !strings.Contains(string(media), want) {
+			t.Errorf("media/index.html missing %s:\n%s", want, media)
+		}
+	}
+}
+
+func TestCrawlHooks(t *testing.T) {
+	srv := newTestSite(t)
+	var mu sync.Mutex
+	var requests, responses int
+	var links []string
+	c, _ := New(Options{
+		Depth: 1,
+		OnRequest: func(*http.Request) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+		},
+		OnResponse: func(*http.Response) {
+			mu.Lock()
+			responses++
+			mu.Unlock()
+		},
+		OnLink: func(from, to string, page bool) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			links = append(links, to)
+			return !strings.HasSuffix(to, "/docs/")
+		},
+	})
+	if err := c.Run(context.Background(), srv.URL); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if requests == 0 || requests != responses {
+		t.Errorf("expected matching request/response hooks, got %d/%d", requests, responses)
+	}
+	if len(links) == 0 {
+		t.Fatalf("OnLink was never called")
+	}
+	store := c.opts.Storage.(*MemoryStorage)
+	if _, ok := store.Get(hostOf(srv) + "/docs/index.html"); ok {
+		t.Errorf("link rejected by OnLink was still fetched")
+	}
+}
+
+func TestCrawlReportsBrokenLinks(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<a href="/missing">x</a><img src="/ok.png"><a href="/private/x">private</a>`)
+	})
+	mux.HandleFunc("/ok.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "png")
+	})
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, _ := New(Options{Depth: 1, Spider: true})
+	if err := c.Run(context.Background(), srv.URL); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	broken := c.Report().BrokenBySource()
+	got := broken[srv.URL+"/"]
+	if len(got) != 1 || got[0] != srv.URL+"/missing" {
+		t.Errorf("expected /missing reported broken, got %v", broken)
+	}
+	for _, e := range c.Report().Entries() {
+		if e.URL == srv.URL+"/private/x" && (e.Skipped != "robots.txt" || e.Broken()) {
+			t.Errorf("robots.txt disallowed URL reported as %+v", e)
+		}
+	}
+	var summary strings.Builder
+	c.Report().PrintSummary(&summary)
+	if !strings.Contains(summary.String(), "битых ссылок: 1, пропущено: 1") {
+		t.Errorf("summary:\n%s", summary.String())
+	}
+}
+
+func TestCrawlCancelled(t *testing.T) {
+	srv := newTestSite(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, _ := New(Options{Depth: 2})
+	if err := c.Run(ctx, srv.URL); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCrawlCancelledRewritesFetchedPages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := http.NewServeMux()
+	page := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("/{$}", page(`<a href="/a.html">a</a><a href="/stop.html">stop</a><a href="/b.html">b</a>`))
+	mux.HandleFunc("/a.html", page(`<a href="/">home</a>`))
+	mux.HandleFunc("/b.html", page(`<p>b</p>`))
+	// Ctrl+C arrives while the crawl is in the middle of the home page.
+	mux.HandleFunc("/stop.html", func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	store := NewMemoryStorage()
+	c, _ := New(Options{Depth: 2, Workers: 1, Storage: store})
+	if err := c.Run(ctx, srv.URL+"/"); err != context.Canceled {
+		t.Fatalf("Run() error = %v, want context.Canceled", err)
+	}
+	host := hostOf(srv)
+	if _, ok := store.Get(host + "/b.html"); ok {
+		t.Errorf("b.html was fetched after cancellation")
+	}
+	index, _ := store.Get(host + "/index.html")
+	if !strings.Contains(string(index), `href="a.html"`) || !strings.Contains(string(index), `href="/b.html"`) {
+		t.Errorf("index.html not rewritten to what was fetched:\n%s", index)
+	}
+	// Queued before the cancellation, a.html is rewritten all the same.
+	if a, _ := store.Get(host + "/a.html"); !strings.Contains(string(a), `href="index.html"`) {
+		t.Errorf("a.html not rewritten:\n%s", a)
+	}
+}
+
+func TestArchiveStorageZip(t *testing.T) {
+	srv := newTestSite(t)
+	archive := filepath.Join(t.TempDir(), "site.zip")
+	store, err := NewArchiveStorage(archive)
+	if err != nil {
+		t.Fatalf("NewArchiveStorage() error = %v", err)
+	}
+	c, _ := New(Options{Depth: 0, Storage: store})
+	if err := c.Run(context.Background(), srv.URL); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	defer zr.Close()
+	names := make(map[string]bool)
+	for _, f := range zr.File {
+		names[f.Name] = true
+	}
+	if !names[hostOf(srv)+"/index.html"] || !names[hostOf(srv)+"/css/site.css"] {
+		t.Errorf("archive is missing files: %v", names)
+	}
+}
+
+func TestFSStorageStaysInDir(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "mirror")
+	store, err := NewFSStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../escaped", "h/../../escaped", "/escaped", ""} {
+		if f, err := store.Create(name); err == nil {
+			f.Abort()
+			t.Errorf("Create(%q) succeeded", name)
+		}
+		if _, err := store.Open(name); err == nil {
+			t.Errorf("Open(%q) succeeded", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); err == nil {
+		t.Errorf("a file was written outside the storage directory")
+	}
+
+	f, err := store.Create("h/./docs/../a.html")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	io.WriteString(f, "a")
+	if err := f.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "h", "a.html")); err != nil {
+		t.Errorf("cleaned name not stored: %v", err)
+	}
+}
+
+func TestRelativeName(t *testing.T) {
+	tests := []struct{ from, to, want string }{
+		{"h/index.html", "h/img/a.png", "img/a.png"},
+		{"h/docs/index.html", "h/index.html", "../index.html"},
+		{"h/a/b/c.html", "h/a/d.html", "../d.html"},
+		{"h/index.html", "h/index.html", "index.html"},
+	}
+	for _, tt := range tests {
+		if got := relativeName(tt.from, tt.to); got != tt.want {
+			t.Errorf("relativeName(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestRelativeLink(t *testing.T) {
+	tests := []struct{ from, to, want string }{
+		{"h/index.html", "h/docs/a b.html", "docs/a%20b.html"},
+		{"h/docs/index.html", "h/x%2Fy.html", "../x%252Fy.html"},
+		{"h/index.html", "h/q%3Fa%23b.html@x=1", "q%253Fa%2523b.html@x=1"},
+		{"h/index.html", "h/a:b.html", "./a:b.html"},
+	}
+	for _, tt := range tests {
+		got := relativeLink(tt.from, tt.to)
+		if got != tt.want {
+			t.Errorf("relativeLink(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+		// Followed from the page, the link leads to the stored name.
+		base, _ := url.Parse("file:///m/" + tt.from)
+		ref, err := url.Parse(got)
+		if err != nil || base.ResolveReference(ref).Path != "/m/"+tt.to {
+			t.Errorf("relativeLink(%q, %q) = %q leads elsewhere", tt.from, tt.to, got)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	plain := normalizer{}
+	tidy := normalizer{sortQuery: true, dropParams: []string{"utm_*", "sid"}}
+	tests := []struct {
+		n         normalizer
+		raw, want string
+	}{
+		{plain, "HTTP://Example.COM:80/a/./b/../c#top", "http://example.com/a/c"},
+		{plain, "https://example.com:443", "https://example.com/"},
+		{plain, "http://example.com:8080/x", "http://example.com:8080/x"},
+		{plain, "http://[::1]:80/x", "http://[::1]/x"},
+		{plain, "http://example.com/docs/.", "http://example.com/docs/"},
+		{plain, "http://example.com/docs/sub/..", "http://example.com/docs/"},
+		{plain, "http://example.com/a%20b", "http://example.com/a%20b"},
+		{plain, "http://example.com/a%2Fb", "http://example.com/a%2Fb"},
+		{plain, "http://example.com/a%2Fb/../c", "http://example.com/c"},
+		{plain, "http://example.com/a%2F..%2Fb", "http://example.com/a%2F..%2Fb"},
+		{plain, "http://example.com/%2E%2E/%2e%2E/%2E%2E/etc/passwd", "http://example.com/etc/passwd"},
+		{plain, "http://example.com/docs/%2E/%7euser/a%2fb%c3%a9", "http://example.com/docs/~user/a%2Fb%C3%A9"},
+		{plain, "http://example.com/x?b=2&a=1", "http://example.com/x?b=2&a=1"},
+		{tidy, "http://example.com/x?b=2&a=1", "http://example.com/x?a=1&b=2"},
+		{tidy, "http://example.com/x?utm_source=feed&id=1&sid=2&", "http://example.com/x?id=1"},
+		{tidy, "http://example.com/x?q=a%2Fb&utm%5Fmedium=x", "http://example.com/x?q=a%2Fb"},
+	}
+	for _, tt := range tests {
+		got, err := tt.n.normalize(tt.raw)
+		if err != nil || got != tt.want {
+			t.Errorf("normalize(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestNameFor(t *testing.T) {
+	tests := []struct{ raw, want string }{
+		{"http://h/", "h/index.html"},
+		{"http://h/docs/", "h/docs/index.html"},
+		{"http://h/a%2Fb.html?x=1/2", "h/a%2Fb.html@x=1%2F2"},
+		{"http://h/q%3Fa%23b.html?x=?", "h/q%3Fa%23b.html@x=%3F"},
+		{"http://h/a/../b", ""},
+		{"http://h/%2E%2E/%2E%2E/etc/passwd", ""},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.raw)
+		if got := NameFor(u); got != tt.want {
+			t.Errorf("NameFor(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCrawlSharesFetches(t *testing.T) {
+	mux := http.NewServeMux()
+	page := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("/{$}", page(`<a href="/a.html">a</a><a href="/copy.html">copy</a><a href="/go">go</a>`+
+		`<a href="/x/y.html">x/y</a><a href="/x%2Fy.html">x%2Fy</a><a href="/q%3Fa%23b.html">q?a#b</a>`))
+	mux.HandleFunc("/a.html", page(`<p>same</p>`))
+	mux.HandleFunc("/copy.html", page(`<p>same</p>`))
+	mux.HandleFunc("/go", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/a.html", http.StatusFound)
+	})
+	mux.HandleFunc("/x/y.html", page(`<p>nested</p>`))
+	mux.HandleFunc("/{name}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/x%2Fy.html":
+			page(`<p>encoded</p>`)(w, r)
+		case "/q%3Fa%23b.html":
+			page(`<p>question</p>`)(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	host := hostOf(srv)
+
+	for _, dedup := range []bool{false, true} {
+		store := NewMemoryStorage()
+		c, _ := New(Options{Depth: 1, Storage: store, Dedup: dedup})
+		if err := c.Run(context.Background(), srv.URL+"/"); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+
+		// The redirect shares the file of its target.
+		if _, ok := store.Get(host + "/go"); ok {
+			t.Errorf("dedup %v: redirect stored on its own, have %v", dedup, store.Names())
+		}
+		if data, _ := store.Get(host + "/x/y.html"); !strings.Contains(string(data), "<p>nested</p>") {
+			t.Errorf("dedup %v: x/y.html = %q", dedup, data)
+		}
+		if data, _ := store.Get(host + "/x%2Fy.html"); !strings.Contains(string(data), "<p>encoded</p>") {
+			t.Errorf("dedup %v: x%%2Fy.html = %q, have %v", dedup, data, store.Names())
+		}
+		if data, _ := store.Get(host + "/q%3Fa%23b.html"); !strings.Contains(string(data), "<p>question</p>") {
+			t.Errorf("dedup %v: q%%3Fa%%23b.html = %q, have %v", dedup, data, store.Names())
+		}
+		_, copied := store.Get(host + "/copy.html")
+		if copied == dedup {
+			t.Errorf("dedup %v: copy.html stored = %v", dedup, copied)
+		}
+
+		index, _ := store.Get(host + "/index.html")
+		copyHref := `href="copy.html"`
+		if dedup {
+			copyHref = `href="a.html">copy`
+		}
+		for _, want := range []string{`href="a.html">a`, copyHref, `href="a.html">go`, `href="x/y.html"`, `href="x%252Fy.html"`, `href="q%253Fa%2523b.html"`} {
+			if !strings.Contains(string(index), want) {
+				t.Errorf("dedup %v: index.html missing %s:\n%s", dedup, want, index)
+			}
+		}
+	}
+}
+
+func TestCrawlKeepsPageCharset(t *testing.T) {
+	// "Привет" in windows-1251, declared only by <meta charset>.
+	page := "<html><head><meta charset=\"windows-1251\"></head><body><p>\xcf\xf0\xe8\xe2\xe5\xf2</p><a href=\"/b\">b</a></body></html>"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, page)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+		fmt.Fprint(w, "<p>\xe0\xe1\xe2</p>")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	store := NewMemoryStorage()
+	c, _ := New(Options{Depth: 1, Storage: store})
+	if err := c.Run(context.Background(), srv.URL); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	index, _ := store.Get(hostOf(srv) + "/index.html")
+	if !strings.Contains(string(index), "\xcf\xf0\xe8\xe2\xe5\xf2") || !strings.Contains(string(index), `href="b"`) {
+		t.Errorf("index.html lost its windows-1251 text or was not rewritten:\n%q", index)
+	}
+	b, _ := store.Get(hostOf(srv) + "/b")
+	if !strings.Contains(string(b), "\xe0\xe1\xe2") {
+		t.Errorf("b lost its windows-1251 text: %q", b)
+	}
+}
+
+func TestCrawlDecodesContentEncoding(t *testing.T) {
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+		"deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+	for coding, newWriter := range encoders {
+		t.Run(coding, func(t *testing.T) {
+			var gotAccept string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAccept = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", coding)
+				cw := newWriter(w)
+				fmt.Fprint(cw, "<p>compressed</p>")
+				cw.Close()
+			}))
+			defer srv.Close()
+
+			store := NewMemoryStorage()
+			c, _ := New(Options{Depth: 0, Storage: store})
+			if err := c.Run(context.Background(), srv.URL); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if gotAccept != DefaultAcceptEncoding {
+				t.Errorf("Accept-Encoding = %q, want %q", gotAccept, DefaultAcceptEncoding)
+			}
+			index, _ := store.Get(hostOf(srv) + "/index.html")
+			if !strings.Contains(string(index), "<p>compressed</p>") {
+				t.Errorf("body was not decoded: %q", index)
+			}
+		})
+	}
+}
+
+func TestCrawlHeuristics(t *testing.T) {
+	mux := http.NewServeMux()
+	page := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, body)
+		}
+	}
+	mux.HandleFunc("/{$}", page(`<html><head>
+<script type="application/ld+json">{"@context":"https://schema.org","mainEntityOfPage":{"url":"/ld"}}</script>
+<script>fetch("/inline.json"); location.href = '/from-inline'; var re = "/\\d+/";</script>
+<script src="/app.js"></script>
+</head><body>
+<noscript><img src="/noscript.png"></noscript>
+<img data-src="/lazy.png" data-srcset="/lazy-2x.png 2x">
+</body></html>`))
+	mux.HandleFunc("/app.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/javascript")
+		fmt.Fprint(w, "router.add(`/from-app`); const tpl = `/user/${id}`;")
+	})
+	for _, p := range []string{"/ld", "/from-inline", "/from-app"} {
+		mux.HandleFunc(p, page(`<p>page</p>`))
+	}
+	for _, p := range []string{"/noscript.png", "/lazy.png", "/lazy-2x.png", "/inline.json"} {
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "x") })
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	store := NewMemoryStorage()
+	c, _ := New(Options{Depth: 1, Storage: store, Heuristics: true})
+	if err := c.Run(context.Background(), srv.URL); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	host := hostOf(srv)
+	for _, name := range []string{"ld", "from-inline", "from-app", "app.js", "noscript.png", "lazy.png", "lazy-2x.png", "inline.json"} {
+		if _, ok := store.Get(host + "/" + name); !ok {
+			t.Errorf("expected %s to be mirrored, have %v", name, store.Names())
+		}
+	}
+	index, _ := store.Get(host + "/index.html")
+	for _, want := range []string{`<img src="noscript.png"/>`, `data-src="lazy.png"`, `data-srcset="lazy-2x.png 2x"`} {
+		if !strings.Contains(string(index), want) {
+			t.Errorf("index.html missing %s:\n%s", want, index)
+		}
+	}
+
+	plain := NewMemoryStorage()
+	c, _ = New(Options{Depth: 1, Storage: plain})
+	c.Run(context.Background(), srv.URL)
+	if _, ok := plain.Get(host + "/lazy.png"); ok {
+		t.Errorf("data-src followed without Heuristics")
+	}
+}
+
+func TestMirrorHandler(t *testing.T) {
+	srv := newTestSite(t)
+	dir := t.TempDir()
+	store, _ := NewFSStorage(dir)
+	c, _ := New(Options{Depth: 2, Storage: store})
+	if err := c.Run(context.Background(), srv.URL); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	fsys := os.DirFS(dir)
+	h, err := NewMirrorHandler(fstest.MapFS{
+		ManifestName:                  readFile(t, fsys, ManifestName),
+		hostOf(srv) + "/index.html":   readFile(t, fsys, hostOf(srv)+"/index.html"),
+		hostOf(srv) + "/new":          readFile(t, fsys, hostOf(srv)+"/new"),
+		hostOf(srv) + "/css/site.css": readFile(t, fsys, hostOf(srv)+"/css/site.css"),
+		hostOf(srv) + "/list@page=2":  &fstest.MapFile{Data: []byte("<p>page 2</p>")},
+		hostOf(srv) + "/about.html":   &fstest.MapFile{Data: []byte("<p>about</p>")},
+	})
+	if err != nil {
+		t.Fatalf("NewMirrorHandler() error = %v", err)
+	}
+
+	tests := []struct {
+		path, wantType string
+		wantStatus     int
+	}{
+		{"/", "text/html; charset=utf-8", http.StatusOK},
+		{"/" + hostOf(srv) + "/css/site.css", "text/css", http.StatusOK},
+		{"/old", "text/html; charset=utf-8", http.StatusOK},
+		{"/list?page=2", "text/html; charset=utf-8", http.StatusOK},
+		{"/about", "text/html; charset=utf-8", http.StatusOK},
+		{"/missing.png", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantType != "" && rec.Header().Get("Content-Type") != tt.wantType {
+			t.Errorf("GET %s: Content-Type %q, want %q", tt.path, rec.Header().Get("Content-Type"), tt.wantType)
+		}
+	}
+	if got := h.Missing(); len(got) != 1 || got[0] != srv.URL+"/missing.png" {
+		t.Errorf("Missing() = %v", got)
+	}
+}
+
+func readFile(t *testing.T, fsys fs.FS, name string) *fstest.MapFile {
+	t.Helper()
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return &fstest.MapFile{Data: data}
+}
+
+func TestCrawlSeedsFromSitemapsAndFeeds(t *testing.T) {
+	mux := http.NewServeMux()
+	serve := func(contentType, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			fmt.Fprint(w, strings.ReplaceAll(body, "HOST", r.Host))
+		}
+	}
+	mux.HandleFunc("/{$}", serve("text/html", `<html><head>
+<link rel="alternate" type="application/rss+xml" href="/rss.xml">
+<link rel="alternate" type="application/atom+xml" href="http://elsewhere.invalid/atom.xml"></head><body><p>no links</p></body></html>`))
+	mux.HandleFunc("/robots.txt", serve("text/plain", "User-agent: *\nSitemap: http://HOST/sitemap_index.xml\n"))
+	mux.HandleFunc("/sitemap_index.xml", serve("application/xml", `<?xml version="1.0"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<sitemap><loc>http://HOST/pages.xml.gz</loc></sitemap></sitemapindex>`))
+	mux.HandleFunc("/pages.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		zw := gzip.NewWriter(w)
+		fmt.Fprintf(zw, `<?xml version="1.0"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+<url><loc>http://%s/orphan.html</loc></url>
+<url><loc>http://elsewhere.invalid/away.html</loc></url></urlset>`, r.Host)
+		zw.Close()
+	})
+	mux.HandleFunc("/rss.xml", serve("application/rss+xml", `<rss version="2.0"><channel>
+<item><link>/news/rss-post.html</link></item></channel></rss>`))
+	mux.HandleFunc("/atom.xml", serve("application/atom+xml", `<feed xmlns="http://www.w3.org/2005/Atom">
+<entry><link rel="alternate" href="http://HOST/news/atom-post.html"/><link rel="edit" href="/news/edit"/></entry></feed>`))
+	for _, p := range []string{"/orphan.html", "/news/rss-post.html", "/news/atom-post.html", "/news/edit"} {
+		mux.HandleFunc(p, serve("text/html", `<p>only in a sitemap or feed</p>`))
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	store := NewMemoryStorage()
+	var mu sync.Mutex
+	var hosts []string
+	c, _ := New(Options{
+		Depth:   1,
+		Storage: store,
+		Feeds:   []string{srv.URL + "/atom.xml"},
+		OnRequest: func(r *http.Request) {
+			mu.Lock()
+			hosts = append(hosts, r.URL.Host)
+			mu.Unlock()
+		},
+	})
+	if err := c.Run(context.Background(), srv.URL+"/"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	host := hostOf(srv)
+	for _, name := range []string{"orphan.html", "news/rss-post.html", "news/atom-post.html"} {
+		if _, ok := store.Get(host + "/" + name); !ok {
+			t.Errorf("expected %s to be mirrored, have %v", name, store.Names())
+		}
+	}
+	if _, ok := store.Get(host + "/news/edit"); ok {
+		t.Errorf("atom link with rel=edit was followed")
+	}
+	for _, h := range hosts {
+		if h != host {
+			t.Errorf("out-of-scope sitemap entry or feed fetched from %s", h)
+		}
+	}
+}
+
+func TestSitemapUnpackedSizeLimited(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<p>home</p>`)
+	})
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Sitemap: http://%s/bomb.xml.gz\n", r.Host)
+	})
+	// A few kilobytes that unpack to a megabyte, past MaxFileSize.
+	mux.HandleFunc("/bomb.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		zw := gzip.NewWriter(w)
+		fmt.Fprintf(zw, `<urlset><url><loc>http://%s/orphan.html</loc></url><!--`, r.Host)
+		zw.Write(make([]byte, 1<<20))
+		io.WriteString(zw, `--></urlset>`)
+		zw.Close()
+	})
+	mux.HandleFunc("/orphan.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<p>orphan</p>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	store := NewMemoryStorage()
+	var log strings.Builder
+	c, _ := New(Options{Depth: 1, Storage: store, Sitemaps: true, MaxFileSize: 64 << 10, Log: &log})
+	if err := c.Run(context.Background(), srv.URL+"/"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if _, ok := store.Get(hostOf(srv) + "/orphan.html"); ok || !strings.Contains(log.String(), "[ERR sitemap]") {
+		t.Errorf("oversized sitemap was read whole, log:\n%s", log.String())
+	}
+}
+
+type warcRecord struct {
+	header map[string]string
+	block  []byte
+}
+
+// readWARC reads back the records of one .warc.gz file, each of which must
+// be a gzip member of its own.
+func readWARC(t *testing.T, name string) []warcRecord {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var records []warcRecord
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return records
+		}
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			t.Fatalf("%s: record %d: %v", name, len(records), err)
+		}
+		zr.Multistream(false)
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("%s: record %d: %v", name, len(records), err)
+		}
+		head, rest, ok := strings.Cut(string(data), "\r\n\r\n")
+		lines := strings.Split(head, "\r\n")
+		if !ok || lines[0] != warcVersion {
+			t.Fatalf("%s: record %d is not WARC:\n%s", name, len(records), data)
+		}
+		rec := warcRecord{header: map[string]string{}}
+		for _, line := range lines[1:] {
+			k, v, _ := strings.Cut(line, ": ")
+			rec.header[k] = v
+		}
+		n, _ := strconv.Atoi(rec.header["Content-Length"])
+		if len(rest) != n+4 || !strings.HasSuffix(rest, "\r\n\r\n") {
+			t.Fatalf("%s: record %d: block of %d bytes, Content-Length %d", name, len(records), len(rest)-4, n)
+		}
+		rec.block = []byte(rest[:n])
+		records = append(records, rec)
+	}
+}
+
+func TestCrawlWritesWARC(t *testing.T) {
+	srv := newTestSite(t)
+	const maxSize = 2048
+	prefix := filepath.Join(t.TempDir(), "crawl")
+	var log strings.Builder
+	w, err := NewWARCWriter(prefix, maxSize, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := New(Options{Depth: 2, WARC: w})
+	if err := c.Run(context.Background(), srv.URL+"/"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(prefix + "-*.warc.gz")
+	if len(files) < 2 {
+		t.Fatalf("expected the archive to rotate past %d bytes, got %v", maxSize, files)
+	}
+	payloads := map[string]string{}
+	for i, name := range files {
+		if want := fmt.Sprintf("%s-%05d.warc.gz", prefix, i); name != want {
+			t.Errorf("file %d is %s, want %s", i, name, want)
+		}
+		if !strings.Contains(log.String(), "[WARC] "+name+"\n") {
+			t.Errorf("%s not logged:\n%s", name, log.String())
+		}
+		records := readWARC(t, name)
+		info := records[0]
+		if info.header["WARC-Type"] != "warcinfo" || info.header["WARC-Filename"] != name {
+			t.Fatalf("%s does not start with its warcinfo: %v", name, info.header)
+		}
+		if (len(records)-1)%3 != 0 || len(records) == 1 {
+			t.Fatalf("%s holds %d records, want warcinfo and whole exchanges", name, len(records))
+		}
+
+		// A file is only left once it reaches maxSize.
+		st, _ := os.Stat(name)
+		if i < len(files)-1 && st.Size() < maxSize {
+			t.Errorf("%s rotated at %d bytes, before %d", name, st.Size(), maxSize)
+		}
+
+		for j := 1; j < len(records); j += 3 {
+			resp, req, meta := records[j], records[j+1], records[j+2]
+			if resp.header["WARC-Type"] != "response" || req.header["WARC-Type"] != "request" || meta.header["WARC-Type"] != "metadata" {
+				t.Fatalf("%s: records %d-%d are %s, %s, %s", name, j, j+2,
+					resp.header["WARC-Type"], req.header["WARC-Type"], meta.header["WARC-Type"])
+			}
+			target := resp.header["WARC-Target-URI"]
+			respID := resp.header["WARC-Record-ID"]
+			for _, rec := range []warcRecord{req, meta} {
+				if rec.header["WARC-Concurrent-To"] != respID || rec.header["WARC-Target-URI"] != target {
+					t.Errorf("%s %s: concurrent to %s for %s, want %s for %s", name, rec.header["WARC-Type"],
+						rec.header["WARC-Concurrent-To"], rec.header["WARC-Target-URI"], respID, target)
+				}
+			}
+			for _, rec := range []warcRecord{resp, req, meta} {
+				if rec.header["WARC-Warcinfo-ID"] != info.header["WARC-Record-ID"] {
+					t.Errorf("%s %s of %s: warcinfo %s, want %s", name, rec.header["WARC-Type"], target,
+						rec.header["WARC-Warcinfo-ID"], info.header["WARC-Record-ID"])
+				}
+				if got := rec.header["WARC-Block-Digest"]; got != warcDigest(rec.block) {
+					t.Errorf("%s %s of %s: block digest %s, want %s", name, rec.header["WARC-Type"], target, got, warcDigest(rec.block))
+				}
+			}
+			_, payload, _ := strings.Cut(string(resp.block), "\r\n\r\n")
+			if got := resp.header["WARC-Payload-Digest"]; got != warcDigest([]byte(payload)) {
+				t.Errorf("%s response of %s: payload digest %s, want %s", name, target, got, warcDigest([]byte(payload)))
+			}
+			if !strings.HasPrefix(string(req.block), "GET ") {
+				t.Errorf("%s request of %s:\n%s", name, target, req.block)
+			}
+			payloads[target] = payload
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/robots.txt":     "User-agent: *\nDisallow: /private/\n",
+		"/docs/page.html": "<p>page</p>",
+		"/old":            "",
+		"/new":            "<p>moved here</p>",
+	} {
+		got, ok := payloads[srv.URL+path]
+		if !ok {
+			t.Errorf("no exchange archived for %s", path)
+		} else if want != "" && got != want {
+			t.Errorf("payload of %s = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCookiesFileRoundTrip(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]string{}
+	mux := http.NewServeMux()
+	record := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent[r.URL.Path] = r.Header.Get("Cookie")
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+	}
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		record(w, r)
+		http.SetCookie(w, &http.Cookie{Name: "seen", Value: "1", Path: "/", Expires: time.Unix(4102444800, 0)})
+		fmt.Fprint(w, `<a href="/docs/">docs</a>`)
+	})
+	mux.HandleFunc("/docs/{$}", func(w http.ResponseWriter, r *http.Request) {
+		record(w, r)
+		fmt.Fprint(w, `<p>docs</p>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	in := "# Netscape HTTP Cookie File\n" +
+		"# comment\n\n" +
+		".example.com\tTRUE\t/\tTRUE\t4102444800\tother\tsite\n" +
+		"127.0.0.1\tFALSE\t/\tFALSE\t4102444800\tsession\tabc\n" +
+		"#HttpOnly_127.0.0.1\tFALSE\t/docs/\tFALSE\t0\tpref\tdark\n" +
+		"127.0.0.1\tFALSE\t/\tFALSE\t1\tgone\told\n"
+	if err := os.WriteFile(filepath.Join(dir, "in.txt"), []byte(in), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jar, err := NewJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jar.LoadFile(filepath.Join(dir, "in.txt")); err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+
+	c, _ := New(Options{Depth: 1, Jar: jar})
+	if err := c.Run(context.Background(), srv.URL+"/"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := sent["/"]; got != "session=abc" {
+		t.Errorf("cookies sent to / = %q, want session=abc", got)
+	}
+	if got := sent["/docs/"]; !strings.Contains(got, "pref=dark") || !strings.Contains(got, "session=abc") || !strings.Contains(got, "seen=1") {
+		t.Errorf("cookies sent to /docs/ = %q", got)
+	}
+
+	if err := jar.SaveFile(filepath.Join(dir, "out.txt")); err != nil {
+		t.Fatalf("SaveFile() error = %v", err)
+	}
+	out, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
+	// The expired cookie is gone and the one the site set is added.
+	want := "# Netscape HTTP Cookie File\n" +
+		".example.com\tTRUE\t/\tTRUE\t4102444800\tother\tsite\n" +
+		"127.0.0.1\tFALSE\t/\tFALSE\t4102444800\tseen\t1\n" +
+		"127.0.0.1\tFALSE\t/\tFALSE\t4102444800\tsession\tabc\n" +
+		"#HttpOnly_127.0.0.1\tFALSE\t/docs/\tFALSE\t0\tpref\tdark\n"
+	if string(out) != want {
+		t.Errorf("saved cookies:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestJarSavesOnlyAcceptedCookies(t *testing.T) {
+	jar, _ := NewJar()
+	page, _ := url.Parse("http://www.example.com/docs/page.html")
+	jar.SetCookies(page, []*http.Cookie{
+		{Name: "ok", Value: "1"},
+		{Name: "site", Value: "2", Domain: "example.com"},
+		{Name: "foreign", Value: "3", Domain: "other.org"},
+		{Name: "suffix", Value: "4", Domain: "com"},
+	})
+	var out strings.Builder
+	if err := jar.write(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Netscape HTTP Cookie File\n" +
+		".example.com\tTRUE\t/docs\tFALSE\t0\tsite\t2\n" +
+		"www.example.com\tFALSE\t/docs\tFALSE\t0\tok\t1\n"
+	if out.String() != want {
+		t.Errorf("saved cookies:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestCrawlFormLogin(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("user") != "admin" || r.PostFormValue("pass") != "s3cret&more" {
+			http.Error(w, "wrong password", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "42", Path: "/", HttpOnly: true})
+	})
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("sid"); err != nil || c.Value != "42" {
+			http.Error(w, "log in first", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<p>members only</p>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	crawl := func(data string) (*MemoryStorage, error) {
+		jar, _ := NewJar()
+		store := NewMemoryStorage()
+		c, _ := New(Options{Storage: store, Jar: jar, LoginURL: srv.URL + "/login", LoginData: data})
+		return store, c.Run(context.Background(), srv.URL+"/")
+	}
+	store, err := crawl("user=admin&pass=s3cret%26more")
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if index, _ := store.Get(hostOf(srv) + "/index.html"); !strings.Contains(string(index), "members only") {
+		t.Errorf("index.html after login = %q", index)
+	}
+	if _, err := crawl("user=admin&pass=guess"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Run() with a wrong password: error = %v", err)
+	}
+}
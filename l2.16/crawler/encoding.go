@@ -0,0 +1,167 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+)
+
+const DefaultAcceptEncoding = "gzip, deflate, br, zstd"
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// decodeTransport advertises the content codings we can undo and strips
+// them from responses, so everything above it sees identity bodies while
+// the WARC layer below still records what went over the wire.
+type decodeTransport struct {
+	base           http.RoundTripper
+	acceptEncoding string
+}
+
+func (t *decodeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.acceptEncoding != "" && req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", t.acceptEncoding)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	codings := resp.Header.Get("Content-Encoding")
+	if codings == "" || req.Method == http.MethodHead {
+		return resp, nil
+	}
+
+	body, err := decodeBody(resp.Body, codings)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", req.URL, err)
+	}
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// decodeBody undoes the codings in the reverse of the order they were
+// applied, as listed in Content-Encoding.
+func decodeBody(body io.ReadCloser, codings string) (_ io.ReadCloser, err error) {
+	list := strings.Split(codings, ",")
+	var r io.Reader = body
+	closers := []io.Closer{body}
+	for i := len(list) - 1; i >= 0; i-- {
+		switch coding := strings.ToLower(strings.TrimSpace(list[i])); coding {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			var gz *gzip.Reader
+			if gz, err = gzip.NewReader(r); err != nil {
+				return nil, err
+			}
+			r = gz
+		case "deflate":
+			r = newDeflateReader(r)
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			var zr *zstd.Decoder
+			if zr, err = zstd.NewReader(r); err != nil {
+				return nil, err
+			}
+			defer func() {
+				if err != nil {
+					zr.Close()
+				}
+			}()
+			r = zr
+			closers = append(closers, zr.IOReadCloser())
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+	}
+	return &decodedBody{Reader: r, closers: closers}, nil
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	var err error
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		if cerr := b.closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newDeflateReader accepts both the zlib-wrapped stream the spec asks for
+// and the raw deflate stream some servers send instead.
+func newDeflateReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(2)
+	if len(head) == 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+// parseHTML decodes a stored page to UTF-8 using, in order, its BOM, the
+// Content-Type charset and <meta charset>, and returns the encoding so the
+// rewritten page can be written back in it.
+func parseHTML(content []byte, contentType string) (*html.Node, encoding.Encoding, bool, error) {
+	enc, name, certain := charset.DetermineEncoding(content, contentType)
+	if !certain && name == "windows-1252" && utf8.Valid(content) {
+		enc, name = encoding.Nop, "utf-8"
+	}
+	bom := bytes.HasPrefix(content, utf8BOM)
+
+	var r io.Reader = bytes.NewReader(content)
+	if name != "utf-8" {
+		r = enc.NewDecoder().Reader(r)
+	} else {
+		enc = nil
+		r = bytes.NewReader(bytes.TrimPrefix(content, utf8BOM))
+	}
+	doc, err := html.Parse(r)
+	return doc, enc, bom, err
+}
+
+// renderHTML writes doc in enc (nil means UTF-8). Characters the target
+// charset can't represent become numeric character references.
+func renderHTML(w io.Writer, doc *html.Node, enc encoding.Encoding, bom bool) error {
+	if bom {
+		if _, err := w.Write(utf8BOM); err != nil {
+			return err
+		}
+	}
+	if enc == nil {
+		return html.Render(w, doc)
+	}
+	ew := encoding.HTMLEscapeUnsupported(enc.NewEncoder()).Writer(w)
+	if err := html.Render(ew, doc); err != nil {
+		return err
+	}
+	if c, ok := ew.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package crawler
+
+import "sync"
+
+// frontier is an unbounded job queue. Push never blocks, so workers can
+// enqueue links while the queue is long without deadlocking each other.
+// It closes itself once every pushed job has been marked Done.
+type frontier struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []Job
+	pending int
+	closed  bool
+	// dropped holds the jobs left over by Close and pushed after it.
+	dropped []Job
+}
+
+func newFrontier() *frontier {
+	f := &frontier{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *frontier) Push(j Job) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		f.dropped = append(f.dropped, j)
+		return
+	}
+	f.queue = append(f.queue, j)
+	f.pending++
+	f.cond.Signal()
+}
+
+// Pop blocks until a job is available. ok is false once the frontier is
+// closed, either because the crawl finished or it was cancelled.
+func (f *frontier) Pop() (Job, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.queue) == 0 && !f.closed {
+		f.cond.Wait()
+	}
+	if f.closed {
+		return Job{}, false
+	}
+	j := f.queue[0]
+	f.queue[0] = Job{}
+	f.queue = f.queue[1:]
+	return j, true
+}
+
+// Hold keeps the frontier open while something outside the workers, like
+// the sitemap seeding in main, may still push jobs. Pair it with Done.
+func (f *frontier) Hold() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending++
+}
+
+func (f *frontier) Done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending--
+	if f.pending == 0 {
+		f.closed = true
+		f.cond.Broadcast()
+	}
+}
+
+// Close drops everything still queued, keeping it for TakeDropped, and
+// wakes all waiting workers.
+func (f *frontier) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.dropped = append(f.dropped, f.queue...)
+	f.queue = nil
+	f.cond.Broadcast()
+}
+
+// TakeDropped returns and forgets the jobs a closed frontier turned away.
+func (f *frontier) TakeDropped() []Job {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	jobs := f.dropped
+	f.dropped = nil
+	return jobs
+}
+
+func (f *frontier) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.queue)
+}
@@ -0,0 +1,189 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Lazy-loading libraries keep the real URL in data-* attributes and swap
+// it in from JavaScript.
+var lazyAssetAttrs = map[string]bool{
+	"data-src":        true,
+	"data-lazy-src":   true,
+	"data-original":   true,
+	"data-bg":         true,
+	"data-background": true,
+	"data-poster":     true,
+}
+
+var lazySrcsetAttrs = map[string]bool{
+	"data-srcset":      true,
+	"data-lazy-srcset": true,
+}
+
+func lazyRefKind(attr html.Attribute) refKind {
+	switch {
+	case attr.Namespace != "":
+		return refNone
+	case lazyAssetAttrs[attr.Key]:
+		return refAsset
+	case lazySrcsetAttrs[attr.Key]:
+		return refSrcset
+	}
+	return refNone
+}
+
+// jsPathLiteral matches quoted strings that look like a URL on some host
+// or an absolute path on this one. It is deliberately strict: no spaces,
+// backslashes or template interpolation.
+var jsPathLiteral = regexp.MustCompile("[\"'`]((?:https?:)?//[^\"'`\\s<>\\\\]+|/[A-Za-z0-9_\\-.~%][^\"'`\\s<>\\\\]*)[\"'`]")
+
+func scriptURLs(src []byte) []string {
+	var out []string
+	for _, m := range jsPathLiteral.FindAllSubmatch(src, -1) {
+		if s := string(m[1]); !strings.Contains(s, "${") {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// jsonLDURLs returns every string in a JSON-LD block that looks like a URL
+// or an absolute path.
+func jsonLDURLs(src string) []string {
+	var v any
+	if err := json.Unmarshal([]byte(src), &v); err != nil {
+		return nil
+	}
+	var out []string
+	var walk func(any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") ||
+				(strings.HasPrefix(v, "/") && !strings.HasPrefix(v, "//")) {
+				out = append(out, v)
+			}
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		case map[string]any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return out
+}
+
+func isJSONLD(n *html.Node) bool {
+	return strings.EqualFold(strings.TrimSpace(getAttr(n, "type")), "application/ld+json")
+}
+
+func isJavaScript(n *html.Node) bool {
+	switch strings.ToLower(strings.TrimSpace(getAttr(n, "type"))) {
+	case "", "module", "text/javascript", "application/javascript":
+		return true
+	}
+	return false
+}
+
+// looksLikePage guesses whether a URL found in a script is a document or
+// a static asset from its file extension.
+func looksLikePage(ref string) bool {
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref = ref[:i]
+	}
+	switch strings.ToLower(path.Ext(ref)) {
+	case "", ".html", ".htm", ".php", ".asp", ".aspx", ".jsp":
+		return true
+	}
+	return false
+}
+
+// scriptText returns the content of a raw-text element such as <script>
+// or <noscript>, which the parser keeps as a single text child.
+func scriptText(n *html.Node) (*html.Node, bool) {
+	c := n.FirstChild
+	if c == nil || c.Type != html.TextNode || c.NextSibling != nil {
+		return nil, false
+	}
+	return c, true
+}
+
+// rewriteNoscript parses the markup of a <noscript> element, which the
+// scripting-enabled parser leaves as text, lets walk rewrite it and puts
+// the result back.
+func rewriteNoscript(n *html.Node, walk func(*html.Node)) {
+	text, ok := scriptText(n)
+	if !ok {
+		return
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(text.Data), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		walk(node)
+		if err := html.Render(&buf, node); err != nil {
+			return
+		}
+	}
+	text.Data = buf.String()
+}
+
+// followScriptLinks applies the Heuristics option to one element. URLs
+// found in scripts are fetched but left as they are in the page, since
+// rewriting code would be guesswork.
+func (c *Crawler) followScriptLinks(n *html.Node, name string, rewrite func(string, bool) string, walk func(*html.Node)) {
+	switch n.Data {
+	case "noscript":
+		rewriteNoscript(n, walk)
+	case "script":
+		var refs []string
+		switch {
+		case isJSONLD(n):
+			if text, ok := scriptText(n); ok {
+				refs = jsonLDURLs(text.Data)
+			}
+		case !isJavaScript(n):
+		case getAttr(n, "src") != "":
+			// The attribute pass has already fetched the script and
+			// pointed src at the stored copy.
+			if src := getAttr(n, "src"); !strings.Contains(src, ":") && !strings.HasPrefix(src, "/") {
+				refs = scriptURLs(c.readStored(path.Join(path.Dir(name), src)))
+			}
+		default:
+			if text, ok := scriptText(n); ok {
+				refs = scriptURLs([]byte(text.Data))
+			}
+		}
+		for _, ref := range refs {
+			rewrite(ref, looksLikePage(ref))
+		}
+	}
+}
+
+func (c *Crawler) readStored(name string) []byte {
+	f, err := c.opts.Storage.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	return data
+}
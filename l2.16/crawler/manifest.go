@@ -0,0 +1,86 @@
+package crawler
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ManifestName is the storage name of the manifest written at the end of
+// every crawl that keeps files. It sits next to the host directories.
+const ManifestName = ".mirror-manifest.json"
+
+// ManifestEntry records where a URL ended up and what the server said it
+// was, so the mirror can be served back faithfully.
+type ManifestEntry struct {
+	URL         string `json:"url"`
+	Name        string `json:"name"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// Manifest maps every fetched URL, redirect sources included, to the file
+// that holds it.
+type Manifest struct {
+	mu      sync.Mutex
+	entries map[string]ManifestEntry
+}
+
+func NewManifest() *Manifest {
+	return &Manifest{entries: make(map[string]ManifestEntry)}
+}
+
+func (m *Manifest) Add(e ManifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[e.URL] = e
+}
+
+func (m *Manifest) Lookup(rawurl string) (ManifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[rawurl]
+	return e, ok
+}
+
+// ContentType returns the recorded Content-Type of a stored file.
+func (m *Manifest) ContentType(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.entries {
+		if e.Name == name && e.ContentType != "" {
+			return e.ContentType
+		}
+	}
+	return ""
+}
+
+// Entries returns the entries sorted by URL.
+func (m *Manifest) Entries() []ManifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]ManifestEntry, 0, len(m.entries))
+	for _, e := range m.entries {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m.Entries())
+}
+
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var entries []ManifestEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+	m := NewManifest()
+	for _, e := range entries {
+		m.Add(e)
+	}
+	return m, nil
+}
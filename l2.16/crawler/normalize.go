@@ -0,0 +1,145 @@
+package crawler
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type normalizer struct {
+	sortQuery  bool
+	dropParams []string
+}
+
+// normalize maps equivalent spellings of a URL onto one canonical string:
+// lowercase scheme and host, no default port, no dot segments, no fragment,
+// and optionally sorted / filtered query parameters.
+func (n normalizer) normalize(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = normalizeHost(u.Scheme, u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	if u.Path == "" && u.Host != "" {
+		u.Path = "/"
+	}
+	if u.Path != "" {
+		// Dot segments are removed from the escaped path, so that an encoded
+		// slash such as /a%2Fb stays part of its segment, but only once
+		// escaped dots like %2E%2E have been decoded.
+		escaped := removeDotSegments(decodeUnreserved(u.EscapedPath()))
+		p, err := url.PathUnescape(escaped)
+		if err != nil {
+			return "", err
+		}
+		u.Path, u.RawPath = p, escaped
+	}
+
+	if u.RawQuery != "" && (n.sortQuery || len(n.dropParams) > 0) {
+		u.RawQuery = n.normalizeQuery(u.RawQuery)
+	}
+	return u.String(), nil
+}
+
+func normalizeHost(scheme, host string) string {
+	host = strings.ToLower(host)
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return host
+}
+
+// decodeUnreserved decodes the escapes of unreserved characters, which
+// mean the same unescaped, and uppercases the hex digits of the others
+// (RFC 3986, section 6.2.2).
+func decodeUnreserved(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			b.WriteByte(s[i])
+			continue
+		}
+		if isUnreserved(byte(c)) {
+			b.WriteByte(byte(c))
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	cleaned := path.Clean(p)
+	if cleaned != "/" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")) {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// normalizeQuery keeps the raw encoding of each pair so only their order and
+// presence change.
+func (n normalizer) normalizeQuery(raw string) string {
+	pairs := strings.Split(raw, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		if pair == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(pair, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if n.isDropped(key) {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	if n.sortQuery {
+		sort.Strings(kept)
+	}
+	return strings.Join(kept, "&")
+}
+
+func (n normalizer) isDropped(key string) bool {
+	for _, p := range n.dropParams {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
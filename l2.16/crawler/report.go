@@ -0,0 +1,184 @@
+package crawler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ReportEntry struct {
+	URL         string   `json:"url"`
+	Referrers   []string `json:"referrers,omitempty"`
+	Status      int      `json:"status"`
+	ContentType string   `json:"content_type,omitempty"`
+	Size        int64    `json:"size"`
+	Redirects   []string `json:"redirects,omitempty"`
+	DurationMs  int64    `json:"duration_ms"`
+	Error       string   `json:"error,omitempty"`
+	// Skipped tells why the URL was deliberately not fetched, such as a
+	// robots.txt rule. Skipped URLs are not broken.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+func (e *ReportEntry) Broken() bool {
+	return e.Skipped == "" && (e.Error != "" || e.Status >= 400)
+}
+
+// Report keeps one entry per fetched URL. The same URL may be requested
+// from several pages; every referrer is kept, the first fetch wins.
+type Report struct {
+	mu      sync.Mutex
+	entries map[string]*ReportEntry
+	order   []string
+}
+
+func NewReport() *Report {
+	return &Report{entries: make(map[string]*ReportEntry)}
+}
+
+func (r *Report) Add(e ReportEntry, referrer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.entries[e.URL]
+	if !ok {
+		existing = &e
+		existing.Referrers = nil
+		r.entries[e.URL] = existing
+		r.order = append(r.order, e.URL)
+	}
+	if referrer != "" && !hasKey(existing.Referrers, referrer) {
+		existing.Referrers = append(existing.Referrers, referrer)
+	}
+}
+
+func (r *Report) AddReferrer(rawurl, referrer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[rawurl]; ok && referrer != "" && !hasKey(e.Referrers, referrer) {
+		e.Referrers = append(e.Referrers, referrer)
+	}
+}
+
+func (r *Report) Entries() []ReportEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]ReportEntry, 0, len(r.order))
+	for _, u := range r.order {
+		out = append(out, *r.entries[u])
+	}
+	return out
+}
+
+// BrokenBySource groups broken URLs under each page that links to them.
+func (r *Report) BrokenBySource() map[string][]string {
+	broken := make(map[string][]string)
+	for _, e := range r.Entries() {
+		if !e.Broken() {
+			continue
+		}
+		sources := e.Referrers
+		if len(sources) == 0 {
+			sources = []string{""}
+		}
+		for _, src := range sources {
+			broken[src] = append(broken[src], e.URL)
+		}
+	}
+	return broken
+}
+
+func (r *Report) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = r.WriteCSV(f)
+	} else {
+		err = r.WriteJSON(f)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Entries []ReportEntry       `json:"entries"`
+		Broken  map[string][]string `json:"broken_by_source"`
+	}{r.Entries(), r.BrokenBySource()})
+}
+
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"url", "referrers", "status", "content_type", "size", "redirects", "duration_ms", "error", "skipped"})
+	for _, e := range r.Entries() {
+		cw.Write([]string{
+			e.URL,
+			strings.Join(e.Referrers, " "),
+			strconv.Itoa(e.Status),
+			e.ContentType,
+			strconv.FormatInt(e.Size, 10),
+			strings.Join(e.Redirects, " "),
+			strconv.FormatInt(e.DurationMs, 10),
+			e.Error,
+			e.Skipped,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *Report) PrintSummary(w io.Writer) {
+	entries := r.Entries()
+	broken := r.BrokenBySource()
+	nBroken, nSkipped := 0, 0
+	for _, e := range entries {
+		switch {
+		case e.Broken():
+			nBroken++
+		case e.Skipped != "":
+			nSkipped++
+		}
+	}
+	fmt.Fprintf(w, "Проверено URL: %d, битых ссылок: %d, пропущено: %d\n", len(entries), nBroken, nSkipped)
+
+	sources := make([]string, 0, len(broken))
+	for src := range broken {
+		sources = append(sources, src)
+	}
+	sort.Strings(sources)
+	for _, src := range sources {
+		if src == "" {
+			fmt.Fprintln(w, "(start)")
+		} else {
+			fmt.Fprintln(w, src)
+		}
+		for _, u := range broken[src] {
+			fmt.Fprintln(w, "  ->", u)
+		}
+	}
+}
+
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for prev := resp.Request.Response; prev != nil; prev = prev.Request.Response {
+		chain = append([]string{prev.Request.URL.String()}, chain...)
+	}
+	if len(chain) > 0 {
+		chain = append(chain, resp.Request.URL.String())
+	}
+	return chain
+}
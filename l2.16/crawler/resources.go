@@ -0,0 +1,229 @@
+package crawler
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+type refKind int
+
+const (
+	refNone refKind = iota
+	refAsset
+	refPage
+	refSrcset
+	refRefresh
+)
+
+var assetAttrs = map[string][]string{
+	"img":    {"src"},
+	"source": {"src"},
+	"video":  {"src", "poster"},
+	"audio":  {"src"},
+	"track":  {"src"},
+	"script": {"src"},
+	"embed":  {"src"},
+	"object": {"data"},
+	"input":  {"src"},
+}
+
+var pageAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"iframe": {"src"},
+	"frame":  {"src"},
+	"form":   {"action"},
+}
+
+var skippedLinkRels = map[string]bool{
+	"preconnect":   true,
+	"dns-prefetch": true,
+	"canonical":    true,
+	"alternate":    true,
+	"search":       true,
+}
+
+func refKindOf(n *html.Node, attr html.Attribute) refKind {
+	if n.Namespace == "svg" {
+		if attr.Key == "href" && (attr.Namespace == "xlink" || attr.Namespace == "") {
+			if n.Data == "a" {
+				return refPage
+			}
+			if n.Data == "use" || n.Data == "image" || n.Data == "feImage" {
+				return refAsset
+			}
+		}
+		return refNone
+	}
+	if attr.Namespace != "" {
+		return refNone
+	}
+
+	switch n.Data {
+	case "img", "source":
+		if attr.Key == "srcset" {
+			return refSrcset
+		}
+	case "link":
+		if attr.Key == "imagesrcset" {
+			return refSrcset
+		}
+		if attr.Key == "href" && isDownloadableLink(n) {
+			return refAsset
+		}
+		return refNone
+	case "meta":
+		if attr.Key == "content" && strings.EqualFold(getAttr(n, "http-equiv"), "refresh") {
+			return refRefresh
+		}
+		return refNone
+	case "input":
+		if !strings.EqualFold(getAttr(n, "type"), "image") {
+			return refNone
+		}
+	}
+
+	if hasKey(assetAttrs[n.Data], attr.Key) {
+		return refAsset
+	}
+	if hasKey(pageAttrs[n.Data], attr.Key) {
+		return refPage
+	}
+	return refNone
+}
+
+func isDownloadableLink(n *html.Node) bool {
+	rels := strings.Fields(strings.ToLower(getAttr(n, "rel")))
+	if len(rels) == 0 {
+		return true
+	}
+	for _, rel := range rels {
+		if !skippedLinkRels[rel] {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// findBase returns the first <base href> element of the document, if any.
+func findBase(n *html.Node) *html.Node {
+	if n.Type == html.ElementNode && n.Data == "base" && getAttr(n, "href") != "" {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if b := findBase(c); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+func removeAttr(n *html.Node, key string) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+type srcsetCandidate struct {
+	URL        string
+	Descriptor string
+}
+
+// parseSrcset splits a srcset value into candidates following the WHATWG
+// algorithm closely enough for real pages: URLs may contain commas, only a
+// trailing comma terminates a URL without descriptors.
+func parseSrcset(s string) []srcsetCandidate {
+	var out []srcsetCandidate
+	i := 0
+	for i < len(s) {
+		for i < len(s) && (isSpace(s[i]) || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		start := i
+		for i < len(s) && !isSpace(s[i]) {
+			i++
+		}
+		u := s[start:i]
+		desc := ""
+		if strings.HasSuffix(u, ",") {
+			u = strings.TrimRight(u, ",")
+		} else {
+			start = i
+			for i < len(s) && s[i] != ',' {
+				i++
+			}
+			desc = strings.TrimSpace(s[start:i])
+		}
+		if u != "" {
+			out = append(out, srcsetCandidate{URL: u, Descriptor: desc})
+		}
+	}
+	return out
+}
+
+func formatSrcset(cands []srcsetCandidate) string {
+	parts := make([]string, len(cands))
+	for i, c := range cands {
+		if c.Descriptor != "" {
+			parts[i] = c.URL + " " + c.Descriptor
+		} else {
+			parts[i] = c.URL
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// parseRefresh splits a meta refresh value like `5; url='/next'` into the
+// delay and the target URL. ok is false when there is no URL part.
+func parseRefresh(content string) (delay, target string, ok bool) {
+	delay, rest, found := strings.Cut(content, ";")
+	if !found {
+		delay, rest, found = strings.Cut(content, ",")
+	}
+	delay = strings.TrimSpace(delay)
+	if !found {
+		return delay, "", false
+	}
+	rest = strings.TrimSpace(rest)
+	if len(rest) >= 4 && strings.EqualFold(rest[:3], "url") {
+		if r := strings.TrimSpace(rest[3:]); strings.HasPrefix(r, "=") {
+			rest = strings.TrimSpace(r[1:])
+		}
+	}
+	rest = strings.Trim(rest, `"'`)
+	if rest == "" {
+		return delay, "", false
+	}
+	return delay, rest, true
+}
@@ -0,0 +1,71 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type robotsRules struct {
+	disallow []string
+	sitemaps []string
+}
+
+func (c *Crawler) loadRobots(ctx context.Context, startURL string) {
+	u, _ := url.Parse(startURL)
+	robotsURL := fmt.Sprintf("%s://%s/robots.txt", u.Scheme, u.Host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	var userAgentAllowed = false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(strings.ToLower(line), "sitemap:") {
+			if sm := strings.TrimSpace(line[len("sitemap:"):]); sm != "" {
+				c.robots.sitemaps = append(c.robots.sitemaps, sm)
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(line), "user-agent:") {
+			ua := strings.ToLower(strings.TrimSpace(line[len("user-agent:"):]))
+			if ua == "*" {
+				userAgentAllowed = true
+			} else {
+				userAgentAllowed = false
+			}
+		}
+		if userAgentAllowed && strings.HasPrefix(strings.ToLower(line), "disallow:") {
+			path := strings.TrimSpace(line[len("disallow:"):])
+			if path != "" {
+				c.robots.disallow = append(c.robots.disallow, path)
+			}
+		}
+	}
+}
+
+func (c *Crawler) isAllowedByRobots(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	for _, p := range c.robots.disallow {
+		if strings.HasPrefix(u.Path, p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+package crawler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MirrorHandler serves a mirror tree written by FSStorage. Requests are
+// mapped back to the URLs they were crawled from, either as
+// /<host>/<path> or, when the mirror holds a single host, as /<path>.
+// Requests that fall into a gap of the mirror are remembered so they can
+// be crawled later.
+type MirrorHandler struct {
+	// Log receives one line per missing URL. Nil discards them.
+	Log io.Writer
+
+	fsys     fs.FS
+	manifest *Manifest
+	hosts    []string
+	schemes  map[string]string
+
+	mu      sync.Mutex
+	missing map[string]int
+}
+
+func NewMirrorHandler(fsys fs.FS) (*MirrorHandler, error) {
+	h := &MirrorHandler{
+		fsys:     fsys,
+		manifest: NewManifest(),
+		schemes:  make(map[string]string),
+		missing:  make(map[string]int),
+	}
+	if f, err := fsys.Open(ManifestName); err == nil {
+		m, err := ReadManifest(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ManifestName, err)
+		}
+		h.manifest = m
+		for _, e := range m.Entries() {
+			if u, err := url.Parse(e.URL); err == nil {
+				h.schemes[u.Host] = u.Scheme
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			h.hosts = append(h.hosts, e.Name())
+		}
+	}
+	if len(h.hosts) == 0 {
+		return nil, errors.New("mirror is empty")
+	}
+	return h, nil
+}
+
+// Missing returns the URLs that were requested but not mirrored, sorted.
+func (h *MirrorHandler) Missing() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]string, 0, len(h.missing))
+	for u := range h.missing {
+		out = append(out, u)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (h *MirrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, p := h.split(r.URL.Path)
+	if host == "" {
+		h.serveHosts(w)
+		return
+	}
+	scheme := h.schemes[host]
+	if scheme == "" {
+		scheme = "http"
+	}
+	orig := &url.URL{Scheme: scheme, Host: host, Path: p, RawQuery: r.URL.RawQuery}
+
+	for _, name := range h.candidates(orig) {
+		f, err := h.fsys.Open(name)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			f.Close()
+			if err == nil && !strings.HasSuffix(r.URL.Path, "/") {
+				http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+			continue
+		}
+		defer f.Close()
+		if ct := h.contentType(name); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		if rs, ok := f.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", info.ModTime(), rs)
+			return
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+		return
+	}
+
+	h.mu.Lock()
+	h.missing[orig.String()]++
+	first := h.missing[orig.String()] == 1
+	h.mu.Unlock()
+	if first && h.Log != nil {
+		fmt.Fprintln(h.Log, "[MISSING]", orig)
+	}
+	http.Error(w, "не скачано: "+orig.String(), http.StatusNotFound)
+}
+
+// split picks the host directory a request path refers to. A leading
+// segment naming a host wins; otherwise a single-host mirror is served
+// from the root.
+func (h *MirrorHandler) split(p string) (host, rest string) {
+	first, rest, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	for _, name := range h.hosts {
+		if name == first {
+			return name, "/" + rest
+		}
+	}
+	if len(h.hosts) == 1 {
+		return h.hosts[0], p
+	}
+	return "", p
+}
+
+// candidates lists the storage names that may hold u: whatever the
+// manifest recorded, the name the crawler would give it, and that name
+// with an .html extension added.
+func (h *MirrorHandler) candidates(u *url.URL) []string {
+	var names []string
+	if e, ok := h.manifest.Lookup(u.String()); ok {
+		names = append(names, e.Name)
+	}
+	name := NameFor(u)
+	if name == "" {
+		return names
+	}
+	names = append(names, name)
+	if !strings.HasSuffix(name, ".html") {
+		names = append(names, name+".html")
+	}
+	return names
+}
+
+func (h *MirrorHandler) contentType(name string) string {
+	if ct := h.manifest.ContentType(name); ct != "" {
+		return ct
+	}
+	// Query-encoded names like "list@page=2" carry no extension of their
+	// own; let ServeContent sniff those.
+	base, _, _ := strings.Cut(path.Base(name), "@")
+	return mime.TypeByExtension(path.Ext(base))
+}
+
+func (h *MirrorHandler) serveHosts(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, "<!doctype html><title>mirror</title><ul>\n")
+	for _, host := range h.hosts {
+		fmt.Fprintf(w, "<li><a href=\"/%s/\">%s</a></li>\n", url.PathEscape(host), html.EscapeString(host))
+	}
+	fmt.Fprint(w, "</ul>\n")
+}
@@ -0,0 +1,160 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const maxSitemapNesting = 3
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+// sitemapDoc covers <urlset>, <sitemapindex>, RSS <rss><channel> and Atom
+// <feed> documents: encoding/xml ignores the elements that don't apply.
+type sitemapDoc struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+	Items    []struct {
+		Link string `xml:"link"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		Links []atomLink `xml:"link"`
+	} `xml:"entry"`
+}
+
+// seedFrontier enqueues every in-scope page listed in the site's sitemaps
+// and the given feeds. Entries count as links from the start page.
+func (c *Crawler) seedFrontier(ctx context.Context, startURL string, feeds []string, depth int, fr *frontier) {
+	sources := c.robots.sitemaps
+	if len(sources) == 0 {
+		u, err := url.Parse(startURL)
+		if err != nil {
+			return
+		}
+		sources = []string{fmt.Sprintf("%s://%s/sitemap.xml", u.Scheme, u.Host)}
+	}
+	sources = append(sources, feeds...)
+
+	for _, src := range sources {
+		c.enqueueSitemap(ctx, src, depth, fr)
+	}
+}
+
+func (c *Crawler) enqueueSitemap(ctx context.Context, src string, depth int, fr *frontier) {
+	for _, page := range c.fetchSitemap(ctx, src, 0) {
+		if !c.inScope(page) {
+			continue
+		}
+		fr.Push(Job{URL: page, Referrer: src, Depth: depth - 1})
+	}
+}
+
+func (c *Crawler) fetchSitemap(ctx context.Context, rawurl string, level int) []string {
+	c.seenSitemapsMu.Lock()
+	if c.seenSitemaps[rawurl] || level > maxSitemapNesting {
+		c.seenSitemapsMu.Unlock()
+		return nil
+	}
+	c.seenSitemaps[rawurl] = true
+	c.seenSitemapsMu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logln("[ERR sitemap]", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.logln("[ERR sitemap]", rawurl, resp.Status)
+		return nil
+	}
+
+	body, err := maybeGunzip(io.LimitReader(resp.Body, c.opts.MaxFileSize))
+	if err != nil {
+		c.logln("[ERR sitemap]", rawurl, err)
+		return nil
+	}
+	// The limit holds for the unpacked sitemap too, or a small gzip bomb
+	// would expand without bound.
+	body = io.LimitReader(body, c.opts.MaxFileSize)
+
+	var doc sitemapDoc
+	if err := xml.NewDecoder(body).Decode(&doc); err != nil {
+		c.logln("[ERR sitemap]", rawurl, err)
+		return nil
+	}
+	c.logln("[SITEMAP]", rawurl)
+
+	var pages []string
+	add := func(ref string) {
+		if abs := c.resolveURL(rawurl, ref); abs != "" {
+			pages = append(pages, abs)
+		}
+	}
+	for _, loc := range doc.URLs {
+		add(loc.Loc)
+	}
+	for _, item := range doc.Items {
+		add(item.Link)
+	}
+	for _, entry := range doc.Entries {
+		for _, l := range entry.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				add(l.Href)
+			}
+		}
+	}
+	for _, sm := range doc.Sitemaps {
+		if child := c.resolveURL(rawurl, sm.Loc); child != "" {
+			pages = append(pages, c.fetchSitemap(ctx, child, level+1)...)
+		}
+	}
+	return pages
+}
+
+// maybeGunzip sniffs the gzip magic bytes instead of trusting the URL suffix
+// or Content-Type, since servers disagree on how to label .xml.gz files.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func isFeedLink(n *html.Node) bool {
+	if n.Data != "link" {
+		return false
+	}
+	rels := strings.Fields(strings.ToLower(getAttr(n, "rel")))
+	if !hasKey(rels, "alternate") {
+		return false
+	}
+	switch strings.ToLower(getAttr(n, "type")) {
+	case "application/rss+xml", "application/atom+xml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package crawler
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+type workerStats struct {
+	id    int
+	mu    sync.Mutex
+	url   string
+	bytes atomic.Int64
+	done  atomic.Int64
+}
+
+func (ws *workerStats) setURL(u string) {
+	ws.mu.Lock()
+	ws.url = u
+	ws.mu.Unlock()
+}
+
+func (ws *workerStats) currentURL() string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.url
+}
+
+type workerKey struct{}
+
+func withWorker(ctx context.Context, ws *workerStats) context.Context {
+	return context.WithValue(ctx, workerKey{}, ws)
+}
+
+func workerFrom(ctx context.Context) *workerStats {
+	ws, _ := ctx.Value(workerKey{}).(*workerStats)
+	return ws
+}
+
+// countingReader credits downloaded bytes to the worker as they arrive so
+// throughput is visible while a large file is still in flight.
+type countingReader struct {
+	r  io.Reader
+	ws *workerStats
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.ws != nil {
+		c.ws.bytes.Add(int64(n))
+	}
+	return n, err
+}
+
+type WorkerProgress struct {
+	ID    int
+	URL   string
+	Bytes int64
+	Done  int64
+}
+
+type Progress struct {
+	Queued  int
+	Workers []WorkerProgress
+}
+
+// Progress returns a snapshot of the running crawl for status displays.
+func (c *Crawler) Progress() Progress {
+	var p Progress
+	if c.frontier != nil {
+		p.Queued = c.frontier.Len()
+	}
+	for _, ws := range c.workers {
+		p.Workers = append(p.Workers, WorkerProgress{
+			ID:    ws.id,
+			URL:   ws.currentURL(),
+			Bytes: ws.bytes.Load(),
+			Done:  ws.done.Load(),
+		})
+	}
+	return p
+}
@@ -0,0 +1,302 @@
+package crawler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage holds the mirrored files under slash-separated names such as
+// "example.com/css/site.css". Pages are written once as downloaded and
+// again after their links are rewritten, so Create must replace.
+type Storage interface {
+	Create(name string) (File, error)
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// File is a pending write. Nothing is visible under its name until Commit;
+// Abort discards it.
+type File interface {
+	io.Writer
+	Commit() error
+	Abort() error
+}
+
+// FSStorage writes the mirror tree into a directory, renaming temp files
+// into place on Commit.
+type FSStorage struct {
+	dir string
+}
+
+func NewFSStorage(dir string) (*FSStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FSStorage{dir: dir}, nil
+}
+
+func (s *FSStorage) Dir() string {
+	return s.dir
+}
+
+// path maps name into the directory, refusing names that would land
+// outside it, absolute ones and those climbing out with "..", or onto the
+// directory itself.
+func (s *FSStorage) path(name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(rel) || rel == "." {
+		return "", fmt.Errorf("storage name %q leaves %s", name, s.dir)
+	}
+	return filepath.Join(s.dir, rel), nil
+}
+
+func (s *FSStorage) Create(name string) (File, error) {
+	target, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".part-*")
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{File: tmp, target: target}, nil
+}
+
+func (s *FSStorage) Open(name string) (io.ReadCloser, error) {
+	target, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(target)
+}
+
+func (s *FSStorage) Close() error {
+	return nil
+}
+
+type fsFile struct {
+	*os.File
+	target string
+}
+
+func (f *fsFile) Commit() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.target)
+}
+
+func (f *fsFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// MemoryStorage keeps every file in memory. It is meant for tests and for
+// crawls, like link checking, whose files are not needed afterwards.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string][]byte)}
+}
+
+func (s *MemoryStorage) Create(name string) (File, error) {
+	return &memFile{s: s, name: name}, nil
+}
+
+func (s *MemoryStorage) Open(name string) (io.ReadCloser, error) {
+	data, ok := s.Get(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Get returns the committed content of name.
+func (s *MemoryStorage) Get(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	return data, ok
+}
+
+// Names lists the stored files in sorted order.
+func (s *MemoryStorage) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+type memFile struct {
+	bytes.Buffer
+	s    *MemoryStorage
+	name string
+}
+
+func (f *memFile) Commit() error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	f.s.files[f.name] = f.Bytes()
+	return nil
+}
+
+func (f *memFile) Abort() error {
+	f.Reset()
+	return nil
+}
+
+// ArchiveStorage stages the mirror in a temporary directory and packs it
+// into a zip, tar or tar.gz archive on Close, since pages are rewritten
+// after download and archive formats can't replace an entry in place.
+type ArchiveStorage struct {
+	*FSStorage
+	archive string
+}
+
+func NewArchiveStorage(archive string) (*ArchiveStorage, error) {
+	if archiveFormat(archive) == "" {
+		return nil, fmt.Errorf("unsupported archive %q: use .zip, .tar or .tar.gz", archive)
+	}
+	tmp, err := os.MkdirTemp("", "mirror-stage-")
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveStorage{FSStorage: &FSStorage{dir: tmp}, archive: archive}, nil
+}
+
+func archiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tgz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+func (s *ArchiveStorage) Close() error {
+	defer os.RemoveAll(s.dir)
+
+	out, err := os.Create(s.archive)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	switch archiveFormat(s.archive) {
+	case "zip":
+		err = s.writeZip(out)
+	case "tgz":
+		gz := gzip.NewWriter(out)
+		if err = s.writeTar(gz); err == nil {
+			err = gz.Close()
+		}
+	default:
+		err = s.writeTar(out)
+	}
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func (s *ArchiveStorage) walk(fn func(name string, info fs.FileInfo, path string) error) error {
+	return filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".part-") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info, p)
+	})
+}
+
+func (s *ArchiveStorage) writeZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := s.walk(func(name string, info fs.FileInfo, p string) error {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Method = zip.Deflate
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return copyFile(dst, p)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (s *ArchiveStorage) writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := s.walk(func(name string, info fs.FileInfo, p string) error {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    info.Size(),
+			ModTime: info.ModTime().Truncate(time.Second),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return copyFile(tw, p)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func copyFile(dst io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	return err
+}
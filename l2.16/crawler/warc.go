@@ -0,0 +1,238 @@
+package crawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const warcVersion = "WARC/1.1"
+
+type warcHeader struct {
+	name, value string
+}
+
+// WARCWriter appends gzipped WARC 1.1 records (one gzip member per record)
+// to a series of files named <prefix>-NNNNN.warc.gz, starting a new file
+// once the current one reaches maxSize bytes.
+type WARCWriter struct {
+	// Log receives a line for every file started. Nil discards them.
+	Log io.Writer
+
+	mu         sync.Mutex
+	prefix     string
+	maxSize    int64
+	seq        int
+	file       *os.File
+	written    int64
+	warcinfoID string
+}
+
+// NewWARCWriter opens the first file right away, logging it to log like
+// every later one.
+func NewWARCWriter(prefix string, maxSize int64, log io.Writer) (*WARCWriter, error) {
+	w := &WARCWriter{Log: log, prefix: prefix, maxSize: maxSize}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WARCWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *WARCWriter) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%s-%05d.warc.gz", w.prefix, w.seq)
+	w.seq++
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.written = 0
+	if w.Log != nil {
+		fmt.Fprintln(w.Log, "[WARC]", name)
+	}
+
+	info := "software: l2.16 mirror\r\n" +
+		"format: WARC File Format 1.1\r\n" +
+		"conformsTo: https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n" +
+		"robots: obey\r\n"
+	w.warcinfoID = newRecordID()
+	return w.writeRecord(w.warcinfoID, "warcinfo", "", "application/warc-fields", []byte(info), nil)
+}
+
+// writeRecord must be called with w.mu held.
+func (w *WARCWriter) writeRecord(id, typ, target, contentType string, block []byte, extra []warcHeader) error {
+	headers := []warcHeader{
+		{"WARC-Type", typ},
+		{"WARC-Record-ID", id},
+		{"WARC-Date", time.Now().UTC().Format("2006-01-02T15:04:05.000000Z")},
+	}
+	if target != "" {
+		headers = append(headers, warcHeader{"WARC-Target-URI", target})
+	}
+	if typ != "warcinfo" {
+		headers = append(headers, warcHeader{"WARC-Warcinfo-ID", w.warcinfoID})
+	} else {
+		headers = append(headers, warcHeader{"WARC-Filename", w.file.Name()})
+	}
+	headers = append(headers, extra...)
+	headers = append(headers,
+		warcHeader{"Content-Type", contentType},
+		warcHeader{"WARC-Block-Digest", warcDigest(block)},
+		warcHeader{"Content-Length", fmt.Sprint(len(block))},
+	)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprintf(gz, "%s\r\n", warcVersion)
+	for _, h := range headers {
+		fmt.Fprintf(gz, "%s: %s\r\n", h.name, h.value)
+	}
+	io.WriteString(gz, "\r\n")
+	gz.Write(block)
+	io.WriteString(gz, "\r\n\r\n")
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	n, err := w.file.Write(buf.Bytes())
+	w.written += int64(n)
+	return err
+}
+
+// WriteExchange records one request/response pair plus a metadata record
+// with the fetch timing. The three records always land in the same file.
+func (w *WARCWriter) WriteExchange(req *http.Request, resp *http.Response, body []byte, truncated bool, elapsed time.Duration) error {
+	var reqBlock bytes.Buffer
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&reqBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), host)
+	writeHeaderSorted(&reqBlock, req.Header)
+	reqBlock.WriteString("\r\n")
+
+	var respBlock bytes.Buffer
+	fmt.Fprintf(&respBlock, "%s %s\r\n", resp.Proto, resp.Status)
+	writeHeaderSorted(&respBlock, resp.Header)
+	respBlock.WriteString("\r\n")
+	respBlock.Write(body)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if w.maxSize > 0 && w.written >= w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	target := req.URL.String()
+	respID := newRecordID()
+	respExtra := []warcHeader{{"WARC-Payload-Digest", warcDigest(body)}}
+	if truncated {
+		respExtra = append(respExtra, warcHeader{"WARC-Truncated", "length"})
+	}
+	if err := w.writeRecord(respID, "response", target, "application/http;msgtype=response", respBlock.Bytes(), respExtra); err != nil {
+		return err
+	}
+	if err := w.writeRecord(newRecordID(), "request", target, "application/http;msgtype=request", reqBlock.Bytes(),
+		[]warcHeader{{"WARC-Concurrent-To", respID}}); err != nil {
+		return err
+	}
+	meta := fmt.Sprintf("fetchTimeMs: %d\r\n", elapsed.Milliseconds())
+	return w.writeRecord(newRecordID(), "metadata", target, "application/warc-fields", []byte(meta),
+		[]warcHeader{{"WARC-Concurrent-To", respID}})
+}
+
+func writeHeaderSorted(w io.Writer, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+}
+
+func warcDigest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func newRecordID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// warcTransport tees every exchange that goes through the client into the
+// WARC writer, so redirects, robots.txt and sitemaps are archived as well.
+type warcTransport struct {
+	base    http.RoundTripper
+	writer  *WARCWriter
+	maxBody int64
+	log     func(...any)
+}
+
+func (t *warcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Pin the headers the transport would otherwise add on its own so the
+	// recorded request matches what went over the wire.
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", "Go-http-client/1.1")
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.maxBody+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	truncated := int64(len(body)) > t.maxBody
+	if truncated {
+		body = body[:t.maxBody]
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := t.writer.WriteExchange(req, resp, body, truncated, time.Since(start)); err != nil {
+		t.log("[ERR warc]", err)
+	}
+	return resp, nil
+}
@@ -2,4 +2,9 @@ module l2.16
 
 go 1.24.2
 
-require golang.org/x/net v0.43.0
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/net v0.43.0
+	golang.org/x/text v0.28.0
+)
@@ -1,280 +1,278 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"golang.org/x/net/html"
+	"l2.16/crawler"
 )
 
-type Job struct {
-	URL   string
-	Depth int
-}
+// headerList collects repeated -header "Name: value" flags.
+type headerList []string
+
+func (h *headerList) String() string { return strings.Join(*h, ", ") }
 
-var (
-	visited   = make(map[string]bool)
-	visitedMu sync.Mutex
-	client    = &http.Client{
-		Timeout: 10 * time.Second,
+func (h *headerList) Set(v string) error {
+	if _, _, ok := strings.Cut(v, ":"); !ok {
+		return fmt.Errorf("header %q must look like Name: value", v)
 	}
-	domain      string
-	basePath    = "mirror"
-	maxFileSize = int64(5 * 1024 * 1024)
-	robotsRules = make(map[string]bool)
-)
+	*h = append(*h, v)
+	return nil
+}
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: go run main.go <url> <depth>")
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		runServe(os.Args[2:])
 		return
 	}
 
-	startURL := os.Args[1]
-	depth := atoi(os.Args[2])
-
-	repoPath, err := os.Getwd()
-	if err != nil {
-		fmt.Println("Error getting working directory:", err)
+	useSitemaps := flag.Bool("sitemaps", false, "seed the crawl from robots.txt Sitemap lines, sitemap.xml and RSS/Atom feeds")
+	warcPrefix := flag.String("warc", "", "also write request/response pairs to <prefix>-NNNNN.warc.gz files")
+	warcMaxMB := flag.Int64("warc-max-size", 1024, "start a new WARC file after this many megabytes")
+	warcOnly := flag.Bool("warc-only", false, "write only WARC files, not the rewritten mirror tree")
+	spider := flag.Bool("spider", false, "check links without saving files")
+	reportPath := flag.String("report", "", "write a crawl report to this file (.json or .csv)")
+	sortQuery := flag.Bool("sort-query", false, "sort query parameters when comparing URLs")
+	drop := flag.String("drop-params", "", "comma-separated query parameters to strip from URLs, e.g. utm_*,fbclid")
+	heuristics := flag.Bool("heuristics", false, "also follow links from <noscript>, data-src/data-srcset, JSON-LD and path-like strings in scripts")
+	dedup := flag.Bool("dedup", false, "store pages with identical content only once")
+	cookiesIn := flag.String("load-cookies", "", "load cookies from a Netscape cookies.txt file")
+	cookiesOut := flag.String("save-cookies", "", "save cookies to a Netscape cookies.txt file after the crawl")
+	user := flag.String("user", "", "basic auth user name for the crawled host")
+	password := flag.String("password", "", "basic auth password")
+	bearer := flag.String("bearer", "", "bearer token sent to the crawled host")
+	var headers headerList
+	flag.Var(&headers, "header", "extra request header \"Name: value\" (repeatable)")
+	loginURL := flag.String("login-url", "", "POST -login-data to this URL before crawling")
+	loginData := flag.String("login-data", "", "url-encoded login form, e.g. user=me&pass=secret")
+	acceptEncoding := flag.String("accept-encoding", crawler.DefaultAcceptEncoding, "Accept-Encoding sent to the server; responses are decompressed before saving")
+	proxy := flag.String("proxy", "", "proxy URL (default: HTTP_PROXY/HTTPS_PROXY environment)")
+	showProgress := flag.Bool("progress", false, "show a live progress view instead of per-URL log lines")
+	logPath := flag.String("log", "", "with -progress, write per-URL log lines to this file")
+	numWorkers := flag.Int("workers", 5, "number of parallel downloads")
+	output := flag.String("o", "mirror", "output directory, or a .zip/.tar/.tar.gz archive")
+	feeds := flag.String("feeds", "", "comma-separated RSS/Atom feed URLs to seed the crawl from (implies -sitemaps)")
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		fmt.Println("Usage: go run . [options] <url> <depth>")
+		fmt.Println("       go run . serve [options] <mirror dir>")
+		flag.PrintDefaults()
 		return
 	}
-	basePath = filepath.Join(repoPath, "mirror")
-	fmt.Println("Сохраняю сайт в папку:", basePath)
 
-	if err := os.MkdirAll(basePath, 0755); err != nil {
-		fmt.Println("Ошибка создания папки:", err)
-		return
-	}
+	startURL := flag.Arg(0)
+	depth := atoi(flag.Arg(1))
 
-	u, err := url.Parse(startURL)
-	if err != nil {
-		fmt.Println("Invalid URL:", err)
+	if *warcOnly && *warcPrefix == "" {
+		fmt.Println("-warc-only requires -warc")
 		return
 	}
-	domain = u.Host
-
-	loadRobots(startURL)
-
-	jobs := make(chan Job, 100)
-	var wg sync.WaitGroup
 
-	numWorkers := 5
-	for i := 0; i < numWorkers; i++ {
-		go worker(jobs, &wg)
-	}
-
-	wg.Add(1)
-	jobs <- Job{URL: startURL, Depth: depth}
-
-	wg.Wait()
-	close(jobs)
-
-	fmt.Println("Скачивание завершено.")
-}
-
-func atoi(s string) int {
-	var n int
-	fmt.Sscanf(s, "%d", &n)
-	return n
-}
-
-func worker(jobs chan Job, wg *sync.WaitGroup) {
-	for job := range jobs {
-		processPage(job.URL, job.Depth, jobs, wg)
-		wg.Done()
+	var storage crawler.Storage
+	switch {
+	case *warcOnly || *spider:
+		// Pages still have to be parsed to find links, so they are kept
+		// in a scratch directory that is dropped afterwards.
+		tmp, err := os.MkdirTemp("", "mirror-")
+		if err != nil {
+			fmt.Println("Ошибка создания папки:", err)
+			return
+		}
+		defer os.RemoveAll(tmp)
+		storage, _ = crawler.NewFSStorage(tmp)
+	case isArchive(*output):
+		s, err := crawler.NewArchiveStorage(*output)
+		if err != nil {
+			fmt.Println("Ошибка создания архива:", err)
+			return
+		}
+		fmt.Println("Сохраняю сайт в архив:", *output)
+		storage = s
+	default:
+		dir, err := filepath.Abs(*output)
+		if err != nil {
+			fmt.Println("Error getting working directory:", err)
+			return
+		}
+		s, err := crawler.NewFSStorage(dir)
+		if err != nil {
+			fmt.Println("Ошибка создания папки:", err)
+			return
+		}
+		fmt.Println("Сохраняю сайт в папку:", dir)
+		storage = s
 	}
-}
-
-func processPage(rawurl string, depth int, jobs chan Job, wg *sync.WaitGroup) {
-	if depth < 0 {
-		return
+	defer func() {
+		if err := storage.Close(); err != nil {
+			fmt.Println("Ошибка сохранения:", err)
+		}
+	}()
+
+	var logOut io.Writer = os.Stdout
+	if *showProgress {
+		logOut = io.Discard
+		if *logPath != "" {
+			lf, err := os.Create(*logPath)
+			if err != nil {
+				fmt.Println("Ошибка создания лога:", err)
+				return
+			}
+			defer lf.Close()
+			logOut = lf
+		}
 	}
 
-	visitedMu.Lock()
-	if visited[rawurl] {
-		visitedMu.Unlock()
-		return
+	opts := crawler.Options{
+		Depth:          depth,
+		Workers:        *numWorkers,
+		Storage:        storage,
+		Headers:        parseHeaders(headers),
+		User:           *user,
+		Password:       *password,
+		Bearer:         *bearer,
+		LoginURL:       *loginURL,
+		LoginData:      *loginData,
+		AcceptEncoding: *acceptEncoding,
+		Sitemaps:       *useSitemaps,
+		Feeds:          splitList(*feeds),
+		Spider:         *spider,
+		Report:         *reportPath != "",
+		SortQuery:      *sortQuery,
+		DropParams:     splitList(*drop),
+		Dedup:          *dedup,
+		Heuristics:     *heuristics,
+		Log:            logOut,
 	}
-	visited[rawurl] = true
-	visitedMu.Unlock()
 
-	if !isAllowedByRobots(rawurl) {
-		fmt.Println("[ROBOTS BLOCKED]", rawurl)
-		return
+	if *proxy != "" {
+		proxyURL, err := url.Parse(*proxy)
+		if err != nil {
+			fmt.Println("Invalid proxy URL:", err)
+			return
+		}
+		opts.Proxy = proxyURL
 	}
 
-	localPath, isHTML := downloadFile(rawurl)
-	if localPath == "" || !isHTML {
-		return
+	if *warcPrefix != "" {
+		ww, err := crawler.NewWARCWriter(*warcPrefix, *warcMaxMB*1024*1024, logOut)
+		if err != nil {
+			fmt.Println("Ошибка создания WARC:", err)
+			return
+		}
+		defer ww.Close()
+		opts.WARC = ww
 	}
 
-	f, err := os.Open(localPath)
+	jar, err := crawler.NewJar()
 	if err != nil {
+		fmt.Println("Ошибка создания cookie jar:", err)
 		return
 	}
-	defer f.Close()
-
-	doc, err := html.Parse(f)
-	if err != nil {
-		return
+	opts.Jar = jar
+	if *cookiesIn != "" {
+		if err := jar.LoadFile(*cookiesIn); err != nil {
+			fmt.Println("Ошибка загрузки cookies:", err)
+			return
+		}
 	}
-
-	var walker func(*html.Node)
-	walker = func(n *html.Node) {
-		if n.Type == html.ElementNode {
-			for i := range n.Attr {
-				attr := &n.Attr[i]
-				if isResourceAttr(n.Data, attr.Key) {
-					resURL := resolveURL(rawurl, attr.Val)
-					if resURL == "" {
-						continue
-					}
-					parsed, err := url.Parse(resURL)
-					if err != nil {
-						continue
-					}
-					if parsed.Host == "" || parsed.Host == domain {
-						resLocal, _ := downloadFile(resURL)
-						if resLocal != "" {
-							attr.Val, _ = filepath.Rel(filepath.Dir(localPath), resLocal)
-						}
-						if n.Data == "a" {
-							wg.Add(1)
-							jobs <- Job{URL: resURL, Depth: depth - 1}
-						}
-					}
-				}
+	if *cookiesOut != "" {
+		defer func() {
+			if err := jar.SaveFile(*cookiesOut); err != nil {
+				fmt.Println("Ошибка сохранения cookies:", err)
 			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			walker(c)
-		}
+		}()
 	}
-	walker(doc)
 
-	out, err := os.Create(localPath)
+	c, err := crawler.New(opts)
 	if err != nil {
+		fmt.Println("Ошибка:", err)
 		return
 	}
-	defer out.Close()
-	html.Render(out, doc)
-}
-
-func isResourceAttr(tag, attr string) bool {
-	return (tag == "a" && attr == "href") ||
-		(tag == "img" && attr == "src") ||
-		(tag == "link" && attr == "href") ||
-		(tag == "script" && attr == "src")
-}
-
-func downloadFile(rawurl string) (string, bool) {
-	resp, err := client.Get(rawurl)
-	if err != nil {
-		fmt.Println("[ERR]", err)
-		return "", false
-	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("[ERR]", rawurl, resp.Status)
-		return "", false
-	}
-
-	reader := io.LimitReader(resp.Body, maxFileSize)
-
-	u, _ := url.Parse(rawurl)
-	filePath := u.Path
-	if filePath == "" || strings.HasSuffix(filePath, "/") {
-		filePath += "index.html"
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stopProgress := func() {}
+	if *showProgress {
+		progressCtx, cancel := context.WithCancel(context.Background())
+		progressDone := make(chan struct{})
+		view := newProgressView(os.Stderr, c)
+		go func() {
+			view.Run(progressCtx, 500*time.Millisecond)
+			close(progressDone)
+		}()
+		stopProgress = func() {
+			cancel()
+			<-progressDone
+		}
 	}
 
-	localPath := filepath.Join(basePath, u.Host, filePath)
-	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
-		fmt.Println("[ERR mkdir]", err)
-		return "", false
-	}
+	err = c.Run(ctx, startURL)
+	stopProgress()
 
-	out, err := os.Create(localPath)
-	if err != nil {
-		fmt.Println("[ERR]", err)
-		return "", false
+	switch {
+	case errors.Is(err, context.Canceled):
+		fmt.Println("Прервано, незавершённые файлы не сохранены.")
+	case err != nil:
+		fmt.Println("Ошибка:", err)
+		return
+	default:
+		fmt.Println("Скачивание завершено.")
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, reader)
-	if err != nil {
-		return "", false
+	if report := c.Report(); report != nil {
+		report.PrintSummary(os.Stdout)
+		if *reportPath != "" {
+			if err := report.WriteFile(*reportPath); err != nil {
+				fmt.Println("Ошибка записи отчёта:", err)
+			}
+		}
 	}
-
-	fmt.Println("[DOWNLOAD]", rawurl, "->", localPath)
-
-	contentType := resp.Header.Get("Content-Type")
-	isHTML := strings.HasPrefix(contentType, "text/html")
-	return localPath, isHTML
 }
 
-func resolveURL(base string, href string) string {
-	if strings.HasPrefix(href, "mailto:") || strings.HasPrefix(href, "javascript:") {
-		return ""
-	}
-	u, err := url.Parse(href)
-	if err != nil {
-		return ""
-	}
-	baseURL, err := url.Parse(base)
-	if err != nil {
-		return ""
+func isArchive(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
 	}
-	return baseURL.ResolveReference(u).String()
+	return false
 }
 
-func loadRobots(startURL string) {
-	u, _ := url.Parse(startURL)
-	robotsURL := fmt.Sprintf("%s://%s/robots.txt", u.Scheme, u.Host)
-	resp, err := client.Get(robotsURL)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return
+func parseHeaders(list headerList) http.Header {
+	h := make(http.Header)
+	for _, line := range list {
+		name, value, _ := strings.Cut(line, ":")
+		h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
 	}
-	defer resp.Body.Close()
+	return h
+}
 
-	scanner := bufio.NewScanner(resp.Body)
-	var userAgentAllowed = false
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(strings.ToLower(line), "user-agent:") {
-			ua := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(line, "user-agent:")))
-			if ua == "*" {
-				userAgentAllowed = true
-			} else {
-				userAgentAllowed = false
-			}
-		}
-		if userAgentAllowed && strings.HasPrefix(strings.ToLower(line), "disallow:") {
-			path := strings.TrimSpace(strings.TrimPrefix(line, "disallow:"))
-			if path != "" {
-				robotsRules[path] = true
-			}
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
 		}
 	}
+	return out
 }
 
-func isAllowedByRobots(rawurl string) bool {
-	u, err := url.Parse(rawurl)
-	if err != nil {
-		return false
-	}
-	for p := range robotsRules {
-		if strings.HasPrefix(u.Path, p) {
-			return false
-		}
-	}
-	return true
+func atoi(s string) int {
+	var n int
+	fmt.Sscanf(s, "%d", &n)
+	return n
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"l2.16/crawler"
+)
+
+type progressView struct {
+	out   io.Writer
+	c     *crawler.Crawler
+	start time.Time
+	prev  map[int]int64
+	lines int
+}
+
+func newProgressView(out io.Writer, c *crawler.Crawler) *progressView {
+	return &progressView{
+		out:   out,
+		c:     c,
+		start: time.Now(),
+		prev:  make(map[int]int64),
+	}
+}
+
+func (p *progressView) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.render(interval)
+			return
+		case <-ticker.C:
+			p.render(interval)
+		}
+	}
+}
+
+func (p *progressView) render(interval time.Duration) {
+	snap := p.c.Progress()
+
+	var b strings.Builder
+	if p.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA", p.lines)
+	}
+
+	var total, done int64
+	active := 0
+	rows := make([]string, len(snap.Workers))
+	for i, w := range snap.Workers {
+		total += w.Bytes
+		done += w.Done
+		rate := float64(w.Bytes-p.prev[w.ID]) / interval.Seconds()
+		p.prev[w.ID] = w.Bytes
+
+		u := w.URL
+		if u == "" {
+			rows[i] = fmt.Sprintf(" #%d  idle", w.ID)
+			continue
+		}
+		active++
+		if len(u) > 70 {
+			u = u[:67] + "..."
+		}
+		rows[i] = fmt.Sprintf(" #%d  %10s/s  %s", w.ID, humanBytes(int64(rate)), u)
+	}
+
+	elapsed := time.Since(p.start).Seconds()
+	avg := float64(total)
+	if elapsed > 0 {
+		avg /= elapsed
+	}
+	fmt.Fprintf(&b, "\033[2Kв очереди %d  активно %d/%d  готово %d  %s  %s/s\n",
+		snap.Queued, active, len(snap.Workers), done, humanBytes(total), humanBytes(int64(avg)))
+	for _, row := range rows {
+		fmt.Fprintf(&b, "\033[2K%s\n", row)
+	}
+	p.lines = len(rows) + 1
+	io.WriteString(p.out, b.String())
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"l2.16/crawler"
+)
+
+// runServe implements `l2.16 serve [options] <dir>`: a local preview of a
+// mirror that also collects the URLs the mirror is missing.
+func runServe(args []string) {
+	fset := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fset.String("addr", "127.0.0.1:8080", "address to listen on")
+	gapsPath := fset.String("gaps", "", "on exit, write the requested but missing URLs to this file, one per line")
+	fset.Parse(args)
+
+	if fset.NArg() < 1 {
+		fmt.Println("Usage: go run . serve [options] <mirror dir>")
+		fset.PrintDefaults()
+		return
+	}
+
+	h, err := crawler.NewMirrorHandler(os.DirFS(fset.Arg(0)))
+	if err != nil {
+		fmt.Println("Ошибка открытия зеркала:", err)
+		return
+	}
+	h.Log = os.Stdout
+
+	srv := &http.Server{Addr: *addr, Handler: h}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Зеркало %s доступно на http://%s/\n", fset.Arg(0), *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("Ошибка сервера:", err)
+		return
+	}
+
+	missing := h.Missing()
+	fmt.Println("Не скачано ресурсов:", len(missing))
+	if *gapsPath != "" && len(missing) > 0 {
+		if err := os.WriteFile(*gapsPath, []byte(strings.Join(missing, "\n")+"\n"), 0644); err != nil {
+			fmt.Println("Ошибка записи списка:", err)
+		}
+	}
+}
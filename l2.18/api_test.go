@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func doRequest(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, r))
+	return rec
+}
+
+func TestV2EventLifecycle(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+
+	rec := doRequest(t, h, http.MethodPost, "/v2/users/1/events", `{"start":"2024-03-01T10:00:00Z","event":"Standup"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", rec.Code, rec.Body)
+	}
+	var created Event
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	item := "/v2/users/1/events/" + created.ID
+	if rec.Header().Get("Location") != item {
+		t.Errorf("Location = %q, want %q", rec.Header().Get("Location"), item)
+	}
+
+	if rec := doRequest(t, h, http.MethodGet, "/v2/users/2/events/"+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("another user's event: status %d, want 404", rec.Code)
+	}
+
+	rec = doRequest(t, h, http.MethodPatch, item, `{"start":"2024-03-02T10:00:00Z"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/v2/users/1/events?from=2024-03-01&to=2024-03-31", "")
+	var list eventList
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Events) != 1 || list.Events[0].Text != "Standup" || list.Events[0].Version != 2 {
+		t.Errorf("range query = %+v", list.Events)
+	}
+
+	if rec := doRequest(t, h, http.MethodPut, item, `{"start":"2024-03-02T10:00:00Z","event":"x","version":1}`); rec.Code != http.StatusConflict {
+		t.Errorf("stale put: status %d, want 409", rec.Code)
+	}
+	if rec := doRequest(t, h, http.MethodDelete, item, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: status %d, want 204", rec.Code)
+	}
+	if rec := doRequest(t, h, http.MethodDelete, item, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", rec.Code)
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	tests := []struct {
+		method, target, body string
+		status               int
+		code                 string
+	}{
+		{http.MethodPost, "/v2/users/1/events", `{"event":"x","colour":"red"}`, http.StatusBadRequest, "invalid_request"},
+		{http.MethodPost, "/v2/users/abc/events", `{"event":"x"}`, http.StatusBadRequest, "invalid_request"},
+		{http.MethodGet, "/v2/users/1/events?from=2024-01-01", "", http.StatusBadRequest, "invalid_request"},
+		{http.MethodPost, "/v2/users/1/events/abc", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.MethodGet, "/v2/nothing", "", http.StatusNotFound, "not_found"},
+	}
+	for _, tt := range tests {
+		rec := doRequest(t, h, tt.method, tt.target, tt.body)
+		var body apiErrorBody
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != tt.status || body.Error.Code != tt.code {
+			t.Errorf("%s %s: got %d %q, want %d %q", tt.method, tt.target, rec.Code, body.Error.Code, tt.status, tt.code)
+		}
+	}
+
+	rec := doRequest(t, h, http.MethodPost, "/v2/users/1/events/abc", "")
+	if allow := rec.Header().Get("Allow"); allow != "DELETE, GET, HEAD, PATCH, PUT" {
+		t.Errorf("Allow = %q", allow)
+	}
+}
+
+func TestLegacyMethodEnforcement(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	rec := doRequest(t, h, http.MethodGet, "/create_event", `{"user_id":1,"event":"x"}`)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+		t.Errorf("GET /create_event: status %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/events_for_day?date=2024-01-01", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /events_for_day: status %d, want 405", rec.Code)
+	}
+	if rec := doRequest(t, h, http.MethodGet, "/events_for_day?date=2024-01-01", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /events_for_day: status %d, want 200", rec.Code)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	rec := doRequest(t, h, http.MethodGet, "/openapi.json", "")
+	var doc struct {
+		OpenAPI    string                    `json:"openapi"`
+		Paths      map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi = %q", doc.OpenAPI)
+	}
+	item := doc.Paths["/v2/users/{id}/events/{eventID}"]
+	for _, m := range []string{"get", "put", "patch", "delete"} {
+		if item[m] == nil {
+			t.Errorf("missing %s operation on event item", m)
+		}
+	}
+	if doc.Components.Schemas["Event"] == nil || doc.Paths["/create_event"] == nil {
+		t.Errorf("expected Event schema and legacy paths in document")
+	}
+}
+
+func TestV2Occurrences(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	rec := doRequest(t, h, http.MethodPost, "/v2/users/1/events",
+		`{"start":"2024-03-04T09:00:00Z","event":"Sync","rrule":"FREQ=WEEKLY;BYDAY=MO"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d, body %s", rec.Code, rec.Body)
+	}
+	var series Event
+	json.Unmarshal(rec.Body.Bytes(), &series)
+	occurrences := "/v2/users/1/events/" + series.ID + "/occurrences/"
+
+	if rec := doRequest(t, h, http.MethodPut, occurrences+"2024-03-11T09:00:00Z", `{"event":"Sync, remote"}`); rec.Code != http.StatusOK {
+		t.Errorf("override: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, h, http.MethodDelete, occurrences+"2024-03-18T09:00:00Z", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("cancel: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, h, http.MethodDelete, occurrences+"2024-03-19T09:00:00Z", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("cancel of a non-occurrence: status %d, want 404", rec.Code)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/v2/users/1/events?from=2024-03-01&to=2024-03-31", "")
+	var list eventList
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	var texts []string
+	for _, e := range list.Events {
+		texts = append(texts, e.Text)
+	}
+	if got := strings.Join(texts, ","); got != "Sync,Sync, remote,Sync" {
+		t.Errorf("March occurrences = %q", got)
+	}
+}
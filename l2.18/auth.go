@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errUnauthorized = errors.New("требуется аутентификация")
+	errForbidden    = errors.New("нет доступа к событиям этого пользователя")
+)
+
+// jwtLeeway tolerates clock skew between the token issuer and us.
+const jwtLeeway = time.Minute
+
+// authConfig is the file named by CALENDAR_AUTH.
+type authConfig struct {
+	APIKeys []apiKeyConfig `json:"api_keys"`
+	JWT     struct {
+		Issuer   string         `json:"issuer"`
+		Audience string         `json:"audience"`
+		Keys     []jwtKeyConfig `json:"keys"`
+	} `json:"jwt"`
+}
+
+// apiKeyConfig gives a key either as is or, to keep it out of the file,
+// as the hex SHA-256 of the key.
+type apiKeyConfig struct {
+	Key       string `json:"key,omitempty"`
+	KeySHA256 string `json:"key_sha256,omitempty"`
+	UserID    int    `json:"user_id"`
+}
+
+// jwtKeyConfig is an HS256 secret or an RS256 public key in a PEM file.
+// With several keys tokens name theirs by kid, so keys can be rotated.
+type jwtKeyConfig struct {
+	ID            string `json:"kid"`
+	Alg           string `json:"alg"`
+	Secret        string `json:"secret,omitempty"`
+	PublicKeyFile string `json:"public_key_file,omitempty"`
+}
+
+type jwtKey struct {
+	id, alg string
+	secret  []byte
+	public  *rsa.PublicKey
+}
+
+// Authenticator resolves the credentials of a request to a user ID.
+type Authenticator struct {
+	apiKeys  map[[sha256.Size]byte]int
+	jwtKeys  []jwtKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+func LoadAuthenticator(path string) (*Authenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg authConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return NewAuthenticator(cfg)
+}
+
+func NewAuthenticator(cfg authConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		apiKeys:  make(map[[sha256.Size]byte]int),
+		issuer:   cfg.JWT.Issuer,
+		audience: cfg.JWT.Audience,
+		now:      time.Now,
+	}
+	for i, k := range cfg.APIKeys {
+		if k.UserID <= 0 {
+			return nil, fmt.Errorf("api_keys[%d]: не указан user_id", i)
+		}
+		var sum [sha256.Size]byte
+		switch {
+		case k.Key != "":
+			sum = sha256.Sum256([]byte(k.Key))
+		case k.KeySHA256 != "":
+			b, err := hex.DecodeString(k.KeySHA256)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("api_keys[%d]: key_sha256 должен быть hex SHA-256", i)
+			}
+			copy(sum[:], b)
+		default:
+			return nil, fmt.Errorf("api_keys[%d]: не указан ключ", i)
+		}
+		a.apiKeys[sum] = k.UserID
+	}
+	for i, k := range cfg.JWT.Keys {
+		key := jwtKey{id: k.ID, alg: k.Alg}
+		switch k.Alg {
+		case "HS256":
+			if len(k.Secret) < 32 {
+				return nil, fmt.Errorf("jwt.keys[%d]: секрет HS256 короче 32 байт", i)
+			}
+			key.secret = []byte(k.Secret)
+		case "RS256":
+			pub, err := readRSAPublicKey(k.PublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("jwt.keys[%d]: %v", i, err)
+			}
+			key.public = pub
+		default:
+			return nil, fmt.Errorf("jwt.keys[%d]: алгоритм %q не поддерживается", i, k.Alg)
+		}
+		a.jwtKeys = append(a.jwtKeys, key)
+	}
+	return a, nil
+}
+
+func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: нет PEM", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: ключ не RSA", path)
+	}
+	return pub, nil
+}
+
+// authenticate finds the caller of r. Bearer tokens are JWTs; an API
+// key comes in X-API-Key or, for CalDAV clients, as the Basic password.
+// The query token is only looked at when allowQuery is set, for feed
+// URLs that calendar apps, EventSource and browser WebSockets can't add
+// headers to.
+func (a *Authenticator) authenticate(r *http.Request, allowQuery bool) (int, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.verifyJWT(strings.TrimSpace(token))
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return a.verifyAPIKey(key)
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return a.verifyAPIKey(password)
+	}
+	if token := r.URL.Query().Get("token"); allowQuery && token != "" {
+		if strings.Count(token, ".") == 2 {
+			return a.verifyJWT(token)
+		}
+		return a.verifyAPIKey(token)
+	}
+	return 0, errUnauthorized
+}
+
+func (a *Authenticator) verifyAPIKey(key string) (int, error) {
+	// A map lookup by hash doesn't leak the key through timing the way
+	// comparing the key itself would.
+	if userID, ok := a.apiKeys[sha256.Sum256([]byte(key))]; ok {
+		return userID, nil
+	}
+	return 0, fmt.Errorf("%w: неизвестный ключ API", errUnauthorized)
+}
+
+// verifyJWT checks the signature, times, issuer and audience of token
+// and returns the user in its sub claim.
+func (a *Authenticator) verifyJWT(token string) (int, error) {
+	invalid := func(reason string) (int, error) {
+		return 0, fmt.Errorf("%w: %s", errUnauthorized, reason)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return invalid("некорректный JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return invalid("некорректный заголовок JWT")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return invalid("некорректная подпись JWT")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range a.jwtKeys {
+		// The key decides the algorithm, so a token can't pick a weaker one.
+		if k.alg != header.Alg || header.Kid != "" && k.id != header.Kid {
+			continue
+		}
+		switch k.alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, k.secret)
+			mac.Write(signed)
+			verified = hmac.Equal(mac.Sum(nil), sig)
+		case "RS256":
+			sum := sha256.Sum256(signed)
+			verified = rsa.VerifyPKCS1v15(k.public, crypto.SHA256, sum[:], sig) == nil
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return invalid("подпись JWT не подходит ни к одному ключу")
+	}
+
+	var claims struct {
+		Sub json.Number     `json:"sub"`
+		Exp *json.Number    `json:"exp"`
+		Nbf *json.Number    `json:"nbf"`
+		Iss string          `json:"iss"`
+		Aud json.RawMessage `json:"aud"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return invalid("некорректные claims JWT")
+	}
+	now := a.now()
+	if claims.Exp == nil {
+		return invalid("в JWT нет exp")
+	}
+	if exp, err := claims.Exp.Int64(); err != nil || now.After(time.Unix(exp, 0).Add(jwtLeeway)) {
+		return invalid("срок действия JWT истёк")
+	}
+	if claims.Nbf != nil {
+		if nbf, err := claims.Nbf.Int64(); err != nil || now.Add(jwtLeeway).Before(time.Unix(nbf, 0)) {
+			return invalid("JWT ещё не действует")
+		}
+	}
+	if a.issuer != "" && claims.Iss != a.issuer {
+		return invalid("JWT выдан другим издателем")
+	}
+	if a.audience != "" && !hasAudience(claims.Aud, a.audience) {
+		return invalid("JWT выдан не для этого сервиса")
+	}
+	userID, err := strconv.Atoi(claims.Sub.String())
+	if err != nil || userID <= 0 {
+		return invalid("sub в JWT должен быть id пользователя")
+	}
+	return userID, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// hasAudience reads aud, which is a string or a list of them.
+func hasAudience(raw json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return one == want
+	}
+	var many []string
+	json.Unmarshal(raw, &many)
+	for _, aud := range many {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+type callerKey struct{}
+
+// callerID returns the authenticated user of r. ok is false when the
+// server runs without authentication.
+func callerID(r *http.Request) (userID int, ok bool) {
+	userID, ok = r.Context().Value(callerKey{}).(int)
+	return userID, ok
+}
+
+// authorize returns errForbidden unless the caller may act for userID.
+// Without authentication anyone may, as before it existed.
+func authorize(r *http.Request, userID int) error {
+	if caller, ok := callerID(r); ok && caller != userID {
+		return errForbidden
+	}
+	return nil
+}
+
+// authorizeEvent returns errForbidden unless the caller may read e or,
+// with write set, change it; see Calendar.Access.
+func authorizeEvent(c *Calendar, r *http.Request, e Event, write bool) error {
+	caller, ok := callerID(r)
+	if !ok {
+		return nil
+	}
+	switch c.Access(caller, e) {
+	case accessWrite:
+		return nil
+	case accessRead:
+		if !write {
+			return nil
+		}
+	}
+	return errForbidden
+}
+
+// publicPaths need no credentials.
+var publicPaths = map[string]bool{"/openapi.json": true, "/.well-known/caldav": true}
+
+// middleware authenticates every request but those to publicPaths and
+// stores the caller in its context. Failures are reported in the style
+// of the API the path belongs to.
+func (a *Authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		feed := r.Method == http.MethodGet && (strings.HasSuffix(r.URL.Path, "/calendar.ics") || strings.HasSuffix(r.URL.Path, "/changes"))
+		userID, err := a.authenticate(r, feed)
+		if err != nil {
+			logger.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+			writeUnauthorized(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, userID)))
+	})
+}
+
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Add("WWW-Authenticate", `Bearer realm="calendar"`)
+	w.Header().Add("WWW-Authenticate", `Basic realm="calendar", charset="UTF-8"`)
+	switch {
+	case apiPath(r.URL.Path):
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+	case strings.HasPrefix(r.URL.Path, "/dav/"):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		writeJSONError(w, err.Error(), http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func signJWT(t *testing.T, header, claims map[string]any, sign func([]byte) []byte) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(b []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+}
+
+func testAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	var cfg authConfig
+	cfg.APIKeys = []apiKeyConfig{{Key: "key-of-1", UserID: 1}}
+	cfg.JWT.Issuer = "https://id.example"
+	cfg.JWT.Keys = []jwtKeyConfig{{ID: "k1", Alg: "HS256", Secret: testSecret}}
+	a, err := NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestVerifyJWT(t *testing.T) {
+	a := testAuthenticator(t)
+	now := time.Now().Unix()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "2", "iss": "https://id.example", "exp": now + 3600}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	hdr := map[string]any{"alg": "HS256", "kid": "k1"}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", signJWT(t, hdr, claims(nil), hs256(testSecret)), true},
+		{"expired", signJWT(t, hdr, claims(map[string]any{"exp": now - 3600}), hs256(testSecret)), false},
+		{"no exp", signJWT(t, hdr, map[string]any{"sub": "2", "iss": "https://id.example"}, hs256(testSecret)), false},
+		{"wrong issuer", signJWT(t, hdr, claims(map[string]any{"iss": "evil"}), hs256(testSecret)), false},
+		{"wrong secret", signJWT(t, hdr, claims(nil), hs256(strings.Repeat("x", 32))), false},
+		{"unknown kid", signJWT(t, map[string]any{"alg": "HS256", "kid": "k2"}, claims(nil), hs256(testSecret)), false},
+		{"alg none", signJWT(t, map[string]any{"alg": "none"}, claims(nil), func([]byte) []byte { return nil }), false},
+	}
+	for _, tt := range tests {
+		userID, err := a.verifyJWT(tt.token)
+		if tt.ok && (err != nil || userID != 2) {
+			t.Errorf("%s: got %d, %v", tt.name, userID, err)
+		}
+		if !tt.ok && !errors.Is(err, errUnauthorized) {
+			t.Errorf("%s: expected errUnauthorized, got %d, %v", tt.name, userID, err)
+		}
+	}
+}
+
+func TestVerifyJWTRS256(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "pub.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	var cfg authConfig
+	cfg.JWT.Keys = []jwtKeyConfig{
+		{ID: "hs", Alg: "HS256", Secret: testSecret},
+		{ID: "rs", Alg: "RS256", PublicKeyFile: path},
+	}
+	a, err := NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := func(b []byte) []byte {
+		sum := sha256.Sum256(b)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		return sig
+	}
+	token := signJWT(t, map[string]any{"alg": "RS256", "kid": "rs"}, map[string]any{"sub": 7, "exp": time.Now().Unix() + 60}, rs256)
+	if userID, err := a.verifyJWT(token); err != nil || userID != 7 {
+		t.Errorf("RS256 token: got %d, %v", userID, err)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	c := NewCalendar()
+	other, _ := c.Create(Event{UserID: 2, Text: "Secret", Start: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)})
+	h := makeHandlersWithAuth(c, testAuthenticator(t))
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	key := []string{"X-API-Key", "key-of-1"}
+
+	if rec := do(http.MethodGet, "/v2/users/1/events?from=2024-03-01&to=2024-03-02", ""); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("no credentials: status %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/openapi.json", ""); rec.Code != http.StatusOK {
+		t.Errorf("openapi.json: status %d, want it public", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v2/users/1/events?from=2024-03-01&to=2024-03-02", "", key...); rec.Code != http.StatusOK {
+		t.Errorf("own events: status %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v2/users/2/events?from=2024-03-01&to=2024-03-02", "", key...); rec.Code != http.StatusForbidden {
+		t.Errorf("another user's events: status %d, want 403", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/delete_event", `{"id":"`+other.ID+`"}`, key...); rec.Code != http.StatusForbidden {
+		t.Errorf("legacy delete of another user's event: status %d, want 403", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/create_event", `{"user_id":2,"date":"2024-03-01T00:00:00Z","event":"x"}`, key...); rec.Code != http.StatusForbidden {
+		t.Errorf("legacy create for another user: status %d, want 403", rec.Code)
+	}
+
+	// The legacy API takes the owner from the key and only lists the
+	// caller's events.
+	rec := do(http.MethodPost, "/create_event", `{"date":"2024-03-01T00:00:00Z","event":"Mine"}`, key...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("legacy create: status %d, body %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/events_for_day?date=2024-03-01", "", key...)
+	var evts []Event
+	json.Unmarshal(rec.Body.Bytes(), &evts)
+	if len(evts) != 1 || evts[0].Text != "Mine" {
+		t.Errorf("legacy day query = %+v", evts)
+	}
+
+	// CalDAV clients log in with the key as password; feeds take it in the URL.
+	req := httptest.NewRequest("PROPFIND", "/dav/users/2/calendar/", nil)
+	req.SetBasicAuth("anyone", "key-of-1")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("CalDAV for another user: status %d, want 403", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v2/users/1/calendar.ics?token=key-of-1", ""); rec.Code != http.StatusOK {
+		t.Errorf("feed with token: status %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v2/users/1/events?from=2024-03-01&to=2024-03-02&token=key-of-1", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token in the URL outside feeds: status %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	davNS    = "DAV:"
+	calDAVNS = "urn:ietf:params:xml:ns:caldav"
+	csNS     = "http://calendarserver.org/ns/"
+
+	syncTokenPrefix = "urn:l2.18:sync:"
+)
+
+// davPrefixes are the namespace prefixes declared on every multistatus.
+var davPrefixes = map[string]string{davNS: "d", calDAVNS: "c", csNS: "cs"}
+
+type davKind int
+
+const (
+	davRoot davKind = iota
+	davPrincipal
+	davCollection
+	davResource
+)
+
+// davTarget is what a /dav path names: a user's principal, which is also
+// their calendar home, the user's one calendar or an event in it.
+type davTarget struct {
+	kind   davKind
+	userID int
+	// uid names the event of a davResource.
+	uid string
+}
+
+// parseDAVPath reads an escaped path, such as URL.EscapedPath returns, so
+// that a UID holding a '/', escaped by resourceHref, stays one segment.
+func parseDAVPath(p string) (davTarget, bool) {
+	rest, ok := strings.CutPrefix(p, "/dav/")
+	if !ok {
+		return davTarget{}, false
+	}
+	if rest == "" {
+		return davTarget{kind: davRoot}, true
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	for i, part := range parts {
+		seg, err := url.PathUnescape(part)
+		if err != nil {
+			return davTarget{}, false
+		}
+		parts[i] = seg
+	}
+	if len(parts) < 2 || parts[0] != "users" {
+		return davTarget{}, false
+	}
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil || userID <= 0 {
+		return davTarget{}, false
+	}
+	t := davTarget{kind: davPrincipal, userID: userID}
+	switch {
+	case len(parts) == 2:
+	case len(parts) == 3 && parts[2] == "calendar":
+		t.kind = davCollection
+	case len(parts) == 4 && parts[2] == "calendar" && strings.HasSuffix(parts[3], ".ics") && !strings.HasSuffix(rest, "/"):
+		t.kind, t.uid = davResource, strings.TrimSuffix(parts[3], ".ics")
+	default:
+		return davTarget{}, false
+	}
+	return t, true
+}
+
+func principalHref(userID int) string {
+	return "/dav/users/" + strconv.Itoa(userID) + "/"
+}
+
+func collectionHref(userID int) string {
+	return principalHref(userID) + "calendar/"
+}
+
+func resourceHref(e Event) string {
+	return collectionHref(e.UserID) + url.PathEscape(resourceUID(e)) + ".ics"
+}
+
+// davETag changes whenever the event does.
+func davETag(e Event) string {
+	return `"` + e.ID + "-" + strconv.Itoa(e.Version) + `"`
+}
+
+// davHandler serves every user's events as a CalDAV calendar at
+// /dav/users/{id}/calendar/, enough for clients such as Thunderbird to
+// sync both ways.
+type davHandler struct {
+	c *Calendar
+}
+
+const davAllow = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT"
+
+func (h *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t, ok := parseDAVPath(r.URL.EscapedPath())
+	if !ok {
+		http.Error(w, "Нет такого ресурса: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	if t.kind == davRoot {
+		// The root points clients at the caller's principal.
+		t.userID, _ = callerID(r)
+	} else if err := authorize(r, t.userID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1, 3, calendar-access")
+		w.Header().Set("Allow", davAllow)
+	case "PROPFIND":
+		h.propfind(w, r, t)
+	case "REPORT":
+		h.report(w, r, t)
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, t)
+	case http.MethodPut:
+		h.put(w, r, t)
+	case http.MethodDelete:
+		h.delete(w, r, t)
+	default:
+		w.Header().Set("Allow", davAllow)
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+// davRequest is the body of PROPFIND and of the supported REPORTs; the
+// root element tells which one it is.
+type davRequest struct {
+	XMLName   xml.Name
+	AllProp   *struct{}    `xml:"DAV: allprop"`
+	PropName  *struct{}    `xml:"DAV: propname"`
+	Prop      davPropNames `xml:"DAV: prop"`
+	Hrefs     []string     `xml:"DAV: href"`
+	SyncToken string       `xml:"DAV: sync-token"`
+	Filter    *davFilter   `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+type davFilter struct {
+	Comp davCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+type davCompFilter struct {
+	Name      string          `xml:"name,attr"`
+	Comps     []davCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	TimeRange *struct {
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	} `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+}
+
+// davPropNames collects the names of the elements inside <prop>.
+type davPropNames []xml.Name
+
+func (p *davPropNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			*p = append(*p, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+func readDAVRequest(w http.ResponseWriter, r *http.Request) (davRequest, error) {
+	var req davRequest
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		return req, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// An empty PROPFIND asks for all properties.
+		req.AllProp = &struct{}{}
+		return req, nil
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		return req, fmt.Errorf("некорректный XML: %v", err)
+	}
+	return req, nil
+}
+
+// davResponse is one <response> of a multistatus. Requested properties
+// the resource doesn't have are listed with 404; status replaces the
+// properties for resources that are gone.
+type davResponse struct {
+	href    string
+	found   []string
+	missing []xml.Name
+	status  int
+}
+
+var (
+	propResourceType     = xml.Name{Space: davNS, Local: "resourcetype"}
+	propDisplayName      = xml.Name{Space: davNS, Local: "displayname"}
+	propOwner            = xml.Name{Space: davNS, Local: "owner"}
+	propPrincipal        = xml.Name{Space: davNS, Local: "current-user-principal"}
+	propPrincipalURL     = xml.Name{Space: davNS, Local: "principal-URL"}
+	propPrivileges       = xml.Name{Space: davNS, Local: "current-user-privilege-set"}
+	propReports          = xml.Name{Space: davNS, Local: "supported-report-set"}
+	propSyncToken        = xml.Name{Space: davNS, Local: "sync-token"}
+	propETag             = xml.Name{Space: davNS, Local: "getetag"}
+	propContentType      = xml.Name{Space: davNS, Local: "getcontenttype"}
+	propCalendarHome     = xml.Name{Space: calDAVNS, Local: "calendar-home-set"}
+	propComponents       = xml.Name{Space: calDAVNS, Local: "supported-calendar-component-set"}
+	propCalendarDataType = xml.Name{Space: calDAVNS, Local: "supported-calendar-data"}
+	propCalendarData     = xml.Name{Space: calDAVNS, Local: "calendar-data"}
+	propCTag             = xml.Name{Space: csNS, Local: "getctag"}
+)
+
+// allProps are the properties allprop and propname return for each kind
+// of target. calendar-data is only sent when asked for.
+var allProps = map[davKind][]xml.Name{
+	davRoot:       {propResourceType, propPrincipal},
+	davPrincipal:  {propResourceType, propDisplayName, propPrincipal, propPrincipalURL, propCalendarHome},
+	davCollection: {propResourceType, propDisplayName, propOwner, propPrincipal, propPrivileges, propReports, propSyncToken, propComponents, propCalendarDataType, propCTag},
+	davResource:   {propResourceType, propETag, propContentType},
+}
+
+// prop returns the value of property name of t as XML, e being the
+// event of a davResource.
+func (h *davHandler) prop(t davTarget, e Event, name xml.Name) (string, bool) {
+	href := func(s string) string { return "<d:href>" + xmlText(s) + "</d:href>" }
+	switch t.kind {
+	case davRoot:
+		switch name {
+		case propResourceType:
+			return "<d:collection/>", true
+		case propPrincipal:
+			if t.userID == 0 {
+				return "<d:unauthenticated/>", true
+			}
+			return href(principalHref(t.userID)), true
+		}
+	case davPrincipal:
+		switch name {
+		case propResourceType:
+			return "<d:collection/><d:principal/>", true
+		case propDisplayName:
+			return xmlText(fmt.Sprintf("Пользователь %d", t.userID)), true
+		case propPrincipal, propPrincipalURL, propCalendarHome:
+			return href(principalHref(t.userID)), true
+		}
+	case davCollection:
+		switch name {
+		case propResourceType:
+			return "<d:collection/><c:calendar/>", true
+		case propDisplayName:
+			return xmlText(fmt.Sprintf("Календарь пользователя %d", t.userID)), true
+		case propOwner, propPrincipal:
+			return href(principalHref(t.userID)), true
+		case propPrivileges:
+			return "<d:privilege><d:read/></d:privilege><d:privilege><d:write/></d:privilege>" +
+				"<d:privilege><d:write-content/></d:privilege><d:privilege><d:bind/></d:privilege>" +
+				"<d:privilege><d:unbind/></d:privilege>", true
+		case propReports:
+			return "<d:supported-report><d:report><c:calendar-query/></d:report></d:supported-report>" +
+				"<d:supported-report><d:report><c:calendar-multiget/></d:report></d:supported-report>" +
+				"<d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>", true
+		case propSyncToken:
+			return xmlText(syncTokenPrefix + strconv.FormatInt(h.c.SyncToken(t.userID), 10)), true
+		case propCTag:
+			return xmlText(strconv.FormatInt(h.c.SyncToken(t.userID), 10)), true
+		case propComponents:
+			return `<c:comp name="VEVENT"/>`, true
+		case propCalendarDataType:
+			return `<c:calendar-data content-type="text/calendar" version="2.0"/>`, true
+		}
+	case davResource:
+		switch name {
+		case propResourceType:
+			return "", true
+		case propETag:
+			return xmlText(davETag(e)), true
+		case propContentType:
+			return "text/calendar; charset=utf-8; component=vevent", true
+		case propCalendarData:
+			var b bytes.Buffer
+			writeICS(&b, "", []Event{e})
+			return xmlText(b.String()), true
+		}
+	}
+	return "", false
+}
+
+// respond answers req for one target: the requested properties, all of
+// them for allprop, or just their names for propname.
+func (h *davHandler) respond(href string, t davTarget, e Event, req davRequest) davResponse {
+	resp := davResponse{href: href}
+	names := []xml.Name(req.Prop)
+	if req.AllProp != nil || req.PropName != nil {
+		names = allProps[t.kind]
+	}
+	for _, name := range names {
+		value, ok := h.prop(t, e, name)
+		if !ok {
+			resp.missing = append(resp.missing, name)
+			continue
+		}
+		if req.PropName != nil {
+			value = ""
+		}
+		resp.found = append(resp.found, xmlElement(name, value))
+	}
+	return resp
+}
+
+func (h *davHandler) propfind(w http.ResponseWriter, r *http.Request, t davTarget) {
+	req, err := readDAVRequest(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	depth := r.Header.Get("Depth")
+	var responses []davResponse
+	switch t.kind {
+	case davRoot:
+		responses = append(responses, h.respond("/dav/", t, Event{}, req))
+	case davPrincipal:
+		responses = append(responses, h.respond(principalHref(t.userID), t, Event{}, req))
+		if depth != "0" {
+			coll := davTarget{kind: davCollection, userID: t.userID}
+			responses = append(responses, h.respond(collectionHref(t.userID), coll, Event{}, req))
+		}
+	case davCollection:
+		responses = append(responses, h.respond(collectionHref(t.userID), t, Event{}, req))
+		if depth != "0" {
+			for _, e := range h.c.UserEvents(t.userID) {
+				responses = append(responses, h.respond(resourceHref(e), davTarget{kind: davResource}, e, req))
+			}
+		}
+	case davResource:
+		e, ok := h.c.FindUID(t.userID, t.uid)
+		if !ok {
+			http.Error(w, "Событие не найдено", http.StatusNotFound)
+			return
+		}
+		responses = append(responses, h.respond(resourceHref(e), t, e, req))
+	}
+	writeMultistatus(w, responses, "")
+}
+
+func (h *davHandler) report(w http.ResponseWriter, r *http.Request, t davTarget) {
+	if t.kind != davCollection {
+		http.Error(w, "REPORT поддерживается только для календаря", http.StatusForbidden)
+		return
+	}
+	req, err := readDAVRequest(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := davTarget{kind: davResource}
+	var responses []davResponse
+	switch req.XMLName {
+	case xml.Name{Space: calDAVNS, Local: "calendar-multiget"}:
+		for _, href := range req.Hrefs {
+			p := href
+			if u, err := url.Parse(href); err == nil {
+				p = u.EscapedPath()
+			}
+			var e Event
+			found := false
+			if ht, ok := parseDAVPath(p); ok && ht.kind == davResource && ht.userID == t.userID {
+				e, found = h.c.FindUID(t.userID, ht.uid)
+			}
+			if !found {
+				responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+				continue
+			}
+			responses = append(responses, h.respond(href, res, e, req))
+		}
+	case xml.Name{Space: calDAVNS, Local: "calendar-query"}:
+		from, to, ok, err := queryRange(req.Filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok {
+			for _, e := range h.c.UserEvents(t.userID) {
+				if overlaps(e, from, to) {
+					responses = append(responses, h.respond(resourceHref(e), res, e, req))
+				}
+			}
+		}
+	case xml.Name{Space: davNS, Local: "sync-collection"}:
+		var since int64
+		if req.SyncToken != "" {
+			n, err := strconv.ParseInt(strings.TrimPrefix(req.SyncToken, syncTokenPrefix), 10, 64)
+			if err != nil || !strings.HasPrefix(req.SyncToken, syncTokenPrefix) || n == 0 {
+				writeDAVError(w, http.StatusForbidden, "valid-sync-token")
+				return
+			}
+			since = n
+		}
+		changed, deleted, token, err := h.c.Changes(t.userID, since)
+		if errors.Is(err, errSyncToken) {
+			writeDAVError(w, http.StatusForbidden, "valid-sync-token")
+			return
+		}
+		for _, e := range changed {
+			responses = append(responses, h.respond(resourceHref(e), res, e, req))
+		}
+		for _, uid := range deleted {
+			href := collectionHref(t.userID) + url.PathEscape(uid) + ".ics"
+			responses = append(responses, davResponse{href: href, status: http.StatusNotFound})
+		}
+		writeMultistatus(w, responses, syncTokenPrefix+strconv.FormatInt(token, 10))
+		return
+	default:
+		writeDAVError(w, http.StatusForbidden, "supported-report")
+		return
+	}
+	writeMultistatus(w, responses, "")
+}
+
+// queryRange reads the window of a calendar-query filter. ok is false
+// when the filter asks for components other than events.
+func queryRange(f *davFilter) (from, to time.Time, ok bool, err error) {
+	from, to = time.Time{}, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	if f == nil {
+		return from, to, true, nil
+	}
+	if f.Comp.Name != "VCALENDAR" {
+		return from, to, false, nil
+	}
+	for _, comp := range f.Comp.Comps {
+		if comp.Name != "VEVENT" {
+			return from, to, false, nil
+		}
+		if tr := comp.TimeRange; tr != nil {
+			if tr.Start != "" {
+				if from, err = time.Parse("20060102T150405Z", tr.Start); err != nil {
+					return from, to, false, fmt.Errorf("некорректное начало time-range %q", tr.Start)
+				}
+			}
+			if tr.End != "" {
+				if to, err = time.Parse("20060102T150405Z", tr.End); err != nil {
+					return from, to, false, fmt.Errorf("некорректный конец time-range %q", tr.End)
+				}
+			}
+		}
+	}
+	return from, to, true, nil
+}
+
+func (h *davHandler) get(w http.ResponseWriter, r *http.Request, t davTarget) {
+	var events []Event
+	switch t.kind {
+	case davCollection:
+		events = h.c.UserEvents(t.userID)
+	case davResource:
+		e, ok := h.c.FindUID(t.userID, t.uid)
+		if !ok {
+			http.Error(w, "Событие не найдено", http.StatusNotFound)
+			return
+		}
+		if inm := r.Header.Get("If-None-Match"); inm == davETag(e) || inm == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", davETag(e))
+		events = []Event{e}
+	default:
+		http.Error(w, "Используйте PROPFIND", http.StatusMethodNotAllowed)
+		return
+	}
+	var b bytes.Buffer
+	writeICS(&b, "", events)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// checkPreconditions applies If-Match and If-None-Match to the current
+// state of a resource.
+func checkPreconditions(r *http.Request, e Event, exists bool) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !exists || im != "*" && im != davETag(e) {
+			return false
+		}
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && exists {
+		if inm == "*" || inm == davETag(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// put stores the event in an .ics resource. The stored event differs
+// from what was sent, alarms are dropped for one, so no ETag is returned
+// and clients fetch it again.
+func (h *davHandler) put(w http.ResponseWriter, r *http.Request, t davTarget) {
+	if t.kind != davResource {
+		http.Error(w, "Можно сохранять только события", http.StatusMethodNotAllowed)
+		return
+	}
+	events, issues, err := decodeICS(http.MaxBytesReader(w, r.Body, maxImportSize), h.c.UserLocation(t.userID))
+	if err != nil {
+		writeDAVError(w, http.StatusForbidden, "valid-calendar-data")
+		return
+	}
+	if len(events) != 1 {
+		writeDAVError(w, http.StatusForbidden, "valid-calendar-object-resource")
+		return
+	}
+	for _, is := range issues {
+		logger.Printf("CalDAV %s: пропущен %s: %s", r.URL.Path, is.Component, is.Reason)
+	}
+	e := events[0]
+	if e.UID == "" {
+		e.UID = t.uid
+	}
+	if e.UID != t.uid {
+		writeDAVError(w, http.StatusForbidden, "no-uid-conflict")
+		return
+	}
+
+	existing, exists := h.c.FindUID(t.userID, t.uid)
+	if !checkPreconditions(r, existing, exists) {
+		http.Error(w, "Событие изменилось", http.StatusPreconditionFailed)
+		return
+	}
+	e.UserID = t.userID
+	if exists {
+		e.ID, e.Version = existing.ID, existing.Version
+		if e.UID == existing.ID {
+			e.UID = existing.UID
+		}
+		// Calendars, attendees and reminders aren't carried by iCalendar
+		// here, so they are kept.
+		e.CalendarID, e.Attendees, e.Reminders = existing.CalendarID, existing.Attendees, existing.Reminders
+		_, err = h.c.Update(e)
+	} else {
+		_, err = h.c.Create(e)
+	}
+	switch {
+	case errors.Is(err, errConflict):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case err != nil:
+		writeCalendarError(w, err)
+	case exists:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (h *davHandler) delete(w http.ResponseWriter, r *http.Request, t davTarget) {
+	if t.kind != davResource {
+		http.Error(w, "Календарь удалить нельзя", http.StatusForbidden)
+		return
+	}
+	e, exists := h.c.FindUID(t.userID, t.uid)
+	if !exists {
+		http.Error(w, "Событие не найдено", http.StatusNotFound)
+		return
+	}
+	if !checkPreconditions(r, e, exists) {
+		http.Error(w, "Событие изменилось", http.StatusPreconditionFailed)
+		return
+	}
+	if err := h.c.Delete(e.ID); err != nil {
+		writeCalendarError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []davResponse, syncToken string) {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:c="` + calDAVNS + `" xmlns:cs="` + csNS + `">`)
+	propstat := func(props []string, status int) {
+		b.WriteString("<d:propstat><d:prop>")
+		for _, p := range props {
+			b.WriteString(p)
+		}
+		b.WriteString("</d:prop>" + davStatus(status) + "</d:propstat>")
+	}
+	for _, resp := range responses {
+		b.WriteString("<d:response><d:href>" + xmlText(resp.href) + "</d:href>")
+		if resp.status != 0 {
+			b.WriteString(davStatus(resp.status))
+		}
+		if len(resp.found) > 0 {
+			propstat(resp.found, http.StatusOK)
+		}
+		if len(resp.missing) > 0 {
+			var missing []string
+			for _, name := range resp.missing {
+				missing = append(missing, xmlElement(name, ""))
+			}
+			propstat(missing, http.StatusNotFound)
+		}
+		b.WriteString("</d:response>")
+	}
+	if syncToken != "" {
+		b.WriteString("<d:sync-token>" + xmlText(syncToken) + "</d:sync-token>")
+	}
+	b.WriteString("</d:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+// writeDAVError reports a failed DAV or CalDAV precondition.
+func writeDAVError(w http.ResponseWriter, status int, condition string) {
+	ns := davNS
+	switch condition {
+	case "valid-calendar-data", "valid-calendar-object-resource", "no-uid-conflict":
+		ns = calDAVNS
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header+`<d:error xmlns:d="DAV:" xmlns:c="`+calDAVNS+`">`+xmlElement(xml.Name{Space: ns, Local: condition}, "")+`</d:error>`)
+}
+
+func davStatus(status int) string {
+	return fmt.Sprintf("<d:status>HTTP/1.1 %d %s</d:status>", status, http.StatusText(status))
+}
+
+// xmlElement writes an element with already escaped content, declaring
+// namespaces the multistatus doesn't.
+func xmlElement(name xml.Name, inner string) string {
+	tag, decl := name.Local, ""
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		tag = prefix + ":" + name.Local
+	} else if name.Space != "" {
+		tag, decl = "x:"+name.Local, ` xmlns:x="`+xmlText(name.Space)+`"`
+	}
+	if inner == "" {
+		return "<" + tag + decl + "/>"
+	}
+	return "<" + tag + decl + ">" + inner + "</" + tag + ">"
+}
+
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// readFixture loads a request recorded from a client. {{name}} in it is
+// replaced with vars[name], for values only known while replaying.
+func readFixture(t *testing.T, name string, vars map[string]string) *http.Request {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", "caldav", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(raw)
+	for k, v := range vars {
+		text = strings.ReplaceAll(text, "{{"+k+"}}", v)
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	head, body, _ := strings.Cut(text, "\n\n")
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(head + "\n\n")))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	r := httptest.NewRequest(req.Method, req.URL.String(), strings.NewReader(body))
+	r.Header = req.Header
+	return r
+}
+
+var (
+	etagPattern      = regexp.MustCompile(`<d:getetag>(&#34;|")([^<&"]+)(&#34;|")</d:getetag>`)
+	syncTokenPattern = regexp.MustCompile(`<d:sync-token>([^<]+)</d:sync-token>`)
+)
+
+func TestCalDAVClientFixtures(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	vars := make(map[string]string)
+	steps := []struct {
+		fixture string
+		status  int
+		want    []string
+		absent  []string
+	}{
+		{"01-propfind-calendar.http", http.StatusMultiStatus, []string{
+			"<d:resourcetype><d:collection/><c:calendar/></d:resourcetype>",
+			`<c:comp name="VEVENT"/>`,
+			"<cs:getctag>0</cs:getctag>",
+			"<d:sync-collection/>",
+			"HTTP/1.1 404 Not Found",
+		}, nil},
+		{"02-put-new.http", http.StatusCreated, nil, nil},
+		{"02-put-new.http", http.StatusPreconditionFailed, nil, nil},
+		{"03-sync-initial.http", http.StatusMultiStatus, []string{
+			"/dav/users/1/calendar/8f0c5a1e-3b7d-4c61-9d2e-7a4b1c9e0f11.ics",
+			"<d:sync-token>urn:l2.18:sync:1</d:sync-token>",
+		}, nil},
+		{"04-multiget.http", http.StatusMultiStatus, []string{
+			"SUMMARY:Team lunch",
+			"DTSTART;TZID=Europe/Berlin:20240305T123000",
+			"<d:href>/dav/users/1/calendar/missing.ics</d:href><d:status>HTTP/1.1 404 Not Found</d:status>",
+		}, []string{"VALARM"}},
+		{"05-put-update.http", http.StatusNoContent, nil, nil},
+		{"06-put-stale.http", http.StatusPreconditionFailed, nil, nil},
+		// The update made the lunch weekly, so it is found on May 21.
+		{"07-calendar-query.http", http.StatusMultiStatus, []string{"8f0c5a1e-3b7d-4c61-9d2e-7a4b1c9e0f11.ics"}, nil},
+		{"08-delete.http", http.StatusNoContent, nil, nil},
+		{"09-sync-delta.http", http.StatusMultiStatus, []string{
+			"<d:href>/dav/users/1/calendar/8f0c5a1e-3b7d-4c61-9d2e-7a4b1c9e0f11.ics</d:href><d:status>HTTP/1.1 404 Not Found</d:status>",
+			"<d:sync-token>urn:l2.18:sync:3</d:sync-token>",
+		}, nil},
+	}
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, readFixture(t, step.fixture, vars))
+		body := rec.Body.String()
+		if rec.Code != step.status {
+			t.Fatalf("%s: status %d, want %d\n%s", step.fixture, rec.Code, step.status, body)
+		}
+		for _, want := range step.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: response lacks %q\n%s", step.fixture, want, body)
+			}
+		}
+		for _, absent := range step.absent {
+			if strings.Contains(body, absent) {
+				t.Errorf("%s: response contains %q", step.fixture, absent)
+			}
+		}
+		if m := etagPattern.FindStringSubmatch(body); m != nil {
+			vars["etag"] = `"` + m[2] + `"`
+		}
+		if m := syncTokenPattern.FindStringSubmatch(body); m != nil && strings.HasPrefix(step.fixture, "03") {
+			vars["sync-token"] = m[1]
+		}
+	}
+}
+
+func TestCalDAVDiscovery(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	rec := doRequest(t, h, http.MethodGet, "/.well-known/caldav", "")
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/dav/" {
+		t.Errorf("well-known: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = doRequest(t, h, "PROPFIND", "/dav/users/2/", `<propfind xmlns="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><prop><C:calendar-home-set/></prop></propfind>`)
+	if !strings.Contains(rec.Body.String(), "<c:calendar-home-set><d:href>/dav/users/2/</d:href></c:calendar-home-set>") {
+		t.Errorf("principal: %s", rec.Body)
+	}
+	if rec := doRequest(t, h, http.MethodOptions, "/dav/users/2/calendar/", ""); !strings.Contains(rec.Header().Get("DAV"), "calendar-access") {
+		t.Errorf("OPTIONS: DAV %q", rec.Header().Get("DAV"))
+	}
+}
+
+func TestLegacyUpdateKeepsUID(t *testing.T) {
+	c := NewCalendar()
+	h := makeHandlers(c)
+	ics := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:abc-123\r\nDTSTART:20240304T100000Z\r\nSUMMARY:Imported\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	if rec := doRequest(t, h, http.MethodPost, "/v2/users/1/calendar.ics", ics); rec.Code != http.StatusOK {
+		t.Fatalf("import: status %d, body %s", rec.Code, rec.Body)
+	}
+	imported, ok := c.FindUID(1, "abc-123")
+	if !ok {
+		t.Fatal("imported event not found by UID")
+	}
+
+	// The original API knows nothing of UIDs and sends none.
+	body := `{"id":"` + imported.ID + `","user_id":1,"start":"2024-03-04T11:00:00Z","event":"Moved"}`
+	if rec := doRequest(t, h, http.MethodPost, "/update_event", body); rec.Code != http.StatusOK {
+		t.Fatalf("update: status %d, body %s", rec.Code, rec.Body)
+	}
+	if e, ok := c.FindUID(1, "abc-123"); !ok || e.Text != "Moved" {
+		t.Errorf("after update FindUID = %+v, %v", e, ok)
+	}
+	rec := doRequest(t, h, "PROPFIND", "/dav/users/1/calendar/", `<propfind xmlns="DAV:"><prop><getetag/></prop></propfind>`)
+	if body := rec.Body.String(); !strings.Contains(body, "/dav/users/1/calendar/abc-123.ics") || strings.Contains(body, imported.ID+".ics") {
+		t.Errorf("PROPFIND after update: %s", body)
+	}
+}
+
+func TestCalDAVUIDWithSlash(t *testing.T) {
+	c := NewCalendar()
+	h := makeHandlers(c)
+	ics := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:team/2024@example.com\r\nDTSTART:20240304T100000Z\r\nSUMMARY:Slashed\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	if rec := doRequest(t, h, http.MethodPost, "/v2/users/1/calendar.ics", ics); rec.Code != http.StatusOK {
+		t.Fatalf("import: status %d, body %s", rec.Code, rec.Body)
+	}
+	e, _ := c.FindUID(1, "team/2024@example.com")
+	href := resourceHref(e)
+	if href != "/dav/users/1/calendar/team%2F2024@example.com.ics" {
+		t.Fatalf("href = %s", href)
+	}
+
+	// The href the server hands out leads back to the event.
+	if rec := doRequest(t, h, http.MethodGet, href, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "UID:team/2024@example.com") {
+		t.Errorf("GET %s: status %d, body %s", href, rec.Code, rec.Body)
+	}
+	report := `<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><D:getetag/></D:prop>` +
+		`<D:href>` + href + `</D:href></C:calendar-multiget>`
+	rec := doRequest(t, h, "REPORT", "/dav/users/1/calendar/", report)
+	if body := rec.Body.String(); !strings.Contains(body, e.ID+"-1") || !strings.Contains(body, "200 OK") {
+		t.Errorf("multiget of %s: %s", href, body)
+	}
+	if rec := doRequest(t, h, http.MethodGet, "/dav/users/1/calendar/team/2024@example.com.ics", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unescaped slash: status %d", rec.Code)
+	}
+}
@@ -1,99 +1,650 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// Event runs from Start up to, not including, End. All-day events start
+// and end at midnight in their time zone. Date mirrors Start for clients
+// of the original API, which only knew dates.
+//
+// An event with an RRule is a series: Start and End are its first
+// occurrence, ExDates are the starts of cancelled occurrences and
+// Overrides replace single occurrences. Range queries return the
+// occurrences, each with RecurrenceID set to its original start.
+//
+// CalendarID names one of the owner's calendars, empty for the default
+// one. Attendees are the other users invited to the event. Tags are free
+// labels, iCalendar's CATEGORIES, which searches match whatever the case.
 type Event struct {
-	UserID int       `json:"user_id"`
-	Date   time.Time `json:"date"`
-	Text   string    `json:"event"`
+	ID string `json:"id"`
+	// UID is the iCalendar UID of an imported event, which later imports
+	// of the same event match on.
+	UID          string      `json:"uid,omitempty"`
+	UserID       int         `json:"user_id"`
+	CalendarID   string      `json:"calendar_id,omitempty"`
+	Date         time.Time   `json:"date"`
+	Start        time.Time   `json:"start"`
+	End          time.Time   `json:"end"`
+	AllDay       bool        `json:"all_day"`
+	TimeZone     string      `json:"time_zone,omitempty"`
+	Text         string      `json:"event"`
+	RRule        string      `json:"rrule,omitempty"`
+	ExDates      []time.Time `json:"exdates,omitempty"`
+	Overrides    []Override  `json:"overrides,omitempty"`
+	RecurrenceID *time.Time  `json:"recurrence_id,omitempty"`
+	Attendees    []Attendee  `json:"attendees,omitempty"`
+	Reminders    []Reminder  `json:"reminders,omitempty"`
+	Tags         []string    `json:"tags,omitempty"`
+	Version      int         `json:"version"`
+	// Seq is the number of the event's last change among its owner's,
+	// see changeState.
+	Seq int64 `json:"seq,omitempty"`
 }
 
+// Override changes the occurrence of a series starting at RecurrenceID.
+// Zero times and empty text keep the occurrence's own.
+type Override struct {
+	RecurrenceID time.Time `json:"recurrence_id"`
+	Start        time.Time `json:"start,omitempty"`
+	End          time.Time `json:"end,omitempty"`
+	Text         string    `json:"event,omitempty"`
+}
+
+// defaultDuration is the length of a timed event created without an end.
+const defaultDuration = time.Hour
+
+// maxEventDays bounds the length of an event. Range queries look back
+// as far as the longest event stored, so one endless event would slow
+// every one of them.
+const maxEventDays = 366
+
+var (
+	errInvalidEvent = errors.New("неверные данные события")
+	errNotFound     = errors.New("событие не найдено")
+	errConflict     = errors.New("событие изменено другим запросом")
+)
+
 type Calendar struct {
-	mu     sync.Mutex
-	events map[string][]Event
+	mu    sync.Mutex
+	store EventStore
+	// byID maps an event ID to the date key it is stored under.
+	byID map[string]string
+	// recurring holds the IDs of series, which range queries expand
+	// instead of finding them by day.
+	recurring map[string]bool
+	// byUID maps uidKey of imported events to their IDs.
+	byUID map[string]string
+	// calendars holds the named calendars of each user, see CalendarInfo.
+	calendars map[int][]CalendarInfo
+	search    *searchIndex
+	// feeds holds the channels subscribed to each user's changes.
+	feeds map[int]map[chan Change]bool
+	// longest is the longest event duration stored. Events are bucketed by
+	// the UTC day they start on, so a window query looks back this far to
+	// catch events that began earlier and are still running. lengths and
+	// lengthCount hold the durations of events that aren't series, so that
+	// longest shrinks again when the longest event goes.
+	longest     time.Duration
+	lengths     map[string]time.Duration
+	lengthCount map[time.Duration]int
+}
+
+type userSettings struct {
+	TimeZone      string `json:"time_zone,omitempty"`
+	OverlapPolicy string `json:"overlap_policy,omitempty"`
 }
 
 func NewCalendar() *Calendar {
-	return &Calendar{events: make(map[string][]Event)}
+	return NewCalendarWithStore(NewMemoryStore())
+}
+
+// NewCalendarWithStore indexes the events already in store. Events saved
+// by older versions are brought up to date: given an ID, and, if they
+// only have a date, turned into all-day events.
+func NewCalendarWithStore(store EventStore) *Calendar {
+	c := &Calendar{store: store, byID: make(map[string]string), recurring: make(map[string]bool), byUID: make(map[string]string), search: newSearchIndex(),
+		lengths: make(map[string]time.Duration), lengthCount: make(map[time.Duration]int)}
+	c.loadCalendars()
+	for _, date := range store.Dates() {
+		evts := store.Day(date)
+		changed := false
+		for i := range evts {
+			e := &evts[i]
+			if e.ID == "" {
+				e.ID = newEventID()
+				e.Version = 1
+				changed = true
+			}
+			if e.Start.IsZero() {
+				if err := c.normalize(e); err != nil {
+					logger.Printf("событие %s: %v", e.ID, err)
+				}
+				changed = true
+			}
+			c.index(*e, date)
+		}
+		if !changed {
+			continue
+		}
+		if err := c.put(map[string][]Event{date: evts}); err != nil {
+			logger.Printf("не удалось обновить события за %s: %v", date, err)
+		}
+	}
+	return c
+}
+
+func newEventID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func dateKey(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// bucketKey is the date an event is stored under: the UTC day it starts.
+func bucketKey(e Event) string {
+	return dateKey(e.Start.UTC())
 }
 
-func (c *Calendar) Create(e Event) error {
+func validate(e Event) error {
 	if e.UserID <= 0 || e.Text == "" {
-		return errors.New("неверные данные события")
+		return errInvalidEvent
+	}
+	return nil
+}
+
+// eventLocation is the zone e is in. Stored times only keep their offset,
+// which is not enough to step across DST changes.
+func eventLocation(e Event) *time.Location {
+	if loc, err := time.LoadLocation(e.TimeZone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+func loadZone(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: неизвестный часовой пояс %q", errInvalidEvent, name)
+	}
+	return loc, nil
+}
+
+// normalize fills in what the client left out. An event with only a Date,
+// as the original API sends, becomes an all-day event on that date. The
+// event's zone defaults to its owner's. Must be called with c.mu held.
+func (c *Calendar) normalize(e *Event) error {
+	if e.TimeZone == "" {
+		e.TimeZone = c.userSettings(e.UserID).TimeZone
+	}
+	loc := time.UTC
+	if e.TimeZone != "" {
+		var err error
+		if loc, err = loadZone(e.TimeZone); err != nil {
+			return err
+		}
+	}
+
+	if e.Start.IsZero() {
+		if e.Date.IsZero() {
+			return fmt.Errorf("%w: не указано время начала", errInvalidEvent)
+		}
+		e.Start, e.AllDay = e.Date, true
+	}
+
+	if e.AllDay {
+		// The calendar date as the client wrote it, whatever the offset.
+		y, m, d := e.Start.Date()
+		e.Start = time.Date(y, m, d, 0, 0, 0, 0, loc)
+		if e.End.IsZero() {
+			e.End = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		} else {
+			y, m, d := e.End.Date()
+			e.End = time.Date(y, m, d, 0, 0, 0, 0, loc)
+		}
+	} else {
+		e.Start = e.Start.In(loc)
+		if e.End.IsZero() {
+			e.End = e.Start.Add(defaultDuration)
+		}
+		e.End = e.End.In(loc)
+	}
+	if !e.End.After(e.Start) {
+		return fmt.Errorf("%w: окончание должно быть позже начала", errInvalidEvent)
+	}
+	if e.End.After(e.Start.AddDate(0, 0, maxEventDays)) {
+		return fmt.Errorf("%w: событие длиннее %d дней", errInvalidEvent, maxEventDays)
+	}
+	e.Date = e.Start
+	e.RecurrenceID = nil
+	if err := c.normalizeInvitations(e); err != nil {
+		return err
 	}
-	dateKey := e.Date.Format("2006-01-02")
+	if err := normalizeReminders(e); err != nil {
+		return err
+	}
+	if err := normalizeTags(e); err != nil {
+		return err
+	}
+	return normalizeSeries(e)
+}
+
+// index must be called with c.mu held.
+func (c *Calendar) index(e Event, key string) {
+	c.byID[e.ID] = key
+	c.search.add(e)
+	if e.UID != "" {
+		c.byUID[uidKey(e.UserID, e.UID)] = e.ID
+	}
+	c.forgetDuration(e.ID)
+	if e.RRule != "" {
+		c.recurring[e.ID] = true
+	} else {
+		delete(c.recurring, e.ID)
+		c.noteDuration(e)
+	}
+}
+
+// noteDuration must be called with c.mu held.
+func (c *Calendar) noteDuration(e Event) {
+	d := e.End.Sub(e.Start)
+	c.lengths[e.ID] = d
+	c.lengthCount[d]++
+	if d > c.longest {
+		c.longest = d
+	}
+}
+
+// forgetDuration drops the duration noted for event id, if any. Must be
+// called with c.mu held.
+func (c *Calendar) forgetDuration(id string) {
+	d, ok := c.lengths[id]
+	if !ok {
+		return
+	}
+	delete(c.lengths, id)
+	if c.lengthCount[d]--; c.lengthCount[d] > 0 {
+		return
+	}
+	delete(c.lengthCount, d)
+	if d == c.longest {
+		c.longest = 0
+		for d := range c.lengthCount {
+			c.longest = max(c.longest, d)
+		}
+	}
+}
+
+// Create stores e under a new ID and returns it as stored. An event
+// overlapping others under a reject policy is refused with an
+// OverlapError.
+func (c *Calendar) Create(e Event) (Event, error) {
+	return c.create(e, false)
+}
+
+// ForceCreate is Create ignoring the overlap policy.
+func (c *Calendar) ForceCreate(e Event) (Event, error) {
+	return c.create(e, true)
+}
+
+func (c *Calendar) create(e Event, force bool) (Event, error) {
+	if err := validate(e); err != nil {
+		return Event{}, err
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.events[dateKey] = append(c.events[dateKey], e)
+	err := c.normalize(&e)
+	if err != nil {
+		return Event{}, err
+	}
+	e.ID = newEventID()
+	if err := c.checkOverlaps(e, nil, force); err != nil {
+		return Event{}, err
+	}
+	e.Version = 1
+	if e.Seq, err = c.recordChange(e.UserID, resourceUID(e), false); err != nil {
+		return Event{}, err
+	}
+	key := bucketKey(e)
+	if err := c.put(map[string][]Event{key: append(c.store.Day(key), e)}); err != nil {
+		return Event{}, err
+	}
+	c.index(e, key)
+	c.publish(e.UserID, eventChange(e))
+	return e, nil
+}
+
+func (c *Calendar) Get(id string) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, i, evts, err := c.find(id)
+	if err != nil {
+		return Event{}, err
+	}
+	return evts[i], nil
+}
+
+// Update replaces the event with e.ID, moving it if the date changed. A
+// non-zero e.Version must match the stored one, so two clients editing
+// the same event can't silently overwrite each other. The overlap
+// policy applies as for Create.
+func (c *Calendar) Update(e Event) (Event, error) {
+	return c.update(e, false)
+}
+
+// ForceUpdate is Update ignoring the overlap policy.
+func (c *Calendar) ForceUpdate(e Event) (Event, error) {
+	return c.update(e, true)
+}
+
+func (c *Calendar) update(e Event, force bool) (Event, error) {
+	if err := validate(e); err != nil {
+		return Event{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	oldKey, i, evts, err := c.find(e.ID)
+	if err != nil {
+		return Event{}, err
+	}
+	old := evts[i]
+	if e.UserID != old.UserID {
+		return Event{}, fmt.Errorf("%w: владельца события менять нельзя", errInvalidEvent)
+	}
+	if e.Version != 0 && e.Version != old.Version {
+		return Event{}, fmt.Errorf("%w: версия %d, ожидалась %d", errConflict, e.Version, old.Version)
+	}
+	// Clients of the original API don't know UIDs: without one the event
+	// keeps its own, or CalDAV clients would see it as a new resource.
+	if e.UID == "" {
+		e.UID = old.UID
+	}
+	if err := c.normalize(&e); err != nil {
+		return Event{}, err
+	}
+	if err := c.checkOverlaps(e, &old, force); err != nil {
+		return Event{}, err
+	}
+	e.Version = old.Version + 1
+	if e.Seq, err = c.recordChange(e.UserID, resourceUID(e), false); err != nil {
+		return Event{}, err
+	}
+
+	newKey := bucketKey(e)
+	days := make(map[string][]Event)
+	if newKey == oldKey {
+		evts[i] = e
+		days[oldKey] = evts
+	} else {
+		days[oldKey] = append(evts[:i], evts[i+1:]...)
+		days[newKey] = append(c.store.Day(newKey), e)
+	}
+	if err := c.put(days); err != nil {
+		return Event{}, err
+	}
+	if old.UID != "" && old.UID != e.UID {
+		delete(c.byUID, uidKey(old.UserID, old.UID))
+	}
+	c.index(e, newKey)
+	c.publish(e.UserID, eventChange(e))
+	return e, nil
+}
+
+func (c *Calendar) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, i, evts, err := c.find(id)
+	if err != nil {
+		return err
+	}
+	deleted := evts[i]
+	seq, err := c.recordChange(deleted.UserID, resourceUID(deleted), true)
+	if err != nil {
+		return err
+	}
+	if err := c.put(map[string][]Event{key: append(evts[:i], evts[i+1:]...)}); err != nil {
+		return err
+	}
+	delete(c.byID, id)
+	delete(c.recurring, id)
+	c.forgetDuration(id)
+	c.search.remove(id)
+	if deleted.UID != "" {
+		delete(c.byUID, uidKey(deleted.UserID, deleted.UID))
+	}
+	c.publish(deleted.UserID, Change{Seq: seq, Type: changeDeleted, UID: resourceUID(deleted)})
 	return nil
 }
 
-func (c *Calendar) Update(e Event) error {
-	dateKey := e.Date.Format("2006-01-02")
+func uidKey(userID int, uid string) string {
+	return strconv.Itoa(userID) + "/" + uid
+}
+
+// FindUID returns the event of userID with the iCalendar UID uid. Events
+// created here have their ID as UID.
+func (c *Calendar) FindUID(userID int, uid string) (Event, bool) {
+	if uid == "" {
+		return Event{}, false
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if evts, ok := c.events[dateKey]; ok {
-		for i, existing := range evts {
-			if existing.UserID == e.UserID {
-				c.events[dateKey][i] = e
-				return nil
-			}
-		}
+	id, ok := c.byUID[uidKey(userID, uid)]
+	if !ok {
+		id = uid
+	}
+	_, i, evts, err := c.find(id)
+	if err != nil || evts[i].UserID != userID {
+		return Event{}, false
 	}
-	return errors.New("событие не найдено")
+	return evts[i], true
 }
 
-func (c *Calendar) Delete(e Event) error {
-	dateKey := e.Date.Format("2006-01-02")
+// UserEvents returns the events of userID as stored, series unexpanded,
+// ordered by start.
+func (c *Calendar) UserEvents(userID int) []Event {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if evts, ok := c.events[dateKey]; ok {
-		for i, existing := range evts {
-			if existing.UserID == e.UserID {
-				c.events[dateKey] = append(evts[:i], evts[i+1:]...)
-				return nil
+	return c.userEvents(userID)
+}
+
+// userEvents must be called with c.mu held.
+func (c *Calendar) userEvents(userID int) []Event {
+	result := []Event{}
+	for _, date := range c.store.Dates() {
+		for _, e := range c.store.Day(date) {
+			if e.UserID == userID {
+				result = append(result, e)
 			}
 		}
 	}
-	return errors.New("событие не найдено")
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
 }
 
-func (c *Calendar) EventsForDay(date string) ([]Event, error) {
+// find must be called with c.mu held.
+func (c *Calendar) find(id string) (key string, index int, evts []Event, err error) {
+	key, ok := c.byID[id]
+	if !ok {
+		return "", 0, nil, errNotFound
+	}
+	evts = c.store.Day(key)
+	for i := range evts {
+		if evts[i].ID == id {
+			return key, i, evts, nil
+		}
+	}
+	return "", 0, nil, errNotFound
+}
+
+func (c *Calendar) put(days map[string][]Event) error {
+	if err := c.store.Put(days); err != nil {
+		return fmt.Errorf("%w: %v", errStorage, err)
+	}
+	return nil
+}
+
+func userSettingsKey(userID int) string {
+	return "user/" + strconv.Itoa(userID)
+}
+
+// userSettings must be called with c.mu held.
+func (c *Calendar) userSettings(userID int) userSettings {
+	var s userSettings
+	if raw := c.store.Meta(userSettingsKey(userID)); raw != nil {
+		json.Unmarshal(raw, &s)
+	}
+	return s
+}
+
+// UserLocation returns the user's time zone, UTC if none was set.
+func (c *Calendar) UserLocation(userID int) *time.Location {
+	c.mu.Lock()
+	tz := c.userSettings(userID).TimeZone
+	c.mu.Unlock()
+	if loc, err := time.LoadLocation(tz); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// SetUserTimeZone sets the zone new events of userID default to and that
+// their range queries use. Existing events keep their zone.
+func (c *Calendar) SetUserTimeZone(userID int, tz string) error {
+	return c.UpdateSettings(userID, &tz, nil)
+}
+
+// SetOverlapPolicy sets the overlap policy of the events of userID in
+// calendars without their own.
+func (c *Calendar) SetOverlapPolicy(userID int, policy string) error {
+	return c.UpdateSettings(userID, nil, &policy)
+}
+
+// UpdateSettings sets the time zone and overlap policy of userID, see
+// SetUserTimeZone and SetOverlapPolicy, in one write. Nil ones are left
+// as they are.
+func (c *Calendar) UpdateSettings(userID int, tz, policy *string) error {
+	if tz != nil && *tz != "" {
+		if _, err := loadZone(*tz); err != nil {
+			return err
+		}
+	}
+	if policy != nil {
+		if err := checkPolicy(*policy); err != nil {
+			return err
+		}
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if evts, ok := c.events[date]; ok {
-		return evts, nil
+	s := c.userSettings(userID)
+	if tz != nil {
+		s.TimeZone = *tz
 	}
-	return []Event{}, nil
+	if policy != nil {
+		s.OverlapPolicy = *policy
+	}
+	raw, _ := json.Marshal(s)
+	if err := c.store.PutMeta(userSettingsKey(userID), raw); err != nil {
+		return fmt.Errorf("%w: %v", errStorage, err)
+	}
+	return nil
 }
 
-func (c *Calendar) EventsForWeek(startDate time.Time) []Event {
+// OverlapPolicy returns the overlap policy set for userID.
+func (c *Calendar) OverlapPolicy(userID int) string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	var result []Event
-	for i := 0; i < 7; i++ {
-		d := startDate.AddDate(0, 0, i).Format("2006-01-02")
-		if evts, ok := c.events[d]; ok {
-			result = append(result, evts...)
-		}
+	if policy := c.userSettings(userID).OverlapPolicy; policy != "" {
+		return policy
 	}
-	return result
+	return policyAllow
 }
 
-func (c *Calendar) EventsForMonth(year int, month time.Month) []Event {
+// EventsBetween returns the events and occurrences of series overlapping
+// [from, to), ordered by start. userID 0 means every user.
+func (c *Calendar) EventsBetween(userID int, from, to time.Time) []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.between(from, to, func(e Event) bool { return userID == 0 || e.UserID == userID })
+}
+
+// Agenda is EventsBetween for what userID sees: their own events, those
+// in calendars shared with them and those they are invited to and haven't
+// declined.
+func (c *Calendar) Agenda(userID int, from, to time.Time) []Event {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	var result []Event
-	daysInMonth := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
-	for day := 1; day <= daysInMonth; day++ {
-		d := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Format("2006-01-02")
-		if evts, ok := c.events[d]; ok {
-			result = append(result, evts...)
+	return c.between(from, to, c.visibleTo(userID))
+}
+
+// visibleTo returns whether an event is in the agenda of userID. Must be
+// called with c.mu held.
+func (c *Calendar) visibleTo(userID int) func(Event) bool {
+	shared := c.sharedWith(userID)
+	return func(e Event) bool {
+		return e.UserID == userID || shared[calendarRef{e.UserID, calendarOf(e)}] != "" || attending(e, userID)
+	}
+}
+
+// between must be called with c.mu held.
+func (c *Calendar) between(from, to time.Time, keep func(Event) bool) []Event {
+	result := []Event{}
+	first := from.Add(-c.longest).UTC()
+	first = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+	for d := first; d.Before(to); d = d.AddDate(0, 0, 1) {
+		for _, e := range c.store.Day(dateKey(d)) {
+			if e.RRule != "" || !keep(e) {
+				continue
+			}
+			if e.Start.Before(to) && e.End.After(from) {
+				result = append(result, e)
+			}
+		}
+	}
+	for id := range c.recurring {
+		_, i, evts, err := c.find(id)
+		if err != nil || !keep(evts[i]) {
+			continue
 		}
+		result = append(result, expand(evts[i], from, to)...)
 	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
 	return result
 }
+
+// dayWindow returns local midnight of date through the next midnight,
+// which is 23 or 25 hours away on DST transition days.
+func dayWindow(date time.Time, days int, loc *time.Location) (time.Time, time.Time) {
+	y, m, d := date.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc), time.Date(y, m, d+days, 0, 0, 0, 0, loc)
+}
+
+func (c *Calendar) EventsForDay(date string) ([]Event, error) {
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return nil, err
+	}
+	return c.EventsBetween(0, day, day.AddDate(0, 0, 1)), nil
+}
+
+func (c *Calendar) EventsForWeek(startDate time.Time) []Event {
+	from, to := dayWindow(startDate, 7, time.UTC)
+	return c.EventsBetween(0, from, to)
+}
+
+func (c *Calendar) EventsForMonth(year int, month time.Month) []Event {
+	from := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return c.EventsBetween(0, from, from.AddDate(0, 1, 0))
+}
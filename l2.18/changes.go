@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// maxTombstones bounds how many deletions a user's change state
+// remembers. Clients syncing from before the oldest one start over.
+const maxTombstones = 1000
+
+var errSyncToken = errors.New("токен синхронизации устарел")
+
+// changeState numbers the changes to one user's events. Every stored
+// event carries the number of its last change in Seq; deletions are kept
+// as tombstones so that clients can learn about them too.
+type changeState struct {
+	Seq     int64            `json:"seq"`
+	Deleted map[string]int64 `json:"deleted,omitempty"`
+	// Floor is the oldest Seq changes can be listed from.
+	Floor int64 `json:"floor,omitempty"`
+}
+
+func changeStateKey(userID int) string {
+	return "changes/" + strconv.Itoa(userID)
+}
+
+// resourceUID names an event to sync clients: its iCalendar UID, or its
+// ID for events created here.
+func resourceUID(e Event) string {
+	if e.UID != "" {
+		return e.UID
+	}
+	return e.ID
+}
+
+// changeState must be called with c.mu held.
+func (c *Calendar) changeState(userID int) changeState {
+	var s changeState
+	if raw := c.store.Meta(changeStateKey(userID)); raw != nil {
+		json.Unmarshal(raw, &s)
+	}
+	return s
+}
+
+// recordChange numbers a change to the event uid of userID, which was
+// deleted if deleted is set. It is stored before the change itself, so a
+// crash in between leaves a gap in the numbers rather than reusing one.
+// Must be called with c.mu held.
+func (c *Calendar) recordChange(userID int, uid string, deleted bool) (int64, error) {
+	s := c.changeState(userID)
+	s.Seq++
+	if deleted {
+		if s.Deleted == nil {
+			s.Deleted = make(map[string]int64)
+		}
+		s.Deleted[uid] = s.Seq
+		for len(s.Deleted) > maxTombstones {
+			oldest, seq := "", s.Seq
+			for u, n := range s.Deleted {
+				if n < seq {
+					oldest, seq = u, n
+				}
+			}
+			delete(s.Deleted, oldest)
+			s.Floor = seq
+		}
+	} else {
+		delete(s.Deleted, uid)
+	}
+	raw, _ := json.Marshal(s)
+	if err := c.store.PutMeta(changeStateKey(userID), raw); err != nil {
+		return 0, fmt.Errorf("%w: %v", errStorage, err)
+	}
+	return s.Seq, nil
+}
+
+// SyncToken is the number of the latest change to userID's events.
+func (c *Calendar) SyncToken(userID int) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changeState(userID).Seq
+}
+
+// Changes returns the events of userID changed after since, the UIDs of
+// those deleted after it and the number of the latest change. since 0
+// lists every event.
+func (c *Calendar) Changes(userID int, since int64) (changed []Event, deleted []string, token int64, err error) {
+	c.mu.Lock()
+	s := c.changeState(userID)
+	c.mu.Unlock()
+	if since < 0 || since > s.Seq || since > 0 && since < s.Floor {
+		return nil, nil, 0, errSyncToken
+	}
+	for _, e := range c.UserEvents(userID) {
+		if since == 0 || e.Seq > since {
+			changed = append(changed, e)
+		}
+	}
+	if since > 0 {
+		for uid, seq := range s.Deleted {
+			if seq > since {
+				deleted = append(deleted, uid)
+			}
+		}
+		sort.Strings(deleted)
+	}
+	return changed, deleted, s.Seq, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
@@ -8,9 +9,13 @@ import (
 func TestCreateEvent(t *testing.T) {
 	c := NewCalendar()
 	e := Event{UserID: 1, Date: time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC), Text: "New Year Party"}
-	if err := c.Create(e); err != nil {
+	created, err := c.Create(e)
+	if err != nil {
 		t.Fatalf("Create() error = %v", err)
 	}
+	if created.ID == "" {
+		t.Errorf("expected an ID to be assigned")
+	}
 
 	evts, _ := c.EventsForDay("2023-12-31")
 	if len(evts) != 1 {
@@ -23,8 +28,8 @@ func TestCreateEvent(t *testing.T) {
 
 func TestCreateEventInvalid(t *testing.T) {
 	c := NewCalendar()
-	err := c.Create(Event{UserID: 0, Date: time.Now(), Text: ""})
-	if err == nil {
+	_, err := c.Create(Event{UserID: 0, Date: time.Now(), Text: ""})
+	if !errors.Is(err, errInvalidEvent) {
 		t.Errorf("expected error for invalid event, got nil")
 	}
 }
@@ -32,9 +37,9 @@ func TestCreateEventInvalid(t *testing.T) {
 func TestUpdateEvent(t *testing.T) {
 	c := NewCalendar()
 	date := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
-	c.Create(Event{UserID: 1, Date: date, Text: "Old Text"})
+	e, _ := c.Create(Event{UserID: 1, Date: date, Text: "Old Text"})
 
-	err := c.Update(Event{UserID: 1, Date: date, Text: "Updated Text"})
+	_, err := c.Update(Event{ID: e.ID, UserID: 1, Date: date, Text: "Updated Text"})
 	if err != nil {
 		t.Fatalf("Update() error = %v", err)
 	}
@@ -47,8 +52,8 @@ func TestUpdateEvent(t *testing.T) {
 
 func TestUpdateEventNotFound(t *testing.T) {
 	c := NewCalendar()
-	err := c.Update(Event{UserID: 99, Date: time.Now(), Text: "No Event"})
-	if err == nil {
+	_, err := c.Update(Event{ID: "missing", UserID: 99, Date: time.Now(), Text: "No Event"})
+	if !errors.Is(err, errNotFound) {
 		t.Errorf("expected error for updating non-existing event, got nil")
 	}
 }
@@ -56,9 +61,9 @@ func TestUpdateEventNotFound(t *testing.T) {
 func TestDeleteEvent(t *testing.T) {
 	c := NewCalendar()
 	date := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
-	c.Create(Event{UserID: 1, Date: date, Text: "Some Event"})
+	e, _ := c.Create(Event{UserID: 1, Date: date, Text: "Some Event"})
 
-	err := c.Delete(Event{UserID: 1, Date: date})
+	err := c.Delete(e.ID)
 	if err != nil {
 		t.Fatalf("Delete() error = %v", err)
 	}
@@ -71,8 +76,8 @@ func TestDeleteEvent(t *testing.T) {
 
 func TestDeleteEventNotFound(t *testing.T) {
 	c := NewCalendar()
-	err := c.Delete(Event{UserID: 99, Date: time.Now()})
-	if err == nil {
+	err := c.Delete("missing")
+	if !errors.Is(err, errNotFound) {
 		t.Errorf("expected error for deleting non-existing event, got nil")
 	}
 }
@@ -110,3 +115,134 @@ func TestEventsForDayEmpty(t *testing.T) {
 		t.Errorf("expected 0 events, got %d", len(evts))
 	}
 }
+
+func TestUpdateSecondEventOfDay(t *testing.T) {
+	c := NewCalendar()
+	date := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	c.Create(Event{UserID: 1, Date: date, Text: "First"})
+	second, _ := c.Create(Event{UserID: 1, Date: date, Text: "Second"})
+
+	if _, err := c.Update(Event{ID: second.ID, UserID: 1, Date: date, Text: "Second, edited"}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	evts, _ := c.EventsForDay("2023-12-31")
+	if evts[0].Text != "First" || evts[1].Text != "Second, edited" {
+		t.Errorf("expected only the second event to change, got %v", evts)
+	}
+}
+
+func TestUpdateMovesEvent(t *testing.T) {
+	c := NewCalendar()
+	from := time.Date(2023, 12, 30, 0, 0, 0, 0, time.UTC)
+	e, _ := c.Create(Event{UserID: 1, Date: from, Text: "Moving"})
+
+	moved, err := c.Update(Event{ID: e.ID, UserID: 1, Date: from.AddDate(0, 0, 1), Text: "Moving"})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if evts, _ := c.EventsForDay("2023-12-30"); len(evts) != 0 {
+		t.Errorf("expected old day to be empty, got %v", evts)
+	}
+	if got, _ := c.Get(e.ID); got.Date != moved.Date {
+		t.Errorf("Get() after move = %v", got)
+	}
+}
+
+func TestUpdateVersionConflict(t *testing.T) {
+	c := NewCalendar()
+	date := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	e, _ := c.Create(Event{UserID: 1, Date: date, Text: "v1"})
+	if _, err := c.Update(Event{ID: e.ID, UserID: 1, Date: date, Text: "v2", Version: e.Version}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	_, err := c.Update(Event{ID: e.ID, UserID: 1, Date: date, Text: "stale", Version: e.Version})
+	if !errors.Is(err, errConflict) {
+		t.Errorf("expected errConflict for stale version, got %v", err)
+	}
+}
+
+func TestEventsOverlapWindow(t *testing.T) {
+	c := NewCalendar()
+	late, _ := c.Create(Event{UserID: 1, Text: "Late show",
+		Start: time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 2, 1, 0, 0, 0, time.UTC)})
+	c.Create(Event{UserID: 1, Text: "Conference",
+		Start: time.Date(2024, 4, 20, 9, 0, 0, 0, time.UTC), End: time.Date(2024, 5, 5, 18, 0, 0, 0, time.UTC)})
+
+	evts, _ := c.EventsForDay("2024-05-02")
+	if len(evts) != 2 {
+		t.Fatalf("expected the late show and the running conference on May 2, got %v", evts)
+	}
+	if late.End.Sub(late.Start) != 2*time.Hour {
+		t.Errorf("expected explicit end to be kept, got %v", late.End)
+	}
+}
+
+func TestEventLengthBounded(t *testing.T) {
+	c := NewCalendar()
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	_, err := c.Create(Event{UserID: 1, Text: "Forever", Start: start, End: start.AddDate(0, 0, maxEventDays+1)})
+	if !errors.Is(err, errInvalidEvent) {
+		t.Errorf("expected an event over %d days to be rejected, got %v", maxEventDays, err)
+	}
+
+	short, _ := c.Create(Event{UserID: 1, Text: "Meeting", Start: start})
+	long, _ := c.Create(Event{UserID: 1, Text: "Sabbatical", Start: start, End: start.AddDate(0, 0, 90)})
+	if c.longest != 90*24*time.Hour {
+		t.Fatalf("longest = %v", c.longest)
+	}
+	// Range queries stop looking back as far once the long event is gone.
+	long.End, long.Version = start.AddDate(0, 0, 2), 0
+	c.Update(long)
+	if c.longest != 48*time.Hour {
+		t.Errorf("after shortening, longest = %v", c.longest)
+	}
+	c.Delete(long.ID)
+	if c.longest != short.End.Sub(short.Start) {
+		t.Errorf("after deleting, longest = %v", c.longest)
+	}
+}
+
+func TestTimeZones(t *testing.T) {
+	c := NewCalendar()
+	if err := c.SetUserTimeZone(1, "Asia/Tokyo"); err != nil {
+		t.Fatalf("SetUserTimeZone() error = %v", err)
+	}
+	// 22:30 UTC on May 1 is already May 2 in Tokyo.
+	e, _ := c.Create(Event{UserID: 1, Text: "Call", Start: time.Date(2024, 5, 1, 22, 30, 0, 0, time.UTC)})
+	if e.TimeZone != "Asia/Tokyo" {
+		t.Errorf("expected user zone to be applied, got %q", e.TimeZone)
+	}
+
+	tokyo := c.UserLocation(1)
+	from, to := dayWindow(time.Date(2024, 5, 2, 0, 0, 0, 0, tokyo), 1, tokyo)
+	if evts := c.EventsBetween(1, from, to); len(evts) != 1 {
+		t.Errorf("expected the call on May 2 in Tokyo, got %v", evts)
+	}
+	if evts, _ := c.EventsForDay("2024-05-02"); len(evts) != 0 {
+		t.Errorf("expected nothing on May 2 in UTC, got %v", evts)
+	}
+	if err := c.SetUserTimeZone(1, "Mars/Olympus"); !errors.Is(err, errInvalidEvent) {
+		t.Errorf("expected unknown zone to be rejected, got %v", err)
+	}
+}
+
+func TestAllDayEventAcrossDST(t *testing.T) {
+	c := NewCalendar()
+	// Clocks in New York spring forward on 2024-03-10.
+	e, err := c.Create(Event{UserID: 1, Text: "Daylight", AllDay: true, TimeZone: "America/New_York",
+		Start: time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if got := e.End.Sub(e.Start); got != 23*time.Hour {
+		t.Errorf("expected a 23 hour day, got %v", got)
+	}
+
+	ny, _ := time.LoadLocation("America/New_York")
+	for day, want := range map[int]int{9: 0, 10: 1, 11: 0} {
+		from, to := dayWindow(time.Date(2024, 3, day, 0, 0, 0, 0, ny), 1, ny)
+		if evts := c.EventsBetween(1, from, to); len(evts) != want {
+			t.Errorf("March %d in New York: expected %d events, got %v", day, want, evts)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import "sort"
+
+// Change types. changeReset tells a subscriber that changes were missed
+// for good and the user's events have to be loaded again.
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+	changeReset   = "reset"
+)
+
+// feedBuffer is how far a subscriber may fall behind before it is
+// dropped. It then resumes from the last change it got.
+const feedBuffer = 256
+
+// Change is one entry of a user's change feed. Seq numbers the changes
+// of the user's events as in changeState; UID is the changed event's, see
+// resourceUID. Event is the event after a creation or update.
+type Change struct {
+	Seq   int64  `json:"seq"`
+	Type  string `json:"type"`
+	UID   string `json:"uid,omitempty"`
+	Event *Event `json:"event,omitempty"`
+}
+
+// Subscribe returns the changes to userID's events after since and a
+// channel receiving those that follow until cancel is called. A negative
+// since starts from now. Changes already made are told as they stand: an
+// event changed twice is listed once, at its last change. If the change
+// state no longer reaches back to since the backlog is a single reset.
+//
+// The channel is closed when the subscriber falls behind or the feeds are
+// closed.
+func (c *Calendar) Subscribe(userID int, since int64) (backlog []Change, changes <-chan Change, cancel func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.changeState(userID)
+	switch {
+	case since < 0:
+	case since > s.Seq || since > 0 && since < s.Floor:
+		backlog = []Change{{Seq: s.Seq, Type: changeReset}}
+	default:
+		for _, e := range c.userEvents(userID) {
+			if e.Seq > since {
+				backlog = append(backlog, eventChange(e))
+			}
+		}
+		for uid, seq := range s.Deleted {
+			if seq > since {
+				backlog = append(backlog, Change{Seq: seq, Type: changeDeleted, UID: uid})
+			}
+		}
+		sort.Slice(backlog, func(i, j int) bool { return backlog[i].Seq < backlog[j].Seq })
+	}
+
+	ch := make(chan Change, feedBuffer)
+	if c.feeds == nil {
+		c.feeds = make(map[int]map[chan Change]bool)
+	}
+	if c.feeds[userID] == nil {
+		c.feeds[userID] = make(map[chan Change]bool)
+	}
+	c.feeds[userID][ch] = true
+	cancel = func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.unsubscribe(userID, ch)
+	}
+	return backlog, ch, cancel
+}
+
+// CloseFeeds ends every subscription, so that streams don't hold up a
+// shutdown.
+func (c *Calendar) CloseFeeds() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for userID, subs := range c.feeds {
+		for ch := range subs {
+			c.unsubscribe(userID, ch)
+		}
+	}
+}
+
+// unsubscribe must be called with c.mu held.
+func (c *Calendar) unsubscribe(userID int, ch chan Change) {
+	if c.feeds[userID][ch] {
+		delete(c.feeds[userID], ch)
+		close(ch)
+	}
+}
+
+// eventChange tells of e as of its last change: events at their first
+// version were created, others updated.
+func eventChange(e Event) Change {
+	kind := changeUpdated
+	if e.Version == 1 {
+		kind = changeCreated
+	}
+	return Change{Seq: e.Seq, Type: kind, UID: resourceUID(e), Event: &e}
+}
+
+// publish sends ch to the subscribers of userID, dropping those that
+// can't keep up. Must be called with c.mu held.
+func (c *Calendar) publish(userID int, change Change) {
+	for ch := range c.feeds[userID] {
+		select {
+		case ch <- change:
+		default:
+			c.unsubscribe(userID, ch)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSE returns the next event of an event stream, skipping comments.
+func readSSE(t *testing.T, r *bufio.Reader) (id, name string, change Change) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return id, name, change
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			name = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			json.Unmarshal([]byte(line[len("data: "):]), &change)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	c := NewCalendar()
+	srv := httptest.NewServer(makeHandlers(c))
+	defer srv.Close()
+	first, _ := c.Create(Event{UserID: 1, Start: time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), Text: "Раз"})
+	c.Create(Event{UserID: 2, Start: time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), Text: "Чужое"})
+
+	open := func(lastEventID string) (*bufio.Reader, func()) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v2/users/1/changes", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+	}
+
+	stream, stop := open("0")
+	if id, name, change := readSSE(t, stream); id != "1" || name != changeCreated || change.Event == nil || change.Event.Text != "Раз" {
+		t.Fatalf("backlog: id %s, %s %+v", id, name, change)
+	}
+	first.Text = "Два"
+	c.Update(first)
+	if id, name, change := readSSE(t, stream); id != "2" || name != changeUpdated || change.Event.Text != "Два" {
+		t.Errorf("update: id %s, %s %+v", id, name, change)
+	}
+	c.Delete(first.ID)
+	if id, name, change := readSSE(t, stream); id != "3" || name != changeDeleted || change.UID != first.ID {
+		t.Errorf("delete: id %s, %s %+v", id, name, change)
+	}
+	stop()
+
+	// Reconnecting with the last ID seen resumes after it, where the
+	// deletion is all that's left.
+	c.Create(Event{UserID: 1, Start: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC), Text: "Три"})
+	stream, stop = open("2")
+	if id, name, _ := readSSE(t, stream); id != "3" || name != changeDeleted {
+		t.Errorf("resumed: id %s, %s", id, name)
+	}
+	if id, name, change := readSSE(t, stream); id != "4" || name != changeCreated || change.Event.Text != "Три" {
+		t.Errorf("resumed: id %s, %s %+v", id, name, change)
+	}
+	stop()
+
+	// An ID from another server's history can't be resumed from.
+	stream, stop = open("99")
+	if id, name, _ := readSSE(t, stream); id != "4" || name != changeReset {
+		t.Errorf("unknown ID: id %s, %s", id, name)
+	}
+	stop()
+
+	if rec := doRequest(t, makeHandlers(c), http.MethodGet, "/v2/users/1/changes?since=x", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad since: status %d", rec.Code)
+	}
+}
+
+func TestWebSocketFeed(t *testing.T) {
+	c := NewCalendar()
+	srv := httptest.NewServer(makeHandlers(c))
+	defer srv.Close()
+	c.Create(Event{UserID: 1, Start: time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), Text: "Раз"})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /v2/users/1/changes?since=0 HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+key+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("handshake: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+
+	readFrame := func() (byte, []byte) {
+		t.Helper()
+		var head [2]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			t.Fatalf("reading frame: %v", err)
+		}
+		n := int(head[1] & 0x7F)
+		if n == 126 {
+			var ext [2]byte
+			io.ReadFull(r, ext[:])
+			n = int(binary.BigEndian.Uint16(ext[:]))
+		}
+		payload := make([]byte, n)
+		io.ReadFull(r, payload)
+		return head[0] & 0x0F, payload
+	}
+	writeFrame := func(opcode byte, payload []byte) {
+		mask := [4]byte{1, 2, 3, 4}
+		frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+		conn.Write(frame)
+	}
+	change := func() Change {
+		t.Helper()
+		opcode, payload := readFrame()
+		var change Change
+		if opcode != wsText || json.Unmarshal(payload, &change) != nil {
+			t.Fatalf("frame %x %q", opcode, payload)
+		}
+		return change
+	}
+
+	if got := change(); got.Seq != 1 || got.Type != changeCreated {
+		t.Errorf("backlog: %+v", got)
+	}
+	writeFrame(wsPing, []byte("hi"))
+	if opcode, payload := readFrame(); opcode != wsPong || string(payload) != "hi" {
+		t.Errorf("ping answered with %x %q", opcode, payload)
+	}
+	c.Create(Event{UserID: 1, Start: time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC), Text: "Два"})
+	if got := change(); got.Seq != 2 || got.Event == nil || got.Event.Text != "Два" {
+		t.Errorf("live: %+v", got)
+	}
+	writeFrame(wsClose, []byte{0x03, 0xE8})
+	if opcode, payload := readFrame(); opcode != wsClose || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("close answered with %x %v", opcode, payload)
+	}
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	c := NewCalendar()
+	backlog, changes, cancel := c.Subscribe(1, -1)
+	defer cancel()
+	if len(backlog) != 0 {
+		t.Errorf("backlog from now = %+v", backlog)
+	}
+	for i := range feedBuffer + 1 {
+		c.Create(Event{UserID: 1, Start: time.Date(2024, 3, 4, 0, i, 0, 0, time.UTC), Text: "x"})
+	}
+	n := 0
+	for range changes {
+		n++
+	}
+	if n != feedBuffer {
+		t.Errorf("got %d changes before being dropped, want %d", n, feedBuffer)
+	}
+
+	// The dropped subscriber resumes from the last change it got.
+	backlog, _, cancel = c.Subscribe(1, int64(n))
+	defer cancel()
+	if len(backlog) != 1 || backlog[0].Seq != feedBuffer+1 {
+		t.Errorf("resumed backlog = %+v", backlog)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Interval is the time from Start up to, not including, End.
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// busy reports whether e takes up the time of userID: it is theirs, or
+// they accepted the invitation or might come.
+func busy(e Event, userID int) bool {
+	if e.UserID == userID {
+		return true
+	}
+	i := attendeeIndex(e, userID)
+	return i >= 0 && (e.Attendees[i].Status == statusAccepted || e.Attendees[i].Status == statusTentative)
+}
+
+// Busy returns the times in [from, to) userID has events, overlapping
+// and adjacent events merged, in order.
+func (c *Calendar) Busy(userID int, from, to time.Time) []Interval {
+	c.mu.Lock()
+	evts := c.between(from, to, func(e Event) bool { return busy(e, userID) })
+	c.mu.Unlock()
+	intervals := make([]Interval, 0, len(evts))
+	for _, e := range evts {
+		iv := Interval{Start: e.Start, End: e.End}
+		if iv.Start.Before(from) {
+			iv.Start = from
+		}
+		if iv.End.After(to) {
+			iv.End = to
+		}
+		intervals = append(intervals, iv)
+	}
+	return mergeIntervals(intervals)
+}
+
+func mergeIntervals(intervals []Interval) []Interval {
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+	merged := []Interval{}
+	for _, iv := range intervals {
+		if n := len(merged); n > 0 && !iv.Start.After(merged[n-1].End) {
+			if iv.End.After(merged[n-1].End) {
+				merged[n-1].End = iv.End
+			}
+			continue
+		}
+		merged = append(merged, iv)
+	}
+	return merged
+}
+
+// subtractIntervals returns the parts of free not covered by taken; both
+// are sorted and free doesn't overlap itself.
+func subtractIntervals(free, taken []Interval) []Interval {
+	var result []Interval
+	j := 0
+	for _, iv := range free {
+		start := iv.Start
+		for j < len(taken) && !taken[j].End.After(start) {
+			j++
+		}
+		for k := j; k < len(taken) && taken[k].Start.Before(iv.End); k++ {
+			if taken[k].Start.After(start) {
+				result = append(result, Interval{start, taken[k].Start})
+			}
+			if taken[k].End.After(start) {
+				start = taken[k].End
+			}
+		}
+		if start.Before(iv.End) {
+			result = append(result, Interval{start, iv.End})
+		}
+	}
+	return result
+}
+
+// intersectIntervals returns the times in both a and b, which are sorted
+// and don't overlap themselves.
+func intersectIntervals(a, b []Interval) []Interval {
+	var result []Interval
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].Start, a[i].End
+		if b[j].Start.After(start) {
+			start = b[j].Start
+		}
+		if b[j].End.Before(end) {
+			end = b[j].End
+		}
+		if start.Before(end) {
+			result = append(result, Interval{start, end})
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
+
+// WorkingHours are the times of day, in the participant's zone, a
+// meeting may take place, on the given days: "MO" to "SU" as in RRULE.
+type WorkingHours struct {
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Days  []string `json:"days,omitempty"`
+}
+
+var defaultWorkingHours = WorkingHours{Start: "09:00", End: "18:00", Days: []string{"MO", "TU", "WE", "TH", "FR"}}
+
+// windows returns the working time in [from, to) in loc.
+func (wh WorkingHours) windows(from, to time.Time, loc *time.Location) ([]Interval, error) {
+	start, err := clockMinutes(wh.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := clockMinutes(wh.End)
+	if err != nil {
+		return nil, err
+	}
+	if end <= start {
+		return nil, fmt.Errorf("%w: рабочий день должен кончаться позже, чем начинается", errInvalidEvent)
+	}
+	days := make(map[time.Weekday]bool)
+	for _, code := range wh.Days {
+		d, ok := weekdayCodes[strings.ToUpper(code)]
+		if !ok {
+			return nil, fmt.Errorf("%w: некорректный день недели %q", errInvalidEvent, code)
+		}
+		days[d] = true
+	}
+	if len(wh.Days) == 0 {
+		for d := time.Monday; d <= time.Friday; d++ {
+			days[d] = true
+		}
+	}
+
+	var result []Interval
+	first := from.In(loc)
+	for y, m, d := first.Date(); ; d++ {
+		day := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		if !day.Before(to) {
+			break
+		}
+		if !days[day.Weekday()] {
+			continue
+		}
+		iv := Interval{
+			Start: time.Date(y, m, d, 0, start, 0, 0, loc),
+			End:   time.Date(y, m, d, 0, end, 0, 0, loc),
+		}
+		if iv.Start.Before(from) {
+			iv.Start = from
+		}
+		if iv.End.After(to) {
+			iv.End = to
+		}
+		if iv.Start.Before(iv.End) {
+			result = append(result, iv)
+		}
+	}
+	return result, nil
+}
+
+// clockMinutes reads "15:04" as minutes after midnight; "24:00" ends a
+// working day at midnight.
+func clockMinutes(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%w: время %q должно быть в формате ЧЧ:ММ", errInvalidEvent, s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// SlotParticipant is a user a meeting is sought for, with the zone and
+// hours their working day is in.
+type SlotParticipant struct {
+	UserID       int
+	Location     *time.Location
+	WorkingHours WorkingHours
+}
+
+// FindSlots proposes up to limit times of length d in [from, to) when
+// every participant is within their working hours and free, earliest
+// first. Starts are step apart counted from midnight in loc.
+func (c *Calendar) FindSlots(participants []SlotParticipant, from, to time.Time, d, step time.Duration, loc *time.Location, limit int) ([]Interval, error) {
+	free := []Interval{{from, to}}
+	for _, p := range participants {
+		windows, err := p.WorkingHours.windows(from, to, p.Location)
+		if err != nil {
+			return nil, err
+		}
+		free = intersectIntervals(free, subtractIntervals(windows, c.Busy(p.UserID, from, to)))
+	}
+
+	slots := []Interval{}
+	for _, iv := range free {
+		start := alignUp(iv.Start.In(loc), step)
+		for ; !start.Add(d).After(iv.End); start = start.Add(step) {
+			if len(slots) == limit {
+				return slots, nil
+			}
+			slots = append(slots, Interval{start, start.Add(d)})
+		}
+	}
+	return slots, nil
+}
+
+// alignUp rounds t up to a multiple of step after its local midnight.
+func alignUp(t time.Time, step time.Duration) time.Time {
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	since := t.Sub(midnight)
+	if rem := since % step; rem != 0 {
+		return t.Add(step - rem)
+	}
+	return t
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIntervalArithmetic(t *testing.T) {
+	at := func(h int) time.Time { return time.Date(2024, 3, 4, h, 0, 0, 0, time.UTC) }
+	iv := func(a, b int) Interval { return Interval{at(a), at(b)} }
+
+	merged := mergeIntervals([]Interval{iv(12, 13), iv(9, 10), iv(10, 11), iv(9, 9)})
+	if len(merged) != 2 || merged[0] != iv(9, 11) || merged[1] != iv(12, 13) {
+		t.Errorf("merge = %v", merged)
+	}
+	free := subtractIntervals([]Interval{iv(8, 18)}, []Interval{iv(7, 9), iv(10, 11), iv(17, 19)})
+	if len(free) != 2 || free[0] != iv(9, 10) || free[1] != iv(11, 17) {
+		t.Errorf("subtract = %v", free)
+	}
+	both := intersectIntervals([]Interval{iv(9, 10), iv(11, 17)}, []Interval{iv(8, 12), iv(16, 20)})
+	if len(both) != 3 || both[0] != iv(9, 10) || both[1] != iv(11, 12) || both[2] != iv(16, 17) {
+		t.Errorf("intersect = %v", both)
+	}
+}
+
+func TestFreeBusyAndFindSlots(t *testing.T) {
+	c := NewCalendar()
+	c.SetUserTimeZone(1, "Europe/Berlin")
+	c.SetUserTimeZone(2, "America/New_York")
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	at := func(h, m int) time.Time { return time.Date(2024, 3, 4, h, m, 0, 0, berlin) }
+	c.Create(Event{UserID: 1, Text: "Focus", Start: at(15, 0), End: at(16, 0)})
+	sync, _ := c.Create(Event{UserID: 3, Text: "Sync", Start: at(16, 0), End: at(16, 30), Attendees: []Attendee{{UserID: 2}}})
+	c.Create(Event{UserID: 3, Text: "Optional", Start: at(17, 0), End: at(18, 0), Attendees: []Attendee{{UserID: 2}}})
+	c.Respond(sync.ID, 2, statusTentative)
+	h := makeHandlers(c)
+
+	rec := doRequest(t, h, http.MethodGet, "/freebusy?users=1,2&from=2024-03-04&to=2024-03-04&tz=Europe/Berlin", "")
+	var fb freeBusyList
+	json.Unmarshal(rec.Body.Bytes(), &fb)
+	if rec.Code != http.StatusOK || len(fb.Users) != 2 {
+		t.Fatalf("freebusy: status %d, body %s", rec.Code, rec.Body)
+	}
+	if b := fb.Users[0].Busy; len(b) != 1 || !b[0].Start.Equal(at(15, 0)) || !b[0].End.Equal(at(16, 0)) {
+		t.Errorf("busy of 1 = %v", b)
+	}
+	// The unanswered invitation doesn't count.
+	if b := fb.Users[1].Busy; len(b) != 1 || !b[0].Start.Equal(at(16, 0)) || !b[0].End.Equal(at(16, 30)) {
+		t.Errorf("busy of 2 = %v", b)
+	}
+	if b, _ := json.Marshal(fb.Users[0].Busy); string(b) != `[{"start":"2024-03-04T15:00:00+01:00","end":"2024-03-04T16:00:00+01:00"}]` {
+		t.Errorf("busy of 1 in JSON = %s", b)
+	}
+
+	// Working hours overlap from 15:00 to 18:00 in Berlin, 9:00 to 12:00
+	// in New York; the first half hour both are free starts at 16:30.
+	rec = doRequest(t, h, http.MethodPost, "/find_slots", `{"participants":[{"user_id":1},{"user_id":2}],"from":"2024-03-04","to":"2024-03-08","duration":"30m","limit":3}`)
+	var slots slotList
+	json.Unmarshal(rec.Body.Bytes(), &slots)
+	if rec.Code != http.StatusOK || len(slots.Slots) != 3 {
+		t.Fatalf("find_slots: status %d, body %s", rec.Code, rec.Body)
+	}
+	for i, want := range []time.Time{at(16, 30), at(16, 45), at(17, 0)} {
+		s := slots.Slots[i]
+		if _, offset := s.Start.Zone(); !s.Start.Equal(want) || s.End.Sub(s.Start) != 30*time.Minute || offset != 3600 {
+			t.Errorf("slot %d = %v, want %v", i, s, want)
+		}
+	}
+
+	rec = doRequest(t, h, http.MethodPost, "/find_slots", `{"participants":[{"user_id":1,"working_hours":{"start":"09:00","end":"10:00","days":["SA"]}}],"from":"2024-03-04","to":"2024-03-10","duration":"1h"}`)
+	json.Unmarshal(rec.Body.Bytes(), &slots)
+	if len(slots.Slots) != 1 || !slots.Slots[0].Start.Equal(time.Date(2024, 3, 9, 9, 0, 0, 0, berlin)) {
+		t.Errorf("Saturday slots = %v", slots.Slots)
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/find_slots", `{"participants":[{"user_id":1}],"from":"2024-03-04","to":"2024-03-08","duration":"soon"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad duration: status %d", rec.Code)
+	}
+}
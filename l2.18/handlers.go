@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -17,77 +19,319 @@ func writeJSONError(w http.ResponseWriter, msg string, status int) {
 	writeJSON(w, status, map[string]string{"error": msg})
 }
 
-func makeHandlers(c *Calendar) {
-	http.HandleFunc("/create_event", logRequest(func(w http.ResponseWriter, r *http.Request) {
-		var e Event
-		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
-			writeJSONError(w, "Некорректные данные", http.StatusBadRequest)
-			return
-		}
-		if err := c.Create(e); err != nil {
-			writeJSONError(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		writeJSON(w, http.StatusOK, map[string]string{"result": "Событие создано"})
-	}))
-
-	http.HandleFunc("/update_event", logRequest(func(w http.ResponseWriter, r *http.Request) {
-		var e Event
-		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
-			writeJSONError(w, "Некорректные данные", http.StatusBadRequest)
-			return
-		}
-		if err := c.Update(e); err != nil {
-			writeJSONError(w, err.Error(), http.StatusServiceUnavailable)
-			return
-		}
-		writeJSON(w, http.StatusOK, map[string]string{"result": "Событие обновлено"})
-	}))
-
-	http.HandleFunc("/delete_event", logRequest(func(w http.ResponseWriter, r *http.Request) {
-		var e Event
-		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
-			writeJSONError(w, "Некорректные данные", http.StatusBadRequest)
-			return
-		}
-		if err := c.Delete(e); err != nil {
-			writeJSONError(w, err.Error(), http.StatusServiceUnavailable)
-			return
-		}
-		writeJSON(w, http.StatusOK, map[string]string{"result": "Событие удалено"})
-	}))
-
-	http.HandleFunc("/events_for_day", logRequest(func(w http.ResponseWriter, r *http.Request) {
-		date := r.URL.Query().Get("date")
-		if date == "" {
-			writeJSONError(w, "Не указана дата", http.StatusBadRequest)
-			return
-		}
-		evts, _ := c.EventsForDay(date)
-		writeJSON(w, http.StatusOK, evts)
-	}))
-
-	http.HandleFunc("/events_for_week", logRequest(func(w http.ResponseWriter, r *http.Request) {
-		date := r.URL.Query().Get("date")
-		start, err := time.Parse("2006-01-02", date)
-		if err != nil {
-			writeJSONError(w, "Некорректная дата", http.StatusBadRequest)
-			return
-		}
-		evts := c.EventsForWeek(start)
-		writeJSON(w, http.StatusOK, evts)
-	}))
-
-	http.HandleFunc("/events_for_month", logRequest(func(w http.ResponseWriter, r *http.Request) {
-		monthYear := r.URL.Query().Get("month_year")
-		parts := []rune(monthYear)
-		if len(parts) != 7 || parts[4] != '-' {
-			writeJSONError(w, "Некорректный формат, используйте YYYY-MM", http.StatusBadRequest)
-			return
-		}
-		year, _ := strconv.Atoi(string(parts[:4]))
-		month, _ := strconv.Atoi(string(parts[5:]))
-		evts := c.EventsForMonth(year, time.Month(month))
-		writeJSON(w, http.StatusOK, evts)
-	}))
+// writeCalendarError maps Calendar errors onto HTTP statuses. A rejected
+// overlap lists the conflicting events.
+func writeCalendarError(w http.ResponseWriter, err error) {
+	var overlap *OverlapError
+	if errors.As(err, &overlap) {
+		writeJSON(w, http.StatusConflict, map[string]any{"error": err.Error(), "conflicts": overlap.Conflicts})
+		return
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errInvalidEvent):
+		status = http.StatusBadRequest
+	case errors.Is(err, errNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errConflict):
+		status = http.StatusConflict
+	case errors.Is(err, errForbidden):
+		status = http.StatusForbidden
+	}
+	writeJSONError(w, err.Error(), status)
+}
+
+// queryZone reads the tz query parameter, falling back to def.
+func queryZone(r *http.Request, def *time.Location) (*time.Location, error) {
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		return def, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("неизвестный часовой пояс %q", tz)
+	}
+	return loc, nil
+}
+
+// forced reports whether r asks to store an event despite a reject
+// overlap policy.
+func forced(r *http.Request) bool {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	return force
+}
+
+// createEvent creates e, by force if r asks so, and returns it with the
+// events it overlaps under its overlap policy.
+func createEvent(c *Calendar, r *http.Request, e Event) (Event, []Event, error) {
+	create := c.Create
+	if forced(r) {
+		create = c.ForceCreate
+	}
+	e, err := create(e)
+	if err != nil {
+		return Event{}, nil, err
+	}
+	return e, c.Conflicts(e), nil
+}
+
+// updateEvent is createEvent for Update.
+func updateEvent(c *Calendar, r *http.Request, e Event) (Event, []Event, error) {
+	update := c.Update
+	if forced(r) {
+		update = c.ForceUpdate
+	}
+	e, err := update(e)
+	if err != nil {
+		return Event{}, nil, err
+	}
+	return e, c.Conflicts(e), nil
+}
+
+// bodyUser makes the caller the owner of the event in a legacy request
+// that names none. A user_id naming someone else is refused, rather than
+// quietly replaced, unless the caller may write to the event's calendar.
+func bodyUser(c *Calendar, r *http.Request, e *Event) error {
+	caller, ok := callerID(r)
+	if !ok {
+		return nil
+	}
+	if e.UserID == 0 {
+		e.UserID = caller
+	}
+	return authorizeEvent(c, r, *e, true)
+}
+
+// checkOwner returns errForbidden unless the caller may change event id.
+func checkOwner(c *Calendar, r *http.Request, id string) error {
+	e, err := c.Get(id)
+	if err != nil {
+		return err
+	}
+	return authorizeEvent(c, r, e, true)
+}
+
+// rangeEvents answers the legacy range queries: every user's events
+// without authentication, the caller's agenda with it.
+func rangeEvents(c *Calendar, r *http.Request, from, to time.Time) []Event {
+	if caller, ok := callerID(r); ok {
+		return c.Agenda(caller, from, to)
+	}
+	return c.EventsBetween(0, from, to)
+}
+
+var forceParam = queryParam{name: "force", description: "true, чтобы сохранить событие вопреки политике пересечений reject"}
+
+func legacyNotAllowed(w http.ResponseWriter, allow string) {
+	writeJSONError(w, "Метод не поддерживается, используйте "+allow, http.StatusMethodNotAllowed)
+}
+
+// makeHandlers builds the HTTP API without authentication.
+func makeHandlers(c *Calendar) http.Handler {
+	return makeHandlersWithAuth(c, nil)
+}
+
+// makeHandlersWithAuth builds the HTTP API: the original flat endpoints,
+// the REST API under /v2 with its OpenAPI description and CalDAV. With a
+// nil auth every caller may act for any user.
+func makeHandlersWithAuth(c *Calendar, auth *Authenticator) http.Handler {
+	rt := newRouter()
+	rt.handle(route{
+		method:   http.MethodPost,
+		pattern:  "/create_event",
+		summary:  "Создать событие (устаревший API)",
+		query:    []queryParam{forceParam},
+		body:     Event{},
+		response: map[string]any{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			var e Event
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				writeJSONError(w, "Некорректные данные", http.StatusBadRequest)
+				return
+			}
+			if err := bodyUser(c, r, &e); err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			created, conflicts, err := createEvent(c, r, e)
+			if err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			resp := map[string]any{"result": "Событие создано", "id": created.ID, "event": created}
+			if len(conflicts) > 0 {
+				resp["conflicts"] = conflicts
+			}
+			writeJSON(w, http.StatusOK, resp)
+		},
+	}, legacyNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPost,
+		pattern:  "/update_event",
+		summary:  "Обновить событие по id (устаревший API)",
+		query:    []queryParam{forceParam},
+		body:     Event{},
+		response: map[string]any{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			var e Event
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				writeJSONError(w, "Некорректные данные", http.StatusBadRequest)
+				return
+			}
+			if e.ID == "" {
+				writeJSONError(w, "Не указан id события", http.StatusBadRequest)
+				return
+			}
+			if err := checkOwner(c, r, e.ID); err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			if err := bodyUser(c, r, &e); err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			updated, conflicts, err := updateEvent(c, r, e)
+			if err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			resp := map[string]any{"result": "Событие обновлено", "event": updated}
+			if len(conflicts) > 0 {
+				resp["conflicts"] = conflicts
+			}
+			writeJSON(w, http.StatusOK, resp)
+		},
+	}, legacyNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPost,
+		pattern:  "/delete_event",
+		summary:  "Удалить событие по id (устаревший API)",
+		body:     Event{},
+		response: map[string]string{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			var e Event
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				writeJSONError(w, "Некорректные данные", http.StatusBadRequest)
+				return
+			}
+			if e.ID == "" {
+				writeJSONError(w, "Не указан id события", http.StatusBadRequest)
+				return
+			}
+			if err := checkOwner(c, r, e.ID); err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			if err := c.Delete(e.ID); err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"result": "Событие удалено"})
+		},
+	}, legacyNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodGet,
+		pattern:  "/events_for_day",
+		summary:  "События за день (устаревший API)",
+		query:    []queryParam{{name: "date", description: "YYYY-MM-DD", required: true}, {name: "tz", description: "часовой пояс IANA, по умолчанию UTC"}},
+		response: []Event{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			date := r.URL.Query().Get("date")
+			if date == "" {
+				writeJSONError(w, "Не указана дата", http.StatusBadRequest)
+				return
+			}
+			loc, err := queryZone(r, time.UTC)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			day, err := time.ParseInLocation("2006-01-02", date, loc)
+			if err != nil {
+				writeJSONError(w, "Некорректная дата", http.StatusBadRequest)
+				return
+			}
+			from, to := dayWindow(day, 1, loc)
+			writeJSON(w, http.StatusOK, rangeEvents(c, r, from, to))
+		},
+	}, legacyNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodGet,
+		pattern:  "/events_for_week",
+		summary:  "События за неделю (устаревший API)",
+		query:    []queryParam{{name: "date", description: "первый день недели, YYYY-MM-DD", required: true}, {name: "tz", description: "часовой пояс IANA, по умолчанию UTC"}},
+		response: []Event{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			loc, err := queryZone(r, time.UTC)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			date := r.URL.Query().Get("date")
+			start, err := time.ParseInLocation("2006-01-02", date, loc)
+			if err != nil {
+				writeJSONError(w, "Некорректная дата", http.StatusBadRequest)
+				return
+			}
+			from, to := dayWindow(start, 7, loc)
+			writeJSON(w, http.StatusOK, rangeEvents(c, r, from, to))
+		},
+	}, legacyNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodGet,
+		pattern:  "/events_for_month",
+		summary:  "События за месяц (устаревший API)",
+		query:    []queryParam{{name: "month_year", description: "YYYY-MM", required: true}, {name: "tz", description: "часовой пояс IANA, по умолчанию UTC"}},
+		response: []Event{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			monthYear := r.URL.Query().Get("month_year")
+			parts := []rune(monthYear)
+			if len(parts) != 7 || parts[4] != '-' {
+				writeJSONError(w, "Некорректный формат, используйте YYYY-MM", http.StatusBadRequest)
+				return
+			}
+			year, _ := strconv.Atoi(string(parts[:4]))
+			month, _ := strconv.Atoi(string(parts[5:]))
+			loc, err := queryZone(r, time.UTC)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, loc)
+			writeJSON(w, http.StatusOK, rangeEvents(c, r, from, from.AddDate(0, 1, 0)))
+		},
+	}, legacyNotAllowed)
+
+	registerV2(rt, c)
+	registerICal(rt, c)
+	registerSharing(rt, c)
+	registerFreeBusy(rt, c)
+	registerSearch(rt, c)
+	registerFeed(rt, c)
+
+	// CalDAV has its own methods and isn't described by the OpenAPI
+	// document.
+	dav := &davHandler{c: c}
+	rt.mux.Handle("/dav/", logRequest(dav.ServeHTTP))
+	rt.mux.Handle("/.well-known/caldav", http.RedirectHandler("/dav/", http.StatusMovedPermanently))
+
+	// Built before /openapi.json is registered, so the document doesn't
+	// describe itself.
+	spec := rt.openAPI()
+	rt.handle(route{
+		method:  http.MethodGet,
+		pattern: "/openapi.json",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, spec)
+		},
+	}, legacyNotAllowed)
+	if auth == nil {
+		return rt
+	}
+	return auth.middleware(rt)
 }
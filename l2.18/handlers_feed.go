@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// feedHeartbeat is how often an idle stream is pinged, so that proxies
+// keep it open and gone clients are noticed.
+const feedHeartbeat = 30 * time.Second
+
+// feedSince is the change a stream continues after: Last-Event-ID, which
+// EventSource sends when it reconnects, or else the since parameter.
+// Without either the stream starts from now.
+func feedSince(r *http.Request) (int64, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("since")
+	}
+	if s == "" {
+		return -1, nil
+	}
+	since, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || since < 0 {
+		return 0, fmt.Errorf("некорректный номер изменения %q", s)
+	}
+	return since, nil
+}
+
+// registerFeed adds the stream of changes to a user's events, pushed as
+// they happen instead of being polled for. The same path serves
+// Server-Sent Events and, to requests asking to upgrade, WebSocket with
+// one JSON Change per text message. Changes are numbered per owner, so
+// the stream covers the user's own calendars.
+func registerFeed(rt *router, c *Calendar) {
+	rt.handle(route{
+		method:  http.MethodGet,
+		pattern: "/v2/users/{id}/changes",
+		summary: "Поток изменений событий пользователя: Server-Sent Events или WebSocket",
+		query: []queryParam{
+			{name: "since", description: "номер изменения, после которого продолжить; для SSE его передаёт Last-Event-ID"},
+			{name: "token", description: "API-ключ или JWT для клиентов, которые не могут задать заголовки"},
+		},
+		response: Change{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			since, err := feedSince(r)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			if !isWebSocket(r) {
+				serveEventStream(c, w, r, userID, since)
+				return
+			}
+			if err := checkWebSocket(r); err != nil {
+				w.Header().Set("Sec-WebSocket-Version", "13")
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			serveWebSocketFeed(c, w, r, userID, since)
+		},
+	}, apiNotAllowed)
+}
+
+// serveEventStream sends changes as Server-Sent Events named by their
+// type, with the change number as event ID.
+func serveEventStream(c *Calendar, w http.ResponseWriter, r *http.Request, userID int, since int64) {
+	backlog, changes, cancel := c.Subscribe(userID, since)
+	defer cancel()
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(change Change) error {
+		data, _ := json.Marshal(change)
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Type, data)
+		return err
+	}
+	for _, change := range backlog {
+		if send(change) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				// Dropped or shut down: the client reconnects and resumes.
+				return
+			}
+			err = send(change)
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": ping\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serveWebSocketFeed sends changes as WebSocket text messages. A client
+// resuming passes the seq of the last change it got as since.
+func serveWebSocketFeed(c *Calendar, w http.ResponseWriter, r *http.Request, userID int, since int64) {
+	backlog, changes, cancel := c.Subscribe(userID, since)
+	defer cancel()
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		logger.Printf("websocket пользователя %d: %v", userID, err)
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- ws.readLoop() }()
+
+	send := func(change Change) error {
+		data, _ := json.Marshal(change)
+		return ws.writeFrame(wsText, data)
+	}
+	for _, change := range backlog {
+		if send(change) != nil {
+			ws.conn.Close()
+			return
+		}
+	}
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case err = <-done:
+			if !errors.Is(err, errWSClosed) {
+				logger.Printf("websocket пользователя %d: %v", userID, err)
+			}
+			ws.conn.Close()
+			return
+		case change, ok := <-changes:
+			if !ok {
+				// 1001, going away: the client reconnects and resumes.
+				ws.close(1001)
+				return
+			}
+			err = send(change)
+		case <-heartbeat.C:
+			err = ws.writeFrame(wsPing, nil)
+		}
+		if err != nil {
+			ws.conn.Close()
+			return
+		}
+	}
+}
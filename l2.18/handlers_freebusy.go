@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxFreeBusyUsers bounds the users of one free/busy or slot query.
+	maxFreeBusyUsers = 50
+	maxSlots         = 100
+	defaultSlots     = 10
+	defaultSlotStep  = 15 * time.Minute
+)
+
+type userBusy struct {
+	UserID int        `json:"user_id"`
+	Busy   []Interval `json:"busy"`
+}
+
+type freeBusyList struct {
+	From  time.Time  `json:"from"`
+	To    time.Time  `json:"to"`
+	Users []userBusy `json:"users"`
+}
+
+// slotRequest is the body of /find_slots. The days from and to are in
+// TimeZone, by default the first participant's. Working hours apply in
+// each participant's zone, by default their own setting.
+type slotRequest struct {
+	Participants []slotParticipantInput `json:"participants"`
+	From         string                 `json:"from"`
+	To           string                 `json:"to"`
+	TimeZone     string                 `json:"time_zone,omitempty"`
+	Duration     string                 `json:"duration"`
+	Step         string                 `json:"step,omitempty"`
+	WorkingHours *WorkingHours          `json:"working_hours,omitempty"`
+	Limit        int                    `json:"limit,omitempty"`
+}
+
+type slotParticipantInput struct {
+	UserID       int           `json:"user_id"`
+	TimeZone     string        `json:"time_zone,omitempty"`
+	WorkingHours *WorkingHours `json:"working_hours,omitempty"`
+}
+
+type slotList struct {
+	Slots []Interval `json:"slots"`
+}
+
+// parseUserIDs reads a comma separated list of user IDs.
+func parseUserIDs(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("некорректный id пользователя %q", part)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > maxFreeBusyUsers {
+		return nil, fmt.Errorf("не больше %d пользователей", maxFreeBusyUsers)
+	}
+	return ids, nil
+}
+
+// positiveDuration parses s, falling back to def when it is empty.
+func positiveDuration(name, s string, def time.Duration) (time.Duration, error) {
+	if s == "" && def > 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("некорректное значение %s %q", name, s)
+	}
+	return d, nil
+}
+
+// registerFreeBusy adds the free/busy lookup and the meeting slot finder.
+// They show when users are busy, never what they are busy with, so any
+// caller may ask about anyone.
+func registerFreeBusy(rt *router, c *Calendar) {
+	rt.handle(route{
+		method:  http.MethodGet,
+		pattern: "/freebusy",
+		summary: "Занятое время пользователей за период",
+		query: []queryParam{
+			{name: "users", description: "id пользователей через запятую", required: true},
+			{name: "from", description: "первый день, YYYY-MM-DD", required: true},
+			{name: "to", description: "последний день включительно, YYYY-MM-DD", required: true},
+			{name: "tz", description: "часовой пояс IANA, по умолчанию UTC"},
+		},
+		response: freeBusyList{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userIDs, err := parseUserIDs(r.URL.Query().Get("users"))
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			loc, err := queryZone(r, time.UTC)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			from, to, err := parseRange(r, loc)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			list := freeBusyList{From: from, To: to, Users: []userBusy{}}
+			for _, userID := range userIDs {
+				busy := c.Busy(userID, from, to)
+				for i := range busy {
+					busy[i].Start, busy[i].End = busy[i].Start.In(loc), busy[i].End.In(loc)
+				}
+				list.Users = append(list.Users, userBusy{UserID: userID, Busy: busy})
+			}
+			writeJSON(w, http.StatusOK, list)
+		},
+	}, legacyNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPost,
+		pattern:  "/find_slots",
+		summary:  "Подобрать время встречи, свободное у всех участников",
+		body:     slotRequest{},
+		response: slotList{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			var in slotRequest
+			if err := decodeStrict(r, &in); err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(in.Participants) == 0 || len(in.Participants) > maxFreeBusyUsers {
+				writeJSONError(w, fmt.Sprintf("нужно от 1 до %d участников", maxFreeBusyUsers), http.StatusBadRequest)
+				return
+			}
+			d, err := positiveDuration("duration", in.Duration, 0)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			step, err := positiveDuration("step", in.Step, defaultSlotStep)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limit := in.Limit
+			if limit <= 0 {
+				limit = defaultSlots
+			}
+			limit = min(limit, maxSlots)
+			hours := defaultWorkingHours
+			if in.WorkingHours != nil {
+				hours = *in.WorkingHours
+			}
+
+			participants := make([]SlotParticipant, 0, len(in.Participants))
+			for _, p := range in.Participants {
+				if p.UserID <= 0 {
+					writeJSONError(w, fmt.Sprintf("некорректный id пользователя %d", p.UserID), http.StatusBadRequest)
+					return
+				}
+				sp := SlotParticipant{UserID: p.UserID, Location: c.UserLocation(p.UserID), WorkingHours: hours}
+				if p.TimeZone != "" {
+					if sp.Location, err = loadZone(p.TimeZone); err != nil {
+						writeCalendarError(w, err)
+						return
+					}
+				}
+				if p.WorkingHours != nil {
+					sp.WorkingHours = *p.WorkingHours
+				}
+				participants = append(participants, sp)
+			}
+
+			loc := participants[0].Location
+			if in.TimeZone != "" {
+				if loc, err = loadZone(in.TimeZone); err != nil {
+					writeCalendarError(w, err)
+					return
+				}
+			}
+			from, to, err := parseDays(in.From, in.To, loc)
+			if err != nil {
+				writeJSONError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slots, err := c.FindSlots(participants, from, to, d, step, loc, limit)
+			if err != nil {
+				writeCalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, slotList{Slots: slots})
+		},
+	}, legacyNotAllowed)
+}
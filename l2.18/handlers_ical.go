@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// maxImportSize bounds an uploaded .ics file.
+const maxImportSize = 10 << 20
+
+// registerICal adds the iCalendar feed of each user. Its URL doesn't
+// change, so calendar apps can subscribe to it; POST to the same URL
+// imports a file.
+func registerICal(rt *router, c *Calendar) {
+	const feed = "/v2/users/{id}/calendar.ics"
+
+	rt.handle(route{
+		method:  http.MethodGet,
+		pattern: feed,
+		summary: "Календарь пользователя в формате iCalendar (адрес для подписки)",
+		query: []queryParam{
+			{name: "from", description: "первый день, YYYY-MM-DD; без from и to выгружаются все события"},
+			{name: "to", description: "последний день включительно, YYYY-MM-DD"},
+			{name: "tz", description: "часовой пояс IANA для from и to, по умолчанию пояс пользователя"},
+		},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			events := c.UserEvents(userID)
+			if q := r.URL.Query(); q.Has("from") || q.Has("to") {
+				loc, err := queryZone(r, c.UserLocation(userID))
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+					return
+				}
+				from, to, err := parseRange(r, loc)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+					return
+				}
+				events = seriesOf(c, c.EventsBetween(userID, from, to))
+			}
+
+			var buf bytes.Buffer
+			if err := writeICS(&buf, fmt.Sprintf("Календарь пользователя %d", userID), events); err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+			w.Header().Set("Content-Disposition", `inline; filename="calendar.ics"`)
+			w.Write(buf.Bytes())
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPost,
+		pattern:  feed,
+		summary:  "Импортировать файл .ics (тело text/calendar)",
+		response: importReport{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			events, issues, err := decodeICS(http.MaxBytesReader(w, r.Body, maxImportSize), c.UserLocation(userID))
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", "некорректный файл iCalendar: "+err.Error())
+				return
+			}
+			report := importReport{Skipped: issues}
+			if report.Skipped == nil {
+				report.Skipped = []importIssue{}
+			}
+			importEvents(c, userID, events, &report)
+			writeJSON(w, http.StatusOK, report)
+		},
+	}, apiNotAllowed)
+}
+
+// seriesOf replaces occurrences in events by the series they belong to,
+// each series once.
+func seriesOf(c *Calendar, events []Event) []Event {
+	seen := make(map[string]bool)
+	var result []Event
+	for _, e := range events {
+		if seen[e.ID] {
+			continue
+		}
+		seen[e.ID] = true
+		if e.RecurrenceID != nil {
+			var err error
+			if e, err = c.Get(e.ID); err != nil {
+				continue
+			}
+		}
+		result = append(result, e)
+	}
+	return result
+}
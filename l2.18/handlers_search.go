@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+type searchResult struct {
+	Events []Event `json:"events"`
+	// NextCursor continues the results, empty on their last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// searchCursor is the position a page ended at, base64url-encoded JSON so
+// that clients treat it as opaque.
+type searchCursor struct {
+	Start time.Time `json:"start"`
+	ID    string    `json:"id"`
+}
+
+func encodeCursor(e Event) string {
+	data, _ := json.Marshal(searchCursor{Start: e.Start, ID: e.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*SearchPosition, error) {
+	var cur searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &cur)
+	}
+	if err != nil || cur.ID == "" {
+		return nil, errors.New("некорректный cursor")
+	}
+	return &SearchPosition{Start: cur.Start, ID: cur.ID}, nil
+}
+
+// parseSearch reads the query of /events into q.
+func parseSearch(r *http.Request) (q SearchQuery, err error) {
+	v := r.URL.Query()
+	q.Text = v.Get("q")
+	if tags := v.Get("tags"); tags != "" {
+		q.Tags = strings.Split(tags, ",")
+	}
+	if s := v.Get("user"); s != "" {
+		if q.UserID, err = strconv.Atoi(s); err != nil || q.UserID <= 0 {
+			return q, fmt.Errorf("некорректный id пользователя %q", s)
+		}
+	}
+	loc, err := queryZone(r, time.UTC)
+	if err != nil {
+		return q, err
+	}
+	if s := v.Get("from"); s != "" {
+		day, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return q, errors.New("параметр from должен быть в формате YYYY-MM-DD")
+		}
+		q.From, _ = dayWindow(day, 0, loc)
+	}
+	if s := v.Get("to"); s != "" {
+		day, err := time.ParseInLocation("2006-01-02", s, loc)
+		if err != nil {
+			return q, errors.New("параметр to должен быть в формате YYYY-MM-DD")
+		}
+		_, q.To = dayWindow(day, 1, loc)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return q, errors.New("to раньше from")
+	}
+	switch v.Get("sort") {
+	case "", "start":
+	case "-start":
+		q.Descending = true
+	default:
+		return q, errors.New("параметр sort должен быть start или -start")
+	}
+	q.Limit = defaultSearchLimit
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("некорректный limit %q", s)
+		}
+		q.Limit = min(q.Limit, maxSearchLimit)
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.After, err = decodeCursor(s); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// registerSearch adds the search over all events, page by page. An
+// authenticated caller finds only what is in their agenda. Though outside
+// /v2 it answers errors as the v2 API does.
+func registerSearch(rt *router, c *Calendar) {
+	rt.handle(route{
+		method:  http.MethodGet,
+		pattern: "/events",
+		summary: "Поиск событий по тексту, тегам, владельцу и датам",
+		query: []queryParam{
+			{name: "q", description: "слова из текста события, последнее можно не дописывать"},
+			{name: "tags", description: "теги через запятую, нужны все"},
+			{name: "user", description: "id владельца событий"},
+			{name: "from", description: "первый день, YYYY-MM-DD"},
+			{name: "to", description: "последний день включительно, YYYY-MM-DD"},
+			{name: "tz", description: "часовой пояс IANA для from и to, по умолчанию UTC"},
+			{name: "sort", description: "start (по умолчанию) или -start, от поздних к ранним"},
+			{name: "limit", description: fmt.Sprintf("событий на странице, по умолчанию %d, не больше %d", defaultSearchLimit, maxSearchLimit)},
+			{name: "cursor", description: "next_cursor предыдущей страницы"},
+		},
+		response: searchResult{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			q, err := parseSearch(r)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			if caller, ok := callerID(r); ok {
+				q.Viewer = caller
+			}
+			events, more := c.Search(q)
+			result := searchResult{Events: events}
+			if more {
+				result.NextCursor = encodeCursor(events[len(events)-1])
+			}
+			writeJSON(w, http.StatusOK, result)
+		},
+	}, apiNotAllowed)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type calendarInput struct {
+	Name          string `json:"name"`
+	OverlapPolicy string `json:"overlap_policy,omitempty"`
+}
+
+type shareInput struct {
+	Access string `json:"access"`
+}
+
+type rsvpInput struct {
+	Status string `json:"status"`
+}
+
+// calendarList lists a user's own calendars and those shared with them.
+type calendarList struct {
+	Calendars []CalendarInfo `json:"calendars"`
+	Shared    []CalendarInfo `json:"shared"`
+}
+
+// registerSharing adds the named calendars of each user, sharing them
+// with other users and answering invitations. Only the user themselves
+// may manage their calendars and answer for them.
+func registerSharing(rt *router, c *Calendar) {
+	const (
+		calendars = "/v2/users/{id}/calendars"
+		calendar  = "/v2/users/{id}/calendars/{calendarID}"
+		share     = calendar + "/shares/{userID}"
+	)
+
+	rt.handle(route{
+		method:   http.MethodGet,
+		pattern:  calendars,
+		summary:  "Календари пользователя и доступные ему чужие",
+		response: calendarList{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			own, shared := c.Calendars(userID)
+			writeJSON(w, http.StatusOK, calendarList{Calendars: own, Shared: shared})
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPost,
+		pattern:  calendars,
+		summary:  "Создать календарь",
+		body:     calendarInput{},
+		response: CalendarInfo{},
+		status:   http.StatusCreated,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			var in calendarInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			cal, err := c.CreateCalendar(userID, in.Name, in.OverlapPolicy)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			w.Header().Set("Location", fmt.Sprintf("/v2/users/%d/calendars/%s", userID, cal.ID))
+			writeJSON(w, http.StatusCreated, cal)
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPut,
+		pattern:  calendar,
+		summary:  "Переименовать календарь и задать политику пересечений",
+		body:     calendarInput{},
+		response: CalendarInfo{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			var in calendarInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			cal, err := c.UpdateCalendar(userID, r.PathValue("calendarID"), in.Name, in.OverlapPolicy)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, cal)
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:  http.MethodDelete,
+		pattern: calendar,
+		summary: "Удалить пустой календарь",
+		status:  http.StatusNoContent,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			if err := c.DeleteCalendar(userID, r.PathValue("calendarID")); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPut,
+		pattern:  share,
+		summary:  "Открыть календарь другому пользователю на чтение (read) или запись (write)",
+		body:     shareInput{},
+		response: CalendarInfo{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			var in shareInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			if in.Access == "" {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", "не указан доступ")
+				return
+			}
+			grantee, _ := strconv.Atoi(r.PathValue("userID"))
+			cal, err := c.ShareCalendar(userID, r.PathValue("calendarID"), grantee, in.Access)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, cal)
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:  http.MethodDelete,
+		pattern: share,
+		summary: "Закрыть пользователю доступ к календарю",
+		status:  http.StatusNoContent,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			grantee, _ := strconv.Atoi(r.PathValue("userID"))
+			if _, err := c.ShareCalendar(userID, r.PathValue("calendarID"), grantee, ""); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	}, apiNotAllowed)
+
+	const (
+		invitations = "/v2/users/{id}/invitations"
+		invitation  = invitations + "/{eventID}"
+	)
+
+	rt.handle(route{
+		method:  http.MethodGet,
+		pattern: invitations,
+		summary: "События, на которые приглашён пользователь",
+		query: []queryParam{
+			{name: "status", description: "только с этим ответом: needs-action, accepted, declined или tentative"},
+		},
+		response: eventList{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			status := r.URL.Query().Get("status")
+			if status != "" && !attendeeStatuses[status] {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("неизвестный ответ %q", status))
+				return
+			}
+			writeJSON(w, http.StatusOK, eventList{Events: c.Invitations(userID, status)})
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPut,
+		pattern:  invitation,
+		summary:  "Ответить на приглашение",
+		body:     rsvpInput{},
+		response: Event{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			var in rsvpInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			e, err := c.Respond(r.PathValue("eventID"), userID, in.Status)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, e)
+		},
+	}, apiNotAllowed)
+}
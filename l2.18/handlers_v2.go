@@ -0,0 +1,608 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRangeDays bounds range queries so a single request can't walk years
+// of empty days.
+const maxRangeDays = 366
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Conflicts are the events an event rejected for overlapping them
+	// overlaps.
+	Conflicts []Event `json:"conflicts,omitempty"`
+}
+
+// apiErrorBody is the envelope of every /v2 error response.
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+// eventInput is the body of POST and PUT. The owner and ID come from the
+// path. Without end or duration a timed event lasts an hour and an
+// all-day event one day.
+type eventInput struct {
+	Start      time.Time   `json:"start"`
+	End        time.Time   `json:"end,omitempty"`
+	Duration   string      `json:"duration,omitempty"`
+	AllDay     bool        `json:"all_day,omitempty"`
+	TimeZone   string      `json:"time_zone,omitempty"`
+	Text       string      `json:"event"`
+	RRule      string      `json:"rrule,omitempty"`
+	ExDates    []time.Time `json:"exdates,omitempty"`
+	CalendarID string      `json:"calendar_id,omitempty"`
+	Attendees  []int       `json:"attendees,omitempty"`
+	Reminders  []Reminder  `json:"reminders,omitempty"`
+	Tags       []string    `json:"tags,omitempty"`
+	Version    int         `json:"version,omitempty"`
+}
+
+// apply keeps the overrides of a series; those that no longer match an
+// occurrence are dropped by the calendar.
+func (in eventInput) apply(e *Event) error {
+	e.Start, e.End, e.AllDay, e.TimeZone, e.Text, e.Version = in.Start, in.End, in.AllDay, in.TimeZone, in.Text, in.Version
+	e.RRule, e.ExDates = in.RRule, in.ExDates
+	e.CalendarID, e.Attendees = in.CalendarID, invite(e.Attendees, in.Attendees)
+	e.Reminders, e.Tags = in.Reminders, in.Tags
+	if e.RRule == "" {
+		e.Overrides = nil
+	}
+	return applyDuration(e, in.Duration)
+}
+
+// eventPatch is the body of PATCH; absent fields are left unchanged.
+// Moving the start without giving an end keeps the duration.
+type eventPatch struct {
+	Start      *time.Time   `json:"start"`
+	End        *time.Time   `json:"end"`
+	Duration   *string      `json:"duration"`
+	AllDay     *bool        `json:"all_day"`
+	TimeZone   *string      `json:"time_zone"`
+	Text       *string      `json:"event"`
+	RRule      *string      `json:"rrule"`
+	ExDates    *[]time.Time `json:"exdates"`
+	CalendarID *string      `json:"calendar_id"`
+	Attendees  *[]int       `json:"attendees"`
+	Reminders  *[]Reminder  `json:"reminders"`
+	Tags       *[]string    `json:"tags"`
+	Version    *int         `json:"version"`
+}
+
+func (p eventPatch) apply(e *Event) error {
+	length := e.End.Sub(e.Start)
+	if p.TimeZone != nil {
+		e.TimeZone = *p.TimeZone
+	}
+	if p.AllDay != nil && *p.AllDay != e.AllDay {
+		e.AllDay = *p.AllDay
+		if p.End == nil && p.Duration == nil {
+			e.End = time.Time{}
+		}
+	}
+	if p.Start != nil {
+		e.Start = *p.Start
+		switch {
+		case p.End != nil || p.Duration != nil || e.End.IsZero():
+		case e.AllDay:
+			// Whole days: hours would be off by one across DST changes.
+			e.End = e.Start.AddDate(0, 0, int((length+12*time.Hour)/(24*time.Hour)))
+		default:
+			e.End = e.Start.Add(length)
+		}
+	}
+	if p.End != nil {
+		e.End = *p.End
+	}
+	if p.Text != nil {
+		e.Text = *p.Text
+	}
+	if p.RRule != nil {
+		e.RRule = *p.RRule
+		if e.RRule == "" {
+			e.ExDates, e.Overrides = nil, nil
+		}
+	}
+	if p.ExDates != nil {
+		e.ExDates = *p.ExDates
+	}
+	if p.CalendarID != nil {
+		e.CalendarID = *p.CalendarID
+	}
+	if p.Attendees != nil {
+		e.Attendees = invite(e.Attendees, *p.Attendees)
+	}
+	if p.Reminders != nil {
+		e.Reminders = *p.Reminders
+	}
+	if p.Tags != nil {
+		e.Tags = *p.Tags
+	}
+	// Without a version the patch applies to whatever is current.
+	if p.Version != nil {
+		e.Version = *p.Version
+	}
+	if p.Duration != nil {
+		return applyDuration(e, *p.Duration)
+	}
+	return nil
+}
+
+// invite returns the attendees userIDs, keeping the answers of those
+// already among current.
+func invite(current []Attendee, userIDs []int) []Attendee {
+	var attendees []Attendee
+	for _, id := range userIDs {
+		a := Attendee{UserID: id}
+		if i := attendeeIndex(Event{Attendees: current}, id); i >= 0 {
+			a = current[i]
+		}
+		attendees = append(attendees, a)
+	}
+	return attendees
+}
+
+func applyDuration(e *Event, duration string) error {
+	if duration == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("%w: некорректная длительность %q", errInvalidEvent, duration)
+	}
+	e.End = e.Start.Add(d)
+	return nil
+}
+
+// occurrenceInput is the body of PUT on one occurrence of a series.
+// Absent fields keep the occurrence's own values; a new start without an
+// end keeps the duration.
+type occurrenceInput struct {
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+	Text  string    `json:"event,omitempty"`
+}
+
+type settingsBody struct {
+	TimeZone      string `json:"time_zone"`
+	OverlapPolicy string `json:"overlap_policy,omitempty"`
+}
+
+// settingsInput is the body of PUT settings; absent fields are left
+// unchanged, so clients that only know the time zone keep the policy.
+type settingsInput struct {
+	TimeZone      *string `json:"time_zone"`
+	OverlapPolicy *string `json:"overlap_policy"`
+}
+
+// eventResponse is an event as stored with the events it overlaps, when
+// its overlap policy is warn or it was forced past reject.
+type eventResponse struct {
+	Event
+	Conflicts []Event `json:"conflicts,omitempty"`
+}
+
+type eventList struct {
+	Events []Event `json:"events"`
+}
+
+// apiPath reports whether errors on path are answered with apiErrorBody:
+// those of /v2 and of the search, which came after it.
+func apiPath(path string) bool {
+	return strings.HasPrefix(path, "/v2/") || path == "/events"
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, apiErrorBody{Error: apiError{Code: code, Message: msg}})
+}
+
+func writeAPICalendarError(w http.ResponseWriter, err error) {
+	var overlap *OverlapError
+	switch {
+	case errors.As(err, &overlap):
+		writeJSON(w, http.StatusConflict, apiErrorBody{Error: apiError{Code: "overlap", Message: err.Error(), Conflicts: overlap.Conflicts}})
+	case errors.Is(err, errInvalidEvent):
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+	case errors.Is(err, errNotFound):
+		writeAPIError(w, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, errConflict):
+		writeAPIError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, errForbidden):
+		writeAPIError(w, http.StatusForbidden, "forbidden", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+	}
+}
+
+func apiNotAllowed(w http.ResponseWriter, allow string) {
+	writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Метод не поддерживается, используйте "+allow)
+}
+
+// decodeStrict rejects unknown fields so typos in v2 requests fail loudly
+// instead of being ignored.
+func decodeStrict(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("некорректное тело запроса: %w", err)
+	}
+	return nil
+}
+
+func pathUserID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("некорректный id пользователя %q", r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// requireUser reads the user of the path and checks the caller may act
+// for them, answering the request itself when not.
+func requireUser(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return 0, false
+	}
+	if err := authorize(r, userID); err != nil {
+		writeAPICalendarError(w, err)
+		return 0, false
+	}
+	return userID, true
+}
+
+// userEvent loads the event named in the path. Another user's event,
+// or one the caller may not see, is not found; with write set one the
+// caller may only read is forbidden.
+func userEvent(c *Calendar, r *http.Request, write bool) (Event, error) {
+	userID, err := pathUserID(r)
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: %v", errInvalidEvent, err)
+	}
+	e, err := c.Get(r.PathValue("eventID"))
+	if err != nil {
+		return Event{}, err
+	}
+	if e.UserID != userID || authorizeEvent(c, r, e, false) != nil {
+		return Event{}, errNotFound
+	}
+	if write {
+		if err := authorizeEvent(c, r, e, true); err != nil {
+			return Event{}, err
+		}
+	}
+	return e, nil
+}
+
+// pathRecurrenceID reads the original start of an occurrence from the
+// path: an RFC 3339 time, or a date for all-day series.
+func pathRecurrenceID(r *http.Request) (time.Time, error) {
+	v := r.PathValue("recurrenceID")
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%w: некорректное время повторения %q", errInvalidEvent, v)
+}
+
+// parseRange turns the from and to days into the window from local
+// midnight of from to local midnight after to.
+func parseRange(r *http.Request, loc *time.Location) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	return parseDays(q.Get("from"), q.Get("to"), loc)
+}
+
+// parseDays is parseRange for days given elsewhere than the query.
+func parseDays(fromDay, toDay string, loc *time.Location) (from, to time.Time, err error) {
+	first, err := time.ParseInLocation("2006-01-02", fromDay, loc)
+	if err != nil {
+		return from, to, errors.New("параметр from должен быть в формате YYYY-MM-DD")
+	}
+	last, err := time.ParseInLocation("2006-01-02", toDay, loc)
+	if err != nil {
+		return from, to, errors.New("параметр to должен быть в формате YYYY-MM-DD")
+	}
+	if last.Before(first) {
+		return from, to, errors.New("to раньше from")
+	}
+	if last.Sub(first) > maxRangeDays*24*time.Hour {
+		return from, to, fmt.Errorf("диапазон больше %d дней", maxRangeDays)
+	}
+	from, _ = dayWindow(first, 0, loc)
+	_, to = dayWindow(last, 1, loc)
+	return from, to, nil
+}
+
+func registerV2(rt *router, c *Calendar) {
+	const (
+		collection = "/v2/users/{id}/events"
+		item       = "/v2/users/{id}/events/{eventID}"
+	)
+
+	rt.mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "Нет такого ресурса: "+r.URL.Path)
+	})
+
+	rt.handle(route{
+		method:   http.MethodPost,
+		pattern:  collection,
+		summary:  "Создать событие",
+		query:    []queryParam{forceParam},
+		body:     eventInput{},
+		response: eventResponse{},
+		status:   http.StatusCreated,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, err := pathUserID(r)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			var in eventInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			e := Event{UserID: userID}
+			if err := in.apply(&e); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			// Writers of a shared calendar may add events to it.
+			if err := authorizeEvent(c, r, e, true); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			e, conflicts, err := createEvent(c, r, e)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			w.Header().Set("Location", fmt.Sprintf("/v2/users/%d/events/%s", userID, e.ID))
+			writeJSON(w, http.StatusCreated, eventResponse{Event: e, Conflicts: conflicts})
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:  http.MethodGet,
+		pattern: collection,
+		summary: "События пользователя за период, включая общие календари и приглашения",
+		query: []queryParam{
+			{name: "from", description: "первый день, YYYY-MM-DD", required: true},
+			{name: "to", description: "последний день включительно, YYYY-MM-DD", required: true},
+			{name: "tz", description: "часовой пояс IANA, по умолчанию пояс пользователя"},
+		},
+		response: eventList{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			loc, err := queryZone(r, c.UserLocation(userID))
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			from, to, err := parseRange(r, loc)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, eventList{Events: c.Agenda(userID, from, to)})
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodGet,
+		pattern:  item,
+		summary:  "Получить событие",
+		response: Event{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			e, err := userEvent(c, r, false)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, e)
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPut,
+		pattern:  item,
+		summary:  "Заменить событие",
+		query:    []queryParam{forceParam},
+		body:     eventInput{},
+		response: eventResponse{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			e, err := userEvent(c, r, true)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			var in eventInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			if err := in.apply(&e); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			if err := authorizeEvent(c, r, e, true); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			updated, conflicts, err := updateEvent(c, r, e)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, eventResponse{Event: updated, Conflicts: conflicts})
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPatch,
+		pattern:  item,
+		summary:  "Изменить отдельные поля события",
+		query:    []queryParam{forceParam},
+		body:     eventPatch{},
+		response: eventResponse{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			e, err := userEvent(c, r, true)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			var p eventPatch
+			if err := decodeStrict(r, &p); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			e.Version = 0
+			if err := p.apply(&e); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			// The patch may move the event to a calendar the caller can't
+			// write to.
+			if err := authorizeEvent(c, r, e, true); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			updated, conflicts, err := updateEvent(c, r, e)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, eventResponse{Event: updated, Conflicts: conflicts})
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:  http.MethodDelete,
+		pattern: item,
+		summary: "Удалить событие",
+		status:  http.StatusNoContent,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			e, err := userEvent(c, r, true)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			if err := c.Delete(e.ID); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	}, apiNotAllowed)
+
+	const occurrence = item + "/occurrences/{recurrenceID}"
+
+	rt.handle(route{
+		method:   http.MethodPut,
+		pattern:  occurrence,
+		summary:  "Изменить одно повторение события",
+		body:     occurrenceInput{},
+		response: Event{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			e, err := userEvent(c, r, true)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			rid, err := pathRecurrenceID(r)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			var in occurrenceInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			updated, err := c.OverrideOccurrence(e.ID, rid, Override{Start: in.Start, End: in.End, Text: in.Text})
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, updated)
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:  http.MethodDelete,
+		pattern: occurrence,
+		summary: "Отменить одно повторение события",
+		status:  http.StatusNoContent,
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			e, err := userEvent(c, r, true)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			rid, err := pathRecurrenceID(r)
+			if err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			if _, err := c.CancelOccurrence(e.ID, rid); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		},
+	}, apiNotAllowed)
+
+	const settings = "/v2/users/{id}/settings"
+
+	rt.handle(route{
+		method:   http.MethodGet,
+		pattern:  settings,
+		summary:  "Настройки пользователя",
+		response: settingsBody{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			writeJSON(w, http.StatusOK, settingsBody{TimeZone: c.UserLocation(userID).String(), OverlapPolicy: c.OverlapPolicy(userID)})
+		},
+	}, apiNotAllowed)
+
+	rt.handle(route{
+		method:   http.MethodPut,
+		pattern:  settings,
+		summary:  "Изменить часовой пояс и политику пересечений пользователя",
+		body:     settingsInput{},
+		response: settingsBody{},
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := requireUser(w, r)
+			if !ok {
+				return
+			}
+			var in settingsInput
+			if err := decodeStrict(r, &in); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			if err := c.UpdateSettings(userID, in.TimeZone, in.OverlapPolicy); err != nil {
+				writeAPICalendarError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, settingsBody{TimeZone: c.UserLocation(userID).String(), OverlapPolicy: c.OverlapPolicy(userID)})
+		},
+	}, apiNotAllowed)
+}
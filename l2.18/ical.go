@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// icalComponent is one BEGIN/END block of an RFC 5545 stream.
+type icalComponent struct {
+	Name     string
+	Props    []icalProp
+	Children []*icalComponent
+}
+
+type icalProp struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+func (c *icalComponent) prop(name string) (icalProp, bool) {
+	for _, p := range c.Props {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return icalProp{}, false
+}
+
+func (c *icalComponent) value(name string) string {
+	p, _ := c.prop(name)
+	return p.Value
+}
+
+// parseICal reads the components of an iCalendar stream. It accepts LF
+// as well as CRLF line ends, as files edited by hand often have them.
+func parseICal(r io.Reader) ([]*icalComponent, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var top []*icalComponent
+	var stack []*icalComponent
+	for n, line := range lines {
+		if line == "" {
+			continue
+		}
+		p, err := parseContentLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("строка %d: %v", n+1, err)
+		}
+		switch p.Name {
+		case "BEGIN":
+			c := &icalComponent{Name: strings.ToUpper(p.Value)}
+			if len(stack) == 0 {
+				top = append(top, c)
+			} else {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(p.Value) {
+				return nil, fmt.Errorf("строка %d: лишний END:%s", n+1, p.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("строка %d: свойство %s вне компонента", n+1, p.Name)
+			}
+			c := stack[len(stack)-1]
+			c.Props = append(c.Props, p)
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("нет END:%s", stack[len(stack)-1].Name)
+	}
+	return top, nil
+}
+
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+// parseContentLine splits NAME;PARAM=value;...:VALUE. Colons and
+// semicolons inside quoted parameter values don't count.
+func parseContentLine(line string) (icalProp, error) {
+	p := icalProp{Params: make(map[string]string)}
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return p, fmt.Errorf("некорректная строка %q", line)
+	}
+	p.Name = strings.ToUpper(line[:i])
+	for line[i] == ';' {
+		line = line[i+1:]
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return p, fmt.Errorf("параметр без значения в %s", p.Name)
+		}
+		name := strings.ToUpper(line[:eq])
+		line = line[eq+1:]
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				return p, fmt.Errorf("незакрытая кавычка в %s", p.Name)
+			}
+			value, line = line[1:end+1], line[end+2:]
+			i = 0
+		} else {
+			i = strings.IndexAny(line, ";:")
+			if i < 0 {
+				return p, fmt.Errorf("нет значения у %s", p.Name)
+			}
+			value = line[:i]
+		}
+		if len(line) == 0 || (line[i] != ';' && line[i] != ':') {
+			return p, fmt.Errorf("нет значения у %s", p.Name)
+		}
+		p.Params[name] = value
+	}
+	p.Value = line[i+1:]
+	return p, nil
+}
+
+var (
+	icalUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";")
+	icalEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+)
+
+// splitICalList splits a text list such as CATEGORIES on the commas
+// that aren't escaped, unescaping each value.
+func splitICalList(v string) []string {
+	var values []string
+	start := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case ',':
+			values = append(values, icalUnescaper.Replace(v[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, icalUnescaper.Replace(v[start:]))
+}
+
+// parseICalDuration reads an RFC 5545 duration such as P1D or PT1H30M.
+// Days and weeks are returned apart from the clock part, since a day
+// isn't always 24 hours.
+func parseICalDuration(s string) (days int, d time.Duration, err error) {
+	orig := s
+	sign := 1
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	}
+	s = strings.TrimPrefix(s, "+")
+	if !strings.HasPrefix(s, "P") || len(s) < 3 {
+		return 0, 0, fmt.Errorf("некорректная длительность %q", orig)
+	}
+	s = s[1:]
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' {
+			inTime, s = true, s[1:]
+			continue
+		}
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(s) {
+			return 0, 0, fmt.Errorf("некорректная длительность %q", orig)
+		}
+		n, _ := strconv.Atoi(s[:i])
+		switch unit := s[i]; {
+		case unit == 'W' && !inTime:
+			days += 7 * n
+		case unit == 'D' && !inTime:
+			days += n
+		case unit == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case unit == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case unit == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, 0, fmt.Errorf("некорректная длительность %q", orig)
+		}
+		s = s[i+1:]
+	}
+	return sign * days, time.Duration(sign) * d, nil
+}
+
+// icalWriter writes content lines folded at 75 octets, never inside a
+// UTF-8 sequence.
+type icalWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newICalWriter(w io.Writer) *icalWriter {
+	return &icalWriter{w: bufio.NewWriter(w)}
+}
+
+func (iw *icalWriter) line(s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		iw.w.WriteString(s[:cut])
+		iw.w.WriteString("\r\n ")
+		// The leading space counts toward the next line's length.
+		s, limit = s[cut:], 74
+	}
+	iw.w.WriteString(s)
+	_, err := iw.w.WriteString("\r\n")
+	if iw.err == nil {
+		iw.err = err
+	}
+}
+
+func (iw *icalWriter) flush() error {
+	if err := iw.w.Flush(); err != nil {
+		return err
+	}
+	return iw.err
+}
+
+// icalZone is a VTIMEZONE. Zones whose TZID isn't in the IANA database,
+// such as Windows names, are resolved through their observances.
+type icalZone struct {
+	observances []icalObservance
+}
+
+type icalObservance struct {
+	// start is the onset in local time before the change, stored as UTC.
+	start    time.Time
+	rule     *RRule
+	rdates   []time.Time
+	from, to int
+}
+
+func parseICalZone(c *icalComponent) (*icalZone, error) {
+	z := &icalZone{}
+	for _, ob := range c.Children {
+		if ob.Name != "STANDARD" && ob.Name != "DAYLIGHT" {
+			continue
+		}
+		var o icalObservance
+		var err error
+		if o.start, err = parseICalTime(ob.value("DTSTART")); err != nil {
+			return nil, err
+		}
+		if o.from, err = parseUTCOffset(ob.value("TZOFFSETFROM")); err != nil {
+			return nil, err
+		}
+		if o.to, err = parseUTCOffset(ob.value("TZOFFSETTO")); err != nil {
+			return nil, err
+		}
+		if v := ob.value("RRULE"); v != "" {
+			if o.rule, err = ParseRRule(v); err != nil {
+				return nil, err
+			}
+		}
+		for _, p := range ob.Props {
+			if p.Name != "RDATE" {
+				continue
+			}
+			for _, v := range strings.Split(p.Value, ",") {
+				if t, err := parseICalTime(v); err == nil {
+					o.rdates = append(o.rdates, t)
+				}
+			}
+		}
+		z.observances = append(z.observances, o)
+	}
+	if len(z.observances) == 0 {
+		return nil, fmt.Errorf("нет STANDARD и DAYLIGHT")
+	}
+	return z, nil
+}
+
+func parseUTCOffset(s string) (int, error) {
+	if len(s) != 5 && len(s) != 7 || s[0] != '+' && s[0] != '-' {
+		return 0, fmt.Errorf("некорректное смещение %q", s)
+	}
+	hh, err1 := strconv.Atoi(s[1:3])
+	mm, err2 := strconv.Atoi(s[3:5])
+	ss := 0
+	var err3 error
+	if len(s) == 7 {
+		ss, err3 = strconv.Atoi(s[5:7])
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, fmt.Errorf("некорректное смещение %q", s)
+	}
+	off := hh*3600 + mm*60 + ss
+	if s[0] == '-' {
+		off = -off
+	}
+	return off, nil
+}
+
+// instant converts wall, a local time stored as UTC, to the moment it
+// names: the offset is that of the latest onset at or before it.
+func (z *icalZone) instant(wall time.Time) time.Time {
+	var best time.Time
+	offset := z.observances[0].from
+	for _, o := range z.observances {
+		onset := time.Time{}
+		consider := func(t time.Time) {
+			if !t.After(wall) && t.After(onset) {
+				onset = t
+			}
+		}
+		consider(o.start)
+		for _, d := range o.rdates {
+			consider(d)
+		}
+		if o.rule != nil {
+			o.rule.occurrences(o.start, wall.AddDate(-1, 0, 0), func(t time.Time) bool {
+				consider(t)
+				return !t.After(wall)
+			})
+		}
+		if !onset.IsZero() && onset.After(best) {
+			best, offset = onset, o.to
+		}
+	}
+	return wall.Add(-time.Duration(offset) * time.Second)
+}
+
+// ianaZone finds the IANA zone a TZID names, also when it carries a
+// prefix such as /mozilla.org/20050126_1/America/New_York.
+func ianaZone(tzid string) (*time.Location, bool) {
+	parts := strings.Split(strings.Trim(tzid, "/"), "/")
+	for i := range parts {
+		name := strings.Join(parts[i:], "/")
+		if name == "" || name == "Local" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc, true
+		}
+	}
+	return nil, false
+}
+
+// writeVTimezone describes loc around year by its offset changes in that
+// year, repeated yearly when the next year follows the same pattern.
+func writeVTimezone(iw *icalWriter, loc *time.Location, year int) {
+	iw.line("BEGIN:VTIMEZONE")
+	iw.line("TZID:" + loc.String())
+	changes := zoneTransitions(loc, year)
+	next := zoneTransitions(loc, year+1)
+	if len(changes) == 0 {
+		name, off := time.Date(year, 1, 1, 0, 0, 0, 0, loc).Zone()
+		iw.line("BEGIN:STANDARD")
+		iw.line("DTSTART:19700101T000000")
+		iw.line("TZOFFSETFROM:" + formatUTCOffset(off))
+		iw.line("TZOFFSETTO:" + formatUTCOffset(off))
+		iw.line("TZNAME:" + name)
+		iw.line("END:STANDARD")
+	}
+	for i, t := range changes {
+		_, from := t.Add(-time.Second).Zone()
+		name, to := t.Zone()
+		kind := "STANDARD"
+		if t.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		wall := t.In(time.FixedZone("", from))
+		iw.line("BEGIN:" + kind)
+		iw.line("DTSTART:" + wall.Format("20060102T150405"))
+		iw.line("TZOFFSETFROM:" + formatUTCOffset(from))
+		iw.line("TZOFFSETTO:" + formatUTCOffset(to))
+		iw.line("TZNAME:" + name)
+		if len(next) == len(changes) && yearlyPosition(next[i].In(time.FixedZone("", from))) == yearlyPosition(wall) {
+			iw.line("RRULE:FREQ=YEARLY;" + yearlyPosition(wall))
+		}
+		iw.line("END:" + kind)
+	}
+	iw.line("END:VTIMEZONE")
+}
+
+// zoneTransitions returns the moments in year when loc's offset changes.
+func zoneTransitions(loc *time.Location, year int) []time.Time {
+	var changes []time.Time
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(year+1, 1, 1, 0, 0, 0, 0, loc)
+	for lo := start; lo.Before(end); {
+		hi := lo.Add(24 * time.Hour)
+		_, a := lo.Zone()
+		if _, b := hi.Zone(); a != b {
+			l, h := lo, hi
+			for h.Sub(l) > time.Second {
+				mid := l.Add(h.Sub(l) / 2)
+				if _, m := mid.Zone(); m == a {
+					l = mid
+				} else {
+					h = mid
+				}
+			}
+			changes = append(changes, h.Truncate(time.Second))
+		}
+		lo = hi
+	}
+	return changes
+}
+
+// yearlyPosition is the BYMONTH and BYDAY of t, as in "last Sunday of
+// March".
+func yearlyPosition(t time.Time) string {
+	n := strconv.Itoa((t.Day()-1)/7 + 1)
+	if last := time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day(); t.Day()+7 > last {
+		n = "-1"
+	}
+	code := strings.ToUpper(t.Weekday().String()[:2])
+	return fmt.Sprintf("BYMONTH=%d;BYDAY=%s%s", int(t.Month()), n, code)
+}
+
+func formatUTCOffset(off int) string {
+	sign := '+'
+	if off < 0 {
+		sign, off = '-', -off
+	}
+	s := fmt.Sprintf("%c%02d%02d", sign, off/3600, off/60%60)
+	if off%60 != 0 {
+		s += fmt.Sprintf("%02d", off%60)
+	}
+	return s
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const icalProductID = "-//l2.18//Calendar//RU"
+
+// writeICS writes events as a VCALENDAR. Series are written with their
+// rule, cancelled dates and overrides, so clients expand them the same
+// way the server does.
+func writeICS(w io.Writer, name string, events []Event) error {
+	iw := newICalWriter(w)
+	iw.line("BEGIN:VCALENDAR")
+	iw.line("VERSION:2.0")
+	iw.line("PRODID:" + icalProductID)
+	iw.line("CALSCALE:GREGORIAN")
+	if name != "" {
+		iw.line("X-WR-CALNAME:" + icalEscaper.Replace(name))
+	}
+
+	// One VTIMEZONE per zone of timed events, its onsets starting the
+	// year before the earliest event in it so that they cover the event.
+	years := make(map[string]int)
+	for _, e := range events {
+		if e.AllDay || e.TimeZone == "" || e.TimeZone == "UTC" {
+			continue
+		}
+		if y, ok := years[e.TimeZone]; !ok || e.Start.Year()-1 < y {
+			years[e.TimeZone] = e.Start.Year() - 1
+		}
+	}
+	zones := make([]string, 0, len(years))
+	for tz := range years {
+		zones = append(zones, tz)
+	}
+	sort.Strings(zones)
+	for _, tz := range zones {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			writeVTimezone(iw, loc, years[tz])
+		}
+	}
+
+	stamp := "DTSTAMP:" + time.Now().UTC().Format("20060102T150405Z")
+	for _, e := range events {
+		uid := e.UID
+		if uid == "" {
+			uid = e.ID
+		}
+		iw.line("BEGIN:VEVENT")
+		iw.line("UID:" + uid)
+		iw.line(stamp)
+		iw.line("SEQUENCE:" + strconv.Itoa(max(e.Version-1, 0)))
+		iw.line(icalTimeProp("DTSTART", e.Start, e))
+		iw.line(icalTimeProp("DTEND", e.End, e))
+		iw.line("SUMMARY:" + icalEscaper.Replace(e.Text))
+		if len(e.Tags) > 0 {
+			tags := make([]string, len(e.Tags))
+			for i, tag := range e.Tags {
+				tags[i] = icalEscaper.Replace(tag)
+			}
+			iw.line("CATEGORIES:" + strings.Join(tags, ","))
+		}
+		if e.RRule != "" {
+			iw.line("RRULE:" + icalRRule(e))
+		}
+		for _, d := range e.ExDates {
+			iw.line(icalTimeProp("EXDATE", d, e))
+		}
+		iw.line("END:VEVENT")
+
+		for _, o := range e.Overrides {
+			inst := occurrence(e, o.RecurrenceID, o)
+			iw.line("BEGIN:VEVENT")
+			iw.line("UID:" + uid)
+			iw.line(stamp)
+			iw.line(icalTimeProp("RECURRENCE-ID", o.RecurrenceID, e))
+			iw.line(icalTimeProp("DTSTART", inst.Start, e))
+			iw.line(icalTimeProp("DTEND", inst.End, e))
+			iw.line("SUMMARY:" + icalEscaper.Replace(inst.Text))
+			iw.line("END:VEVENT")
+		}
+	}
+	iw.line("END:VCALENDAR")
+	return iw.flush()
+}
+
+// icalTimeProp writes t as a date for all-day events, in UTC for events
+// without a zone and as local time with a TZID otherwise.
+func icalTimeProp(name string, t time.Time, e Event) string {
+	loc := eventLocation(e)
+	switch {
+	case e.AllDay:
+		return name + ";VALUE=DATE:" + t.In(loc).Format("20060102")
+	case loc == time.UTC:
+		return name + ":" + t.UTC().Format("20060102T150405Z")
+	default:
+		return name + ";TZID=" + loc.String() + ":" + t.In(loc).Format("20060102T150405")
+	}
+}
+
+// icalRRule is e's rule with UNTIL in the form RFC 5545 requires: a date
+// for all-day events and UTC otherwise.
+func icalRRule(e Event) string {
+	rule, err := ParseRRule(e.RRule)
+	if err != nil || rule.Until.IsZero() {
+		return e.RRule
+	}
+	until := rule.Until
+	if rule.untilLocal {
+		until = time.Date(until.Year(), until.Month(), until.Day(), until.Hour(), until.Minute(), until.Second(), 0, eventLocation(e))
+	}
+	rule.Until = time.Time{}
+	if e.AllDay {
+		return rule.String() + ";UNTIL=" + until.Format("20060102")
+	}
+	return rule.String() + ";UNTIL=" + until.UTC().Format("20060102T150405Z")
+}
+
+// importIssue is a part of an imported file that was left out.
+type importIssue struct {
+	Component string `json:"component"`
+	UID       string `json:"uid,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+type importReport struct {
+	Created int           `json:"created"`
+	Updated int           `json:"updated"`
+	Skipped []importIssue `json:"skipped"`
+}
+
+// icalDecoder maps VEVENTs onto events of one user. Floating times are
+// taken in the user's zone.
+type icalDecoder struct {
+	userLoc *time.Location
+	zones   map[string]*icalZone
+	issues  []importIssue
+	// warned holds the TZIDs already reported as missing from the IANA
+	// database.
+	warned map[string]bool
+}
+
+// decodeICS reads the events of a VCALENDAR. Components and events that
+// can't be represented are reported rather than failing the import.
+func decodeICS(r io.Reader, userLoc *time.Location) ([]Event, []importIssue, error) {
+	top, err := parseICal(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &icalDecoder{userLoc: userLoc, zones: make(map[string]*icalZone), warned: make(map[string]bool)}
+
+	var vevents []*icalComponent
+	found := false
+	for _, cal := range top {
+		if cal.Name != "VCALENDAR" {
+			d.skip(cal.Name, "", "компонент вне VCALENDAR")
+			continue
+		}
+		found = true
+		for _, c := range cal.Children {
+			switch c.Name {
+			case "VEVENT":
+				vevents = append(vevents, c)
+			case "VTIMEZONE":
+				z, err := parseICalZone(c)
+				if err != nil {
+					d.skip(c.Name, c.value("TZID"), err.Error())
+					continue
+				}
+				d.zones[c.value("TZID")] = z
+			default:
+				d.skip(c.Name, c.value("UID"), "компонент не поддерживается")
+			}
+		}
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("нет VCALENDAR")
+	}
+
+	var events []Event
+	byUID := make(map[string]int)
+	var instances []*icalComponent
+	for _, c := range vevents {
+		for _, child := range c.Children {
+			d.skip(child.Name, c.value("UID"), "компонент не поддерживается")
+		}
+		if _, ok := c.prop("RECURRENCE-ID"); ok {
+			instances = append(instances, c)
+			continue
+		}
+		e, err := d.event(c)
+		if err != nil {
+			d.skip(c.Name, c.value("UID"), err.Error())
+			continue
+		}
+		if strings.EqualFold(c.value("STATUS"), "CANCELLED") {
+			d.skip(c.Name, e.UID, "событие отменено")
+			continue
+		}
+		if i, ok := byUID[e.UID]; ok && e.UID != "" {
+			events[i] = e
+			continue
+		}
+		byUID[e.UID] = len(events)
+		events = append(events, e)
+	}
+
+	for _, c := range instances {
+		uid := c.value("UID")
+		i, ok := byUID[uid]
+		if !ok || events[i].RRule == "" {
+			d.skip(c.Name, uid, "нет повторяющегося события с таким UID")
+			continue
+		}
+		if err := d.instance(c, &events[i]); err != nil {
+			d.skip(c.Name, uid, err.Error())
+		}
+	}
+	return events, d.issues, nil
+}
+
+func (d *icalDecoder) skip(component, uid, reason string) {
+	d.issues = append(d.issues, importIssue{Component: component, UID: uid, Reason: reason})
+}
+
+func (d *icalDecoder) event(c *icalComponent) (Event, error) {
+	e := Event{UID: c.value("UID"), Text: icalUnescaper.Replace(c.value("SUMMARY"))}
+	if e.Text == "" {
+		e.Text = "Без названия"
+	}
+	p, ok := c.prop("DTSTART")
+	if !ok {
+		return Event{}, fmt.Errorf("нет DTSTART")
+	}
+	var err error
+	if e.Start, e.AllDay, e.TimeZone, err = d.time(p, p.Value); err != nil {
+		return Event{}, err
+	}
+	if e.End, err = d.end(c, e.Start); err != nil {
+		return Event{}, err
+	}
+
+	if v := c.value("RRULE"); v != "" {
+		if _, err := ParseRRule(v); err != nil {
+			return Event{}, fmt.Errorf("RRULE: %v", err)
+		}
+		e.RRule = v
+		if e.TimeZone == "" && !e.AllDay && strings.HasSuffix(p.Value, "Z") {
+			// A series given in UTC repeats in UTC, not in the owner's zone.
+			e.TimeZone = "UTC"
+		}
+	}
+	for _, p := range c.Props {
+		if p.Name == "CATEGORIES" {
+			e.Tags = append(e.Tags, splitICalList(p.Value)...)
+		}
+		if p.Name != "EXDATE" {
+			continue
+		}
+		for _, v := range strings.Split(p.Value, ",") {
+			t, _, _, err := d.time(p, v)
+			if err != nil {
+				return Event{}, fmt.Errorf("EXDATE: %v", err)
+			}
+			e.ExDates = append(e.ExDates, t)
+		}
+	}
+	return e, nil
+}
+
+// end reads DTEND or DURATION. Without either the calendar's defaults
+// apply: a day for all-day events, an hour otherwise.
+func (d *icalDecoder) end(c *icalComponent, start time.Time) (time.Time, error) {
+	if p, ok := c.prop("DTEND"); ok {
+		end, _, _, err := d.time(p, p.Value)
+		return end, err
+	}
+	if v := c.value("DURATION"); v != "" {
+		days, dur, err := parseICalDuration(v)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return start.AddDate(0, 0, days).Add(dur), nil
+	}
+	return time.Time{}, nil
+}
+
+func (d *icalDecoder) instance(c *icalComponent, master *Event) error {
+	p, _ := c.prop("RECURRENCE-ID")
+	rid, _, _, err := d.time(p, p.Value)
+	if err != nil {
+		return fmt.Errorf("RECURRENCE-ID: %v", err)
+	}
+	if strings.EqualFold(c.value("STATUS"), "CANCELLED") {
+		master.ExDates = append(master.ExDates, rid)
+		return nil
+	}
+	o := Override{RecurrenceID: rid, Text: icalUnescaper.Replace(c.value("SUMMARY"))}
+	if p, ok := c.prop("DTSTART"); ok {
+		if o.Start, _, _, err = d.time(p, p.Value); err != nil {
+			return err
+		}
+		if o.End, err = d.end(c, o.Start); err != nil {
+			return err
+		}
+	}
+	master.Overrides = append(master.Overrides, o)
+	return nil
+}
+
+// time reads one DATE or DATE-TIME value of p. zone is the IANA name the
+// event should keep, empty for UTC, floating times and zones that had to
+// be converted.
+func (d *icalDecoder) time(p icalProp, v string) (t time.Time, allDay bool, zone string, err error) {
+	if p.Params["VALUE"] == "DATE" || len(v) == len("20060102") {
+		t, err = time.Parse("20060102", v)
+		return t, true, "", err
+	}
+	tzid := p.Params["TZID"]
+	switch {
+	case strings.HasSuffix(v, "Z"):
+		t, err = time.Parse("20060102T150405Z", v)
+		return t, false, "", err
+	case tzid == "":
+		t, err = time.ParseInLocation("20060102T150405", v, d.userLoc)
+		return t, false, "", err
+	}
+	if loc, ok := ianaZone(tzid); ok {
+		t, err = time.ParseInLocation("20060102T150405", v, loc)
+		return t, false, loc.String(), err
+	}
+	z, ok := d.zones[tzid]
+	if !ok {
+		return t, false, "", fmt.Errorf("неизвестный часовой пояс %q", tzid)
+	}
+	wall, err := time.Parse("20060102T150405", v)
+	if err != nil {
+		return t, false, "", err
+	}
+	if !d.warned[tzid] {
+		d.warned[tzid] = true
+		d.skip("VTIMEZONE", tzid, "пояса нет в базе IANA, время переведено в пояс пользователя")
+	}
+	return z.instant(wall), false, "", nil
+}
+
+// importEvents stores events for userID. An event whose UID matches one
+// the user already has, imported before or exported from here, replaces
+// it.
+func importEvents(c *Calendar, userID int, events []Event, report *importReport) {
+	for _, e := range events {
+		e.UserID = userID
+		existing, found := c.FindUID(userID, e.UID)
+		var err error
+		if found {
+			e.ID = existing.ID
+			if e.UID == existing.ID {
+				e.UID = existing.UID
+			}
+			// Calendars, attendees and reminders aren't carried by iCalendar
+			// here, so they are kept.
+			e.CalendarID, e.Attendees, e.Reminders = existing.CalendarID, existing.Attendees, existing.Reminders
+			_, err = c.Update(e)
+		} else {
+			_, err = c.Create(e)
+		}
+		switch {
+		case err != nil:
+			report.Skipped = append(report.Skipped, importIssue{Component: "VEVENT", UID: e.UID, Reason: err.Error()})
+		case found:
+			report.Updated++
+		default:
+			report.Created++
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const outlookICS = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Central European Standard Time\r\n" +
+	"BEGIN:STANDARD\r\n" +
+	"DTSTART:16011028T030000\r\n" +
+	"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=10\r\n" +
+	"TZOFFSETFROM:+0200\r\n" +
+	"TZOFFSETTO:+0100\r\n" +
+	"END:STANDARD\r\n" +
+	"BEGIN:DAYLIGHT\r\n" +
+	"DTSTART:16010325T020000\r\n" +
+	"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=3\r\n" +
+	"TZOFFSETFROM:+0100\r\n" +
+	"TZOFFSETTO:+0200\r\n" +
+	"END:DAYLIGHT\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:weekly-1\r\n" +
+	"SUMMARY:Review\\, weekly\r\n" +
+	"DTSTART;TZID=America/New_York:20240304T090000\r\n" +
+	"DURATION:PT30M\r\n" +
+	"RRULE:FREQ=WEEKLY;COUNT=3\r\n" +
+	"EXDATE;TZID=America/New_York:20240311T090000\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:weekly-1\r\n" +
+	"RECURRENCE-ID;TZID=America/New_York:20240318T090000\r\n" +
+	"DTSTART;TZID=America/New_York:20240318T100000\r\n" +
+	"SUMMARY:Review moved\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:summer-1\r\n" +
+	"SUMMARY:Summer call\r\n" +
+	"DTSTART;TZID=Central European Standard Time:20240701T100000\r\n" +
+	"DTEND;TZID=Central European Standard Time:20240701T110000\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VTODO\r\n" +
+	"UID:todo-1\r\n" +
+	"END:VTODO\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestDecodeICS(t *testing.T) {
+	events, issues, err := decodeICS(strings.NewReader(outlookICS), time.UTC)
+	if err != nil {
+		t.Fatalf("decodeICS() error = %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v", events)
+	}
+	weekly := events[0]
+	if weekly.Text != "Review, weekly" || weekly.TimeZone != "America/New_York" || weekly.End.Sub(weekly.Start) != 30*time.Minute {
+		t.Errorf("weekly event = %+v", weekly)
+	}
+	if len(weekly.ExDates) != 1 || len(weekly.Overrides) != 1 || weekly.Overrides[0].Start.Hour() != 10 {
+		t.Errorf("expected one EXDATE and one override, got %+v", weekly)
+	}
+	// 10:00 in Central Europe in July is 08:00 UTC.
+	if got := events[1].Start.UTC(); !got.Equal(time.Date(2024, 7, 1, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("summer call starts at %v, want 08:00 UTC", got)
+	}
+
+	var components []string
+	for _, is := range issues {
+		components = append(components, is.Component)
+	}
+	if got := strings.Join(components, ","); got != "VTODO,VALARM,VTIMEZONE" {
+		t.Errorf("reported %q, want VTODO, VALARM and the non-IANA VTIMEZONE", got)
+	}
+}
+
+func TestICSRoundTrip(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	rec := doRequest(t, h, http.MethodPost, "/v2/users/1/calendar.ics", outlookICS)
+	var report importReport
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if rec.Code != http.StatusOK || report.Created != 2 {
+		t.Fatalf("import: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	rec = doRequest(t, h, http.MethodGet, "/v2/users/1/calendar.ics", "")
+	feed := rec.Body.String()
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	for _, want := range []string{
+		"BEGIN:VTIMEZONE\r\nTZID:America/New_York\r\n",
+		"RRULE:FREQ=WEEKLY;COUNT=3\r\n",
+		"EXDATE;TZID=America/New_York:20240311T090000\r\n",
+		"RECURRENCE-ID;TZID=America/New_York:20240318T090000\r\n",
+		"SUMMARY:Review\\, weekly\r\n",
+	} {
+		if !strings.Contains(feed, want) {
+			t.Errorf("feed lacks %q:\n%s", want, feed)
+		}
+	}
+
+	// Importing the file again updates the events instead of copying them.
+	rec = doRequest(t, h, http.MethodPost, "/v2/users/1/calendar.ics", feed)
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if report.Created != 0 || report.Updated != 2 {
+		t.Errorf("re-import: %+v", report)
+	}
+	rec = doRequest(t, h, http.MethodGet, "/v2/users/1/events?from=2024-03-01&to=2024-03-31&tz=America/New_York", "")
+	var list eventList
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Events) != 2 || list.Events[1].Text != "Review moved" {
+		t.Errorf("March after re-import = %+v", list.Events)
+	}
+}
+
+func TestICalLineFolding(t *testing.T) {
+	var b strings.Builder
+	iw := newICalWriter(&b)
+	iw.line("SUMMARY:" + strings.Repeat("ж", 60))
+	iw.flush()
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets", len(line))
+		}
+	}
+	lines, _ := unfold(strings.NewReader(b.String()))
+	if len(lines) != 1 || lines[0] != "SUMMARY:"+strings.Repeat("ж", 60) {
+		t.Errorf("unfolded to %q", lines)
+	}
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 )
 
 func main() {
@@ -12,11 +20,119 @@ func main() {
 		port = "8081"
 	}
 
-	calendar := NewCalendar()
-	makeHandlers(calendar)
+	store, err := openStore(os.Getenv("CALENDAR_STORE"), os.Getenv("CALENDAR_DATA"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auth, err := openAuth(os.Getenv("CALENDAR_AUTH"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	notifiers, err := openNotifiers(os.Getenv("CALENDAR_NOTIFY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	calendar := NewCalendarWithStore(store)
+	srv := &http.Server{Addr: ":" + port, Handler: makeHandlersWithAuth(calendar, auth)}
+	// Shutdown doesn't interrupt change streams, it waits for them.
+	srv.RegisterOnShutdown(calendar.CloseFeeds)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	scheduler := NewScheduler(calendar, notifiers)
+	schedulerDone := make(chan struct{})
+	go func() {
+		scheduler.Run(ctx)
+		close(schedulerDone)
+	}()
 
 	log.Printf("Сервер запущен на порту %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+	// The scheduler writes its queue to the store, so it has to stop
+	// before the store is closed.
+	<-schedulerDone
+	if err := store.Close(); err != nil {
+		log.Fatalf("ошибка закрытия хранилища: %v", err)
+	}
+	log.Print("Сервер остановлен")
+}
+
+// openAuth loads the keys in the CALENDAR_AUTH file. Without one every
+// caller may act for any user, which is only fit for local use.
+func openAuth(path string) (*Authenticator, error) {
+	if path == "" {
+		log.Print("CALENDAR_AUTH не задан: аутентификация выключена")
+		return nil, nil
+	}
+	auth, err := LoadAuthenticator(path)
+	if err != nil {
+		return nil, fmt.Errorf("настройки аутентификации: %w", err)
+	}
+	return auth, nil
+}
+
+// openNotifiers sets up the notifiers listed in CALENDAR_NOTIFY, comma
+// separated: log (the default), webhook, which POSTs to
+// CALENDAR_WEBHOOK_URL, and email, sent through CALENDAR_SMTP_ADDR.
+func openNotifiers(names string) (map[string]Notifier, error) {
+	if names == "" {
+		names = "log"
+	}
+	notifiers := make(map[string]Notifier)
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "log":
+			notifiers[name] = logNotifier{}
+		case "webhook":
+			url := os.Getenv("CALENDAR_WEBHOOK_URL")
+			if url == "" {
+				return nil, errors.New("для webhook нужен CALENDAR_WEBHOOK_URL")
+			}
+			notifiers[name] = webhookNotifier{URL: url, Client: &http.Client{Timeout: deliveryTimeout}}
+		case "email":
+			notifiers[name] = smtpNotifier{
+				Addr: envOr("CALENDAR_SMTP_ADDR", "localhost:1025"),
+				From: envOr("CALENDAR_SMTP_FROM", "calendar@localhost"),
+				To:   envOr("CALENDAR_SMTP_TO", "user{user}@localhost"),
+			}
+		default:
+			return nil, fmt.Errorf("неизвестный способ уведомлений %q: используйте log, webhook или email", name)
+		}
+	}
+	log.Printf("Напоминания отправляются через %s", names)
+	return notifiers, nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// openStore picks the EventStore named by CALENDAR_STORE: "memory" (the
+// default) or "file", which keeps its data in the CALENDAR_DATA directory.
+func openStore(kind, dir string) (EventStore, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		if dir == "" {
+			dir = "data"
+		}
+		log.Printf("Данные хранятся в %s", dir)
+		return OpenFileStore(dir)
+	}
+	return nil, fmt.Errorf("неизвестное хранилище %q: используйте memory или file", kind)
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logNotifier writes reminders to the server log.
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, n Notification) error {
+	logger.Printf("напоминание пользователю %d: %q в %s", n.UserID, n.Text, n.Start.Format(time.RFC3339))
+	return nil
+}
+
+// webhookNotifier POSTs the notification as JSON to URL. Any status but
+// 2xx counts as a failure.
+type webhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (wh webhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, _ := json.Marshal(n)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", n.Key)
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook ответил %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier mails reminders through the SMTP server at Addr, meant to
+// be a local relay or a stand-in such as MailHog. Users have no address
+// here, so To is a pattern with {user} in place of the user ID.
+type smtpNotifier struct {
+	Addr string
+	From string
+	To   string
+}
+
+func (m smtpNotifier) Notify(ctx context.Context, n Notification) error {
+	to := strings.ReplaceAll(m.To, "{user}", strconv.Itoa(n.UserID))
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(m.Addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if err := client.Mail(m.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(reminderMail(m.From, to, n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func reminderMail(from, to string, n Notification) []byte {
+	when := n.Start.Format("02.01.2006 15:04 MST")
+	if n.AllDay {
+		when = n.Start.Format("02.01.2006")
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Напоминание: "+n.Text))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@calendar>\r\n", strings.ReplaceAll(n.Key, "/", "."))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\nНачало: %s\r\n", n.Text, when)
+	return b.Bytes()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var pathParam = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+// openAPI builds an OpenAPI 3 document from the registered routes.
+// Schemas are derived from the Go types through their json tags.
+func (rt *router) openAPI() map[string]any {
+	schemas := make(map[string]any)
+	paths := make(map[string]any)
+
+	for _, pattern := range rt.order {
+		item := make(map[string]any)
+		for _, r := range rt.routes {
+			if r.pattern != pattern {
+				continue
+			}
+			item[strings.ToLower(r.method)] = operation(r, schemas)
+		}
+		paths[pattern] = item
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Calendar API",
+			"version": "2.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+		},
+	}
+}
+
+func operation(r route, schemas map[string]any) map[string]any {
+	var params []any
+	for _, m := range pathParam.FindAllStringSubmatch(r.pattern, -1) {
+		params = append(params, map[string]any{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]any{"type": "string"},
+		})
+	}
+	for _, q := range r.query {
+		params = append(params, map[string]any{
+			"name":        q.name,
+			"in":          "query",
+			"required":    q.required,
+			"description": q.description,
+			"schema":      map[string]any{"type": "string"},
+		})
+	}
+
+	op := map[string]any{"summary": r.summary}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if r.body != nil {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(r.body), schemas)},
+			},
+		}
+	}
+
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]any{"description": http.StatusText(status)}
+	if r.response != nil {
+		ok["content"] = map[string]any{
+			"application/json": map[string]any{"schema": schemaFor(reflect.TypeOf(r.response), schemas)},
+		}
+	}
+	responses := map[string]any{strconv.Itoa(status): ok}
+	if apiPath(r.pattern) {
+		errSchema := schemaFor(reflect.TypeOf(apiErrorBody{}), schemas)
+		responses["default"] = map[string]any{
+			"description": "Ошибка",
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": errSchema},
+			},
+		}
+	}
+	op["responses"] = responses
+	return op
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns a JSON schema for t. Named struct types are added to
+// schemas once and referenced.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		return schemaFor(t.Elem(), schemas)
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]any{}
+	}
+
+	name := schemaName(t)
+	ref := map[string]any{"$ref": "#/components/schemas/" + name}
+	if name != "" {
+		if _, done := schemas[name]; done {
+			return ref
+		}
+		// Placeholder first, so self-referencing types terminate.
+		schemas[name] = map[string]any{}
+	}
+
+	props := make(map[string]any)
+	required := addFields(t, props, schemas)
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if name == "" {
+		return schema
+	}
+	schemas[name] = schema
+	return ref
+}
+
+// addFields adds the JSON fields of struct t to props and returns those
+// that are required. Embedded structs without a JSON name are flattened,
+// as encoding/json does.
+func addFields(t reflect.Type, props map[string]any, schemas map[string]any) []string {
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		field, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if field == "-" {
+			continue
+		}
+		if field == "" && f.Anonymous && f.Type.Kind() == reflect.Struct {
+			required = append(required, addFields(f.Type, props, schemas)...)
+			continue
+		}
+		if field == "" {
+			field = f.Name
+		}
+		props[field] = schemaFor(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, field)
+		}
+	}
+	return required
+}
+
+// schemaName exports the Go type name, so eventInput is documented as
+// EventInput.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
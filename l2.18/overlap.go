@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Overlap policies say what happens when an event overlaps others of its
+// calendar or owner: policyAllow stores it silently, policyWarn stores it
+// and lists the conflicts, policyReject refuses it unless forced.
+const (
+	policyAllow  = "allow"
+	policyWarn   = "warn"
+	policyReject = "reject"
+)
+
+var overlapPolicies = map[string]bool{"": true, policyAllow: true, policyWarn: true, policyReject: true}
+
+var errOverlap = errors.New("время занято другими событиями")
+
+const (
+	// conflictHorizon is how far ahead the occurrences of a series are
+	// checked for conflicts.
+	conflictHorizon = 366 * 24 * time.Hour
+	maxConflicts    = 20
+)
+
+// OverlapError is returned for an event its overlap policy rejects.
+type OverlapError struct {
+	Conflicts []Event
+}
+
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("%v: пересекается с %d", errOverlap, len(e.Conflicts))
+}
+
+func (e *OverlapError) Unwrap() error {
+	return errOverlap
+}
+
+func checkPolicy(policy string) error {
+	if !overlapPolicies[policy] {
+		return fmt.Errorf("%w: политика пересечений должна быть allow, warn или reject", errInvalidEvent)
+	}
+	return nil
+}
+
+// overlapPolicy returns the policy e falls under and whether it is its
+// calendar's, which then limits conflicts to that calendar. Must be
+// called with c.mu held.
+func (c *Calendar) overlapPolicy(e Event) (policy string, perCalendar bool) {
+	cals := c.calendars[e.UserID]
+	if i := findCalendar(cals, calendarOf(e)); i >= 0 && cals[i].OverlapPolicy != "" {
+		return cals[i].OverlapPolicy, true
+	}
+	if policy = c.userSettings(e.UserID).OverlapPolicy; policy == "" {
+		policy = policyAllow
+	}
+	return policy, false
+}
+
+// conflicts returns the events overlapping e, each as its first
+// overlapping occurrence, and the policy that applies. A series is
+// checked up to conflictHorizon ahead. Must be called with c.mu held.
+func (c *Calendar) conflicts(e Event) ([]Event, string) {
+	policy, perCalendar := c.overlapPolicy(e)
+	if policy == policyAllow {
+		return nil, policy
+	}
+	from, to := e.Start, e.End
+	instances := []Event{e}
+	if e.RRule != "" {
+		to = e.Start.Add(conflictHorizon)
+		instances = expand(e, from, to)
+		// Overrides come first: the loop below needs them in start order.
+		sort.Slice(instances, func(i, j int) bool { return instances[i].Start.Before(instances[j].Start) })
+	}
+	others := c.between(from, to, func(o Event) bool {
+		return o.ID != e.ID && o.UserID == e.UserID && (!perCalendar || calendarOf(o) == calendarOf(e))
+	})
+
+	var found []Event
+	seen := make(map[string]bool)
+	for _, o := range others {
+		if seen[o.ID] {
+			continue
+		}
+		for _, inst := range instances {
+			if !inst.Start.Before(o.End) {
+				break
+			}
+			if inst.End.After(o.Start) {
+				seen[o.ID] = true
+				found = append(found, o)
+				break
+			}
+		}
+		if len(found) == maxConflicts {
+			break
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Start.Before(found[j].Start) })
+	return found, policy
+}
+
+// checkOverlaps returns an OverlapError if the policy of e rejects it.
+// An update, with old the event before it, is only rejected for
+// conflicts old didn't have, so an event booked by force can still be
+// edited. Must be called with c.mu held.
+func (c *Calendar) checkOverlaps(e Event, old *Event, force bool) error {
+	if force {
+		return nil
+	}
+	found, policy := c.conflicts(e)
+	if policy != policyReject || len(found) == 0 {
+		return nil
+	}
+	if old != nil {
+		before, _ := c.conflicts(*old)
+		had := make(map[string]bool)
+		for _, o := range before {
+			had[o.ID] = true
+		}
+		var added []Event
+		for _, o := range found {
+			if !had[o.ID] {
+				added = append(added, o)
+			}
+		}
+		if len(added) == 0 {
+			return nil
+		}
+	}
+	return &OverlapError{Conflicts: found}
+}
+
+// Conflicts returns the events overlapping e under its overlap policy,
+// none when overlaps are allowed.
+func (c *Calendar) Conflicts(e Event) []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found, _ := c.conflicts(e)
+	return found
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOverlapPolicies(t *testing.T) {
+	h := makeHandlers(NewCalendar())
+	create := func(target, body string) (int, eventResponse, apiErrorBody) {
+		rec := doRequest(t, h, http.MethodPost, target, body)
+		var ok eventResponse
+		var failed apiErrorBody
+		json.Unmarshal(rec.Body.Bytes(), &ok)
+		json.Unmarshal(rec.Body.Bytes(), &failed)
+		return rec.Code, ok, failed
+	}
+
+	rec := doRequest(t, h, http.MethodPost, "/v2/users/1/calendars", `{"name":"Переговорная","overlap_policy":"reject"}`)
+	var room CalendarInfo
+	json.Unmarshal(rec.Body.Bytes(), &room)
+
+	_, first, _ := create("/v2/users/1/events", `{"start":"2024-03-04T10:00:00Z","end":"2024-03-04T11:00:00Z","event":"Booked","calendar_id":"`+room.ID+`"}`)
+	status, _, failed := create("/v2/users/1/events", `{"start":"2024-03-04T10:30:00Z","end":"2024-03-04T11:30:00Z","event":"Double","calendar_id":"`+room.ID+`"}`)
+	if status != http.StatusConflict || failed.Error.Code != "overlap" || len(failed.Error.Conflicts) != 1 || failed.Error.Conflicts[0].ID != first.ID {
+		t.Fatalf("overlapping booking: status %d, %+v", status, failed)
+	}
+	if status, _, _ := create("/v2/users/1/events", `{"start":"2024-03-04T11:00:00Z","end":"2024-03-04T12:00:00Z","event":"Next","calendar_id":"`+room.ID+`"}`); status != http.StatusCreated {
+		t.Errorf("adjacent booking: status %d", status)
+	}
+	// The room's policy doesn't cover the owner's other calendars.
+	if status, ok, _ := create("/v2/users/1/events", `{"start":"2024-03-04T10:30:00Z","event":"Elsewhere"}`); status != http.StatusCreated || len(ok.Conflicts) != 0 {
+		t.Errorf("event in another calendar: status %d, %+v", status, ok)
+	}
+
+	status, forcedEvt, _ := create("/v2/users/1/events?force=true", `{"start":"2024-03-04T10:30:00Z","end":"2024-03-04T10:45:00Z","event":"VIP","calendar_id":"`+room.ID+`"}`)
+	if status != http.StatusCreated || len(forcedEvt.Conflicts) != 1 {
+		t.Fatalf("forced booking: status %d, %+v", status, forcedEvt)
+	}
+	// Edits that add no conflicts are allowed, moves onto another booking
+	// are not.
+	item := "/v2/users/1/events/" + forcedEvt.ID
+	if rec := doRequest(t, h, http.MethodPatch, item, `{"event":"VIP guest"}`); rec.Code != http.StatusOK {
+		t.Errorf("renaming a forced booking: status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := doRequest(t, h, http.MethodPatch, item, `{"start":"2024-03-04T11:15:00Z"}`); rec.Code != http.StatusConflict {
+		t.Errorf("moving onto another booking: status %d", rec.Code)
+	}
+
+	// A daily series conflicts with a booking days after it starts.
+	status, _, failed = create("/v2/users/1/events", `{"start":"2024-03-01T10:15:00Z","event":"Daily","rrule":"FREQ=DAILY","calendar_id":"`+room.ID+`"}`)
+	if status != http.StatusConflict || len(failed.Error.Conflicts) == 0 {
+		t.Errorf("series over bookings: status %d, %+v", status, failed)
+	}
+
+	// Under the owner's warn policy overlaps are stored and listed.
+	doRequest(t, h, http.MethodPut, "/v2/users/2/settings", `{"time_zone":"UTC","overlap_policy":"warn"}`)
+	create("/v2/users/2/events", `{"start":"2024-03-04T09:00:00Z","event":"One"}`)
+	status, warned, _ := create("/v2/users/2/events", `{"start":"2024-03-04T09:30:00Z","event":"Two"}`)
+	if status != http.StatusCreated || len(warned.Conflicts) != 1 || warned.Conflicts[0].Text != "One" {
+		t.Errorf("warn policy: status %d, %+v", status, warned)
+	}
+	if rec := doRequest(t, h, http.MethodPut, "/v2/users/2/settings", `{"overlap_policy":"sometimes"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown policy: status %d", rec.Code)
+	}
+	// Clients older than policies only send the zone, which keeps the
+	// policy; an invalid body changes neither.
+	doRequest(t, h, http.MethodPut, "/v2/users/2/settings", `{"time_zone":"Europe/Berlin"}`)
+	doRequest(t, h, http.MethodPut, "/v2/users/2/settings", `{"time_zone":"Mars/Olympus","overlap_policy":"reject"}`)
+	var settings settingsBody
+	json.Unmarshal(doRequest(t, h, http.MethodGet, "/v2/users/2/settings", "").Body.Bytes(), &settings)
+	if settings.TimeZone != "Europe/Berlin" || settings.OverlapPolicy != policyWarn {
+		t.Errorf("settings after partial updates = %+v", settings)
+	}
+
+	// The legacy API answers a rejected event in its own format.
+	doRequest(t, h, http.MethodPut, "/v2/users/3/settings", `{"time_zone":"UTC","overlap_policy":"reject"}`)
+	doRequest(t, h, http.MethodPost, "/create_event", `{"user_id":3,"date":"2024-03-04T00:00:00Z","event":"Day off"}`)
+	rec = doRequest(t, h, http.MethodPost, "/create_event", `{"user_id":3,"date":"2024-03-04T00:00:00Z","event":"Also off"}`)
+	var legacy struct {
+		Error     string  `json:"error"`
+		Conflicts []Event `json:"conflicts"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &legacy)
+	if rec.Code != http.StatusConflict || len(legacy.Conflicts) != 1 {
+		t.Errorf("legacy overlap: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOverlapSeriesWithMovedOccurrence(t *testing.T) {
+	c := NewCalendar()
+	reject := policyReject
+	c.UpdateSettings(1, nil, &reject)
+	at := func(day, hour int) time.Time { return time.Date(2024, 3, day, hour, 0, 0, 0, time.UTC) }
+	if _, err := c.Create(Event{UserID: 1, Start: at(10, 10), End: at(10, 11), Text: "Booked"}); err != nil {
+		t.Fatal(err)
+	}
+	// Overrides come first from the expansion; moving the second
+	// occurrence to later in the month mustn't hide the ones before it.
+	series := Event{UserID: 1, Start: at(1, 10), End: at(1, 11), Text: "Daily", RRule: "FREQ=DAILY",
+		Overrides: []Override{{RecurrenceID: at(2, 10), Start: at(25, 15), End: at(25, 16)}}}
+	if _, err := c.Create(series); !errors.Is(err, errOverlap) {
+		t.Errorf("series over a booking with a moved occurrence: error %v", err)
+	}
+}
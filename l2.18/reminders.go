@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Reminder asks for a notification MinutesBefore the start of an event,
+// or of each occurrence of a series, through the notifier named Method.
+// Without a Method every configured notifier is used.
+type Reminder struct {
+	MinutesBefore int    `json:"minutes_before"`
+	Method        string `json:"method,omitempty"`
+}
+
+const (
+	maxReminders = 5
+	// maxReminderBefore bounds how early a reminder fires, and so how far
+	// ahead the scheduler has to look for events.
+	maxReminderBefore = 7 * 24 * time.Hour
+)
+
+// reminderMethods are the notifiers a reminder may name.
+var reminderMethods = map[string]bool{"log": true, "webhook": true, "email": true}
+
+// normalizeReminders checks the reminders of e and drops duplicates.
+func normalizeReminders(e *Event) error {
+	if len(e.Reminders) > maxReminders {
+		return fmt.Errorf("%w: не больше %d напоминаний", errInvalidEvent, maxReminders)
+	}
+	var reminders []Reminder
+	seen := make(map[Reminder]bool)
+	for _, r := range e.Reminders {
+		if r.MinutesBefore < 0 || time.Duration(r.MinutesBefore)*time.Minute > maxReminderBefore {
+			return fmt.Errorf("%w: напоминание возможно за 0–%d минут", errInvalidEvent, int(maxReminderBefore/time.Minute))
+		}
+		if r.Method != "" && !reminderMethods[r.Method] {
+			return fmt.Errorf("%w: неизвестный способ напоминания %q", errInvalidEvent, r.Method)
+		}
+		if !seen[r] {
+			seen[r] = true
+			reminders = append(reminders, r)
+		}
+	}
+	sort.Slice(reminders, func(i, j int) bool { return reminders[i].MinutesBefore > reminders[j].MinutesBefore })
+	e.Reminders = reminders
+	return nil
+}
+
+// Notification is what a notifier is given when a reminder is due.
+type Notification struct {
+	// Key is the same for every attempt to deliver one reminder, so
+	// receivers can drop the duplicates at-least-once delivery brings.
+	Key           string    `json:"key"`
+	EventID       string    `json:"event_id"`
+	UserID        int       `json:"user_id"`
+	Text          string    `json:"event"`
+	Start         time.Time `json:"start"`
+	AllDay        bool      `json:"all_day,omitempty"`
+	MinutesBefore int       `json:"minutes_before"`
+	FireAt        time.Time `json:"fire_at"`
+}
+
+// Notifier delivers notifications. An error makes the scheduler try
+// again later.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// reminderJob is a due reminder waiting to be delivered by one notifier.
+type reminderJob struct {
+	Notification
+	Notifier    string    `json:"notifier"`
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// reminderState is what the scheduler keeps in the store: reminders due
+// up to Through have been queued, and Pending are not delivered yet.
+type reminderState struct {
+	Through time.Time     `json:"through"`
+	Pending []reminderJob `json:"pending,omitempty"`
+}
+
+const reminderStateKey = "reminders"
+
+const (
+	// maxCatchUp is how far back reminders missed while the server was
+	// down are still sent after it starts.
+	maxCatchUp = 24 * time.Hour
+	// maxAttempts is how often delivery is tried before giving up.
+	maxAttempts     = 10
+	firstRetry      = 30 * time.Second
+	maxRetry        = time.Hour
+	deliveryTimeout = 30 * time.Second
+)
+
+// Scheduler sends the reminders of every user's events as they come due.
+// Delivery is at least once: a reminder leaves the stored queue only
+// after its notifier succeeded, so one sent just before a crash is sent
+// again after the restart.
+type Scheduler struct {
+	c         *Calendar
+	notifiers map[string]Notifier
+	// Interval is how often the scheduler looks for due reminders.
+	Interval time.Duration
+	now      func() time.Time
+	state    reminderState
+}
+
+// NewScheduler sends reminders through notifiers, keyed by the names
+// reminders use as Method.
+func NewScheduler(c *Calendar, notifiers map[string]Notifier) *Scheduler {
+	s := &Scheduler{c: c, notifiers: notifiers, Interval: 10 * time.Second, now: time.Now}
+	if raw := c.meta(reminderStateKey); raw != nil {
+		if err := json.Unmarshal(raw, &s.state); err != nil {
+			logger.Printf("не удалось прочитать очередь напоминаний: %v", err)
+		}
+	}
+	return s
+}
+
+// Run sends reminders until ctx is done. A delivery under way is
+// finished first, so stopping doesn't cut a request in half.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		s.tick(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick queues the reminders that came due since the last one and tries
+// to deliver the queue.
+func (s *Scheduler) tick(ctx context.Context) {
+	now := s.now()
+	if s.queue(now) {
+		s.save()
+	}
+	for i := 0; i < len(s.state.Pending); {
+		if ctx.Err() != nil {
+			return
+		}
+		job := &s.state.Pending[i]
+		if job.NextAttempt.After(now) {
+			i++
+			continue
+		}
+		if s.deliver(job) {
+			s.state.Pending = append(s.state.Pending[:i], s.state.Pending[i+1:]...)
+		} else {
+			i++
+		}
+		s.save()
+	}
+}
+
+// queue adds the reminders due in (Through, now] to the queue and
+// reports whether it added any or moved Through on first start.
+func (s *Scheduler) queue(now time.Time) bool {
+	from := s.state.Through
+	if from.IsZero() {
+		// Nothing is due before the first start.
+		s.state.Through = now
+		return true
+	}
+	if from.Before(now.Add(-maxCatchUp)) {
+		from = now.Add(-maxCatchUp)
+	}
+	if !from.Before(now) {
+		return false
+	}
+	queued := make(map[string]bool)
+	for _, job := range s.state.Pending {
+		queued[job.Key+"/"+job.Notifier] = true
+	}
+	added := false
+	for _, e := range s.c.EventsBetween(0, from, now.Add(maxReminderBefore+time.Second)) {
+		for _, r := range e.Reminders {
+			fireAt := e.Start.Add(-time.Duration(r.MinutesBefore) * time.Minute)
+			if !fireAt.After(from) || fireAt.After(now) {
+				continue
+			}
+			n := Notification{
+				Key:     fmt.Sprintf("%s/%d/%d", e.ID, e.Start.Unix(), r.MinutesBefore),
+				EventID: e.ID, UserID: e.UserID, Text: e.Text, Start: e.Start, AllDay: e.AllDay,
+				MinutesBefore: r.MinutesBefore, FireAt: fireAt,
+			}
+			for _, name := range s.notifiersFor(r) {
+				if queued[n.Key+"/"+name] {
+					continue
+				}
+				queued[n.Key+"/"+name] = true
+				s.state.Pending = append(s.state.Pending, reminderJob{Notification: n, Notifier: name, NextAttempt: fireAt})
+				added = true
+			}
+		}
+	}
+	if added {
+		sort.SliceStable(s.state.Pending, func(i, j int) bool {
+			return s.state.Pending[i].NextAttempt.Before(s.state.Pending[j].NextAttempt)
+		})
+	}
+	s.state.Through = now
+	return added
+}
+
+func (s *Scheduler) notifiersFor(r Reminder) []string {
+	if r.Method != "" {
+		return []string{r.Method}
+	}
+	names := make([]string, 0, len(s.notifiers))
+	for name := range s.notifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deliver makes one attempt at job and reports whether it is done with,
+// delivered or given up on. A failed job is scheduled to be retried with
+// exponential backoff.
+func (s *Scheduler) deliver(job *reminderJob) bool {
+	n, ok := s.notifiers[job.Notifier]
+	if !ok {
+		logger.Printf("напоминание %s: способ %q не настроен", job.Key, job.Notifier)
+		return true
+	}
+	// A reminder of an event deleted while it waited is dropped.
+	if _, err := s.c.Get(job.EventID); err != nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	err := n.Notify(ctx, job.Notification)
+	cancel()
+	if err == nil {
+		return true
+	}
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= maxAttempts {
+		logger.Printf("напоминание %s через %s не доставлено после %d попыток: %v", job.Key, job.Notifier, job.Attempts, err)
+		return true
+	}
+	delay := firstRetry << (job.Attempts - 1)
+	if delay > maxRetry {
+		delay = maxRetry
+	}
+	job.NextAttempt = s.now().Add(delay)
+	logger.Printf("напоминание %s через %s: %v, повтор в %s", job.Key, job.Notifier, err, job.NextAttempt.Format(time.RFC3339))
+	return false
+}
+
+func (s *Scheduler) save() {
+	raw, _ := json.Marshal(s.state)
+	if err := s.c.putMeta(reminderStateKey, raw); err != nil {
+		logger.Printf("не удалось сохранить очередь напоминаний: %v", err)
+	}
+}
+
+func (c *Calendar) meta(key string) json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.store.Meta(key)
+}
+
+func (c *Calendar) putMeta(key string, value json.RawMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.store.PutMeta(key, value)
+}
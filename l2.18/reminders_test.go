@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records what it is given and fails while failing is set.
+type fakeNotifier struct {
+	sent    []Notification
+	failing bool
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, n Notification) error {
+	if f.failing {
+		return errors.New("недоступен")
+	}
+	f.sent = append(f.sent, n)
+	return nil
+}
+
+func TestSchedulerRetriesAndSurvivesRestart(t *testing.T) {
+	c := NewCalendar()
+	t0 := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	now := t0
+	fake := &fakeNotifier{failing: true}
+	s := NewScheduler(c, map[string]Notifier{"log": fake})
+	s.now = func() time.Time { return now }
+	s.tick(context.Background())
+
+	standup, _ := c.Create(Event{UserID: 1, Text: "Standup", Start: t0.Add(30 * time.Minute), Reminders: []Reminder{{MinutesBefore: 10}}})
+	c.Create(Event{UserID: 1, Text: "Silent", Start: t0.Add(30 * time.Minute)})
+
+	now = t0.Add(19 * time.Minute)
+	s.tick(context.Background())
+	if len(s.state.Pending) != 0 {
+		t.Fatalf("queued before due: %+v", s.state.Pending)
+	}
+	now = t0.Add(21 * time.Minute)
+	s.tick(context.Background())
+	if len(s.state.Pending) != 1 || s.state.Pending[0].Attempts != 1 {
+		t.Fatalf("after failed attempt: %+v", s.state.Pending)
+	}
+
+	// A new scheduler on the same store, as after a restart, picks the
+	// queue up and retries once the backoff is over.
+	fake.failing = false
+	s = NewScheduler(c, map[string]Notifier{"log": fake})
+	s.now = func() time.Time { return now }
+	now = t0.Add(21*time.Minute + 10*time.Second)
+	s.tick(context.Background())
+	if len(fake.sent) != 0 {
+		t.Fatalf("retried before the backoff: %+v", fake.sent)
+	}
+	now = t0.Add(22 * time.Minute)
+	s.tick(context.Background())
+	if len(fake.sent) != 1 || fake.sent[0].EventID != standup.ID || !fake.sent[0].FireAt.Equal(t0.Add(20*time.Minute)) {
+		t.Fatalf("sent = %+v", fake.sent)
+	}
+	if len(s.state.Pending) != 0 {
+		t.Errorf("still pending: %+v", s.state.Pending)
+	}
+	s.tick(context.Background())
+	if len(fake.sent) != 1 {
+		t.Errorf("sent twice: %+v", fake.sent)
+	}
+}
+
+func TestSchedulerSeriesAndCatchUp(t *testing.T) {
+	c := NewCalendar()
+	t0 := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	c.Create(Event{UserID: 1, Text: "Daily", Start: t0.Add(time.Hour), RRule: "FREQ=DAILY", Reminders: []Reminder{{MinutesBefore: 5}}})
+	now := t0
+	fake := &fakeNotifier{}
+	s := NewScheduler(c, map[string]Notifier{"log": fake})
+	s.now = func() time.Time { return now }
+	s.tick(context.Background())
+
+	// Down for two days: only the reminders of the last day are sent.
+	now = t0.Add(49 * time.Hour)
+	s.tick(context.Background())
+	if len(fake.sent) != 1 || !fake.sent[0].Start.Equal(t0.Add(49*time.Hour)) {
+		t.Fatalf("sent = %+v", fake.sent)
+	}
+	now = now.Add(24 * time.Hour)
+	s.tick(context.Background())
+	if len(fake.sent) != 2 || fake.sent[0].Key == fake.sent[1].Key {
+		t.Errorf("occurrences sent = %+v", fake.sent)
+	}
+}
+
+func TestSchedulerStops(t *testing.T) {
+	s := NewScheduler(NewCalendar(), map[string]Notifier{"log": logNotifier{}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return after cancel")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Notification
+	var key string
+	status := http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		key = r.Header.Get("Idempotency-Key")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	wh := webhookNotifier{URL: srv.URL}
+	n := Notification{Key: "abc/1/10", EventID: "abc", UserID: 1, Text: "Standup"}
+	if err := wh.Notify(context.Background(), n); err == nil {
+		t.Error("500 counted as delivered")
+	}
+	status = http.StatusNoContent
+	if err := wh.Notify(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	if got.EventID != "abc" || key != n.Key {
+		t.Errorf("got %+v with key %q", got, key)
+	}
+}
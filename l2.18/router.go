@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// route describes one method on one path. The fields other than handler
+// feed the OpenAPI document, so every endpoint is documented by the same
+// table that registers it.
+type route struct {
+	method  string
+	pattern string
+	summary string
+	query   []queryParam
+	// body and response are zero values of the JSON types exchanged;
+	// nil means no body.
+	body     any
+	response any
+	status   int
+	handler  http.HandlerFunc
+}
+
+type queryParam struct {
+	name, description string
+	required          bool
+}
+
+// router registers routes on a ServeMux, one mux pattern per path, and
+// answers unknown methods with 405 and an Allow header.
+type router struct {
+	mux    *http.ServeMux
+	routes []route
+	paths  map[string]map[string]http.HandlerFunc
+	order  []string
+	// methodNotAllowed writes the 405 body in the style of the path's API.
+	methodNotAllowed map[string]func(w http.ResponseWriter, allow string)
+}
+
+func newRouter() *router {
+	return &router{
+		mux:              http.NewServeMux(),
+		paths:            make(map[string]map[string]http.HandlerFunc),
+		methodNotAllowed: make(map[string]func(http.ResponseWriter, string)),
+	}
+}
+
+func (rt *router) handle(r route, notAllowed func(http.ResponseWriter, string)) {
+	methods, ok := rt.paths[r.pattern]
+	if !ok {
+		methods = make(map[string]http.HandlerFunc)
+		rt.paths[r.pattern] = methods
+		rt.order = append(rt.order, r.pattern)
+		rt.methodNotAllowed[r.pattern] = notAllowed
+		pattern := r.pattern
+		rt.mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+			rt.dispatch(pattern, w, req)
+		})
+	}
+	methods[r.method] = logRequest(r.handler)
+	rt.routes = append(rt.routes, r)
+}
+
+func (rt *router) dispatch(pattern string, w http.ResponseWriter, r *http.Request) {
+	methods := rt.paths[pattern]
+	if h, ok := methods[r.Method]; ok {
+		h(w, r)
+		return
+	}
+	if h, ok := methods[http.MethodGet]; ok && r.Method == http.MethodHead {
+		h(w, r)
+		return
+	}
+	allow := make([]string, 0, len(methods)+1)
+	for m := range methods {
+		allow = append(allow, m)
+	}
+	// HEAD is served through GET, as above.
+	if _, ok := methods[http.MethodGet]; ok {
+		if _, ok := methods[http.MethodHead]; !ok {
+			allow = append(allow, http.MethodHead)
+		}
+	}
+	sort.Strings(allow)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	rt.methodNotAllowed[pattern](w, strings.Join(allow, ", "))
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RRule is the subset of an RFC 5545 recurrence rule the calendar
+// understands: FREQ, INTERVAL, BYDAY, BYMONTHDAY, BYMONTH, COUNT and
+// UNTIL. Weeks start on Monday.
+type RRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []weekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+	Count      int
+	Until      time.Time
+	// untilLocal marks an UNTIL without a Z, a date or floating time that
+	// is compared with the series' wall clock rather than in UTC.
+	untilLocal bool
+}
+
+// weekdayNum is a BYDAY entry such as MO or -1FR. N is zero when every
+// such weekday of the period matches.
+type weekdayNum struct {
+	N   int
+	Day time.Weekday
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// maxOccurrences stops runaway expansion of rules that can never match,
+// such as BYMONTHDAY=31;BYMONTH=2.
+const maxOccurrences = 100000
+
+func ParseRRule(s string) (*RRule, error) {
+	r := &RRule{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(s), "RRULE:"), ";") {
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("часть правила %q без значения", part)
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+			if err == nil && r.Interval < 1 {
+				err = fmt.Errorf("INTERVAL должен быть положительным")
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+			if err == nil && r.Count < 1 {
+				err = fmt.Errorf("COUNT должен быть положительным")
+			}
+		case "UNTIL":
+			r.Until, err = parseICalTime(value)
+			r.untilLocal = !strings.HasSuffix(value, "Z")
+			if len(value) == len("20060102") {
+				// A date includes the whole day.
+				r.Until = r.Until.Add(24*time.Hour - time.Second)
+			}
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				wd, perr := parseWeekdayNum(v)
+				if perr != nil {
+					err = perr
+					break
+				}
+				r.ByDay = append(r.ByDay, wd)
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				n, perr := strconv.Atoi(v)
+				if perr != nil || n == 0 || n < -31 || n > 31 {
+					err = fmt.Errorf("некорректный BYMONTHDAY %q", v)
+					break
+				}
+				r.ByMonthDay = append(r.ByMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				n, perr := strconv.Atoi(v)
+				if perr != nil || n < 1 || n > 12 {
+					err = fmt.Errorf("некорректный BYMONTH %q", v)
+					break
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(n))
+			}
+		case "WKST":
+			if strings.ToUpper(value) != "MO" {
+				err = fmt.Errorf("поддерживается только WKST=MO")
+			}
+		default:
+			err = fmt.Errorf("не поддерживается")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	switch r.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	case "":
+		return nil, fmt.Errorf("не указан FREQ")
+	default:
+		return nil, fmt.Errorf("FREQ=%s не поддерживается", r.Freq)
+	}
+	if r.Count > 0 && !r.Until.IsZero() {
+		return nil, fmt.Errorf("COUNT и UNTIL нельзя указывать вместе")
+	}
+	for _, wd := range r.ByDay {
+		if wd.N != 0 && r.Freq != "MONTHLY" && r.Freq != "YEARLY" {
+			return nil, fmt.Errorf("BYDAY с номером допустим только для MONTHLY и YEARLY")
+		}
+	}
+	return r, nil
+}
+
+func parseWeekdayNum(s string) (weekdayNum, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) < 2 {
+		return weekdayNum{}, fmt.Errorf("некорректный BYDAY %q", s)
+	}
+	day, ok := weekdayCodes[s[len(s)-2:]]
+	if !ok {
+		return weekdayNum{}, fmt.Errorf("некорректный BYDAY %q", s)
+	}
+	wd := weekdayNum{Day: day}
+	if num := s[:len(s)-2]; num != "" {
+		n, err := strconv.Atoi(num)
+		if err != nil || n == 0 || n < -53 || n > 53 {
+			return weekdayNum{}, fmt.Errorf("некорректный BYDAY %q", s)
+		}
+		wd.N = n
+	}
+	return wd, nil
+}
+
+func (r *RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, wd := range r.ByDay {
+			code := ""
+			for c, d := range weekdayCodes {
+				if d == wd.Day {
+					code = c
+				}
+			}
+			if wd.N != 0 {
+				code = strconv.Itoa(wd.N) + code
+			}
+			days = append(days, code)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, d := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(d))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonth) > 0 {
+		var months []string
+		for _, m := range r.ByMonth {
+			months = append(months, strconv.Itoa(int(m)))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	switch {
+	case r.Until.IsZero():
+	case r.untilLocal:
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102T150405"))
+	default:
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Occurrences calls fn with the start of every occurrence of a series
+// beginning at dtstart, in order, until fn returns false or the series
+// ends. Starts keep dtstart's wall clock time in its location, so a 9:00
+// meeting stays at 9:00 across DST changes.
+func (r *RRule) Occurrences(dtstart time.Time, fn func(time.Time) bool) {
+	r.occurrences(dtstart, time.Time{}, fn)
+}
+
+// occurrences is Occurrences starting at the period containing notBefore
+// when the rule has no COUNT, since then earlier periods can't affect
+// the result.
+func (r *RRule) occurrences(dtstart, notBefore time.Time, fn func(time.Time) bool) {
+	loc := dtstart.Location()
+	hh, mm, ss := dtstart.Clock()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hh, mm, ss, 0, loc)
+	}
+
+	skip := 0
+	if r.Count == 0 && notBefore.After(dtstart) {
+		skip = r.periodsBetween(dtstart, notBefore.In(loc)) / r.Interval
+		if skip > 0 {
+			skip--
+		}
+	}
+
+	count, emitted := 0, 0
+	for period := skip * r.Interval; emitted < maxOccurrences; period += r.Interval {
+		var days []time.Time
+		switch r.Freq {
+		case "DAILY":
+			d := dtstart.AddDate(0, 0, period)
+			days = []time.Time{at(d.Year(), d.Month(), d.Day())}
+		case "WEEKLY":
+			days = r.weekDays(dtstart, period, at)
+		case "MONTHLY":
+			first := time.Date(dtstart.Year(), dtstart.Month()+time.Month(period), 1, 0, 0, 0, 0, loc)
+			days = r.monthDays(dtstart, first.Year(), first.Month(), at)
+		case "YEARLY":
+			days = r.yearDays(dtstart, dtstart.Year()+period, at)
+		}
+		sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+		for _, d := range days {
+			if d.Before(dtstart) || !r.monthAllowed(d.Month()) || !r.dayAllowed(d) {
+				continue
+			}
+			if r.pastUntil(d) {
+				return
+			}
+			count++
+			emitted++
+			if !fn(d) {
+				return
+			}
+			if r.Count > 0 && count >= r.Count {
+				return
+			}
+		}
+		emitted++
+	}
+}
+
+func (r *RRule) pastUntil(d time.Time) bool {
+	if r.Until.IsZero() {
+		return false
+	}
+	if r.untilLocal {
+		hh, mm, ss := d.Clock()
+		d = time.Date(d.Year(), d.Month(), d.Day(), hh, mm, ss, 0, time.UTC)
+	}
+	return d.After(r.Until)
+}
+
+func (r *RRule) periodsBetween(a, b time.Time) int {
+	switch r.Freq {
+	case "DAILY":
+		return int(b.Sub(a).Hours() / 24)
+	case "WEEKLY":
+		return int(b.Sub(a).Hours() / (24 * 7))
+	case "MONTHLY":
+		return (b.Year()-a.Year())*12 + int(b.Month()-a.Month())
+	default:
+		return b.Year() - a.Year()
+	}
+}
+
+func (r *RRule) weekDays(dtstart time.Time, period int, at func(int, time.Month, int) time.Time) []time.Time {
+	// Monday of dtstart's week, then period weeks on.
+	offset := (int(dtstart.Weekday()) + 6) % 7
+	monday := dtstart.AddDate(0, 0, period*7-offset)
+	if len(r.ByDay) == 0 {
+		d := monday.AddDate(0, 0, offset)
+		return []time.Time{at(d.Year(), d.Month(), d.Day())}
+	}
+	var days []time.Time
+	for _, wd := range r.ByDay {
+		d := monday.AddDate(0, 0, (int(wd.Day)+6)%7)
+		days = append(days, at(d.Year(), d.Month(), d.Day()))
+	}
+	return days
+}
+
+// monthDays expands BYMONTHDAY and BYDAY within one month; with neither,
+// the month day of dtstart, skipping months too short for it.
+func (r *RRule) monthDays(dtstart time.Time, y int, m time.Month, at func(int, time.Month, int) time.Time) []time.Time {
+	last := time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	var days []time.Time
+	switch {
+	case len(r.ByMonthDay) > 0:
+		for _, md := range r.ByMonthDay {
+			if md < 0 {
+				md = last + md + 1
+			}
+			if md >= 1 && md <= last {
+				days = append(days, at(y, m, md))
+			}
+		}
+	case len(r.ByDay) > 0:
+		days = byDayInRange(r.ByDay, y, m, 1, last, at)
+	default:
+		if d := dtstart.Day(); d <= last {
+			days = append(days, at(y, m, d))
+		}
+	}
+	return days
+}
+
+func (r *RRule) yearDays(dtstart time.Time, y int, at func(int, time.Month, int) time.Time) []time.Time {
+	if len(r.ByMonth) == 0 && len(r.ByDay) > 0 && len(r.ByMonthDay) == 0 {
+		// Ordinals count weeks of the whole year: 20MO is the 20th Monday.
+		jan1 := time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+		return byDayInRange(r.ByDay, y, time.January, 1, jan1.AddDate(1, 0, -1).YearDay(), at)
+	}
+	months := r.ByMonth
+	if len(months) == 0 {
+		months = []time.Month{dtstart.Month()}
+	}
+	var days []time.Time
+	for _, m := range months {
+		days = append(days, r.monthDays(dtstart, y, m, at)...)
+	}
+	return days
+}
+
+// byDayInRange resolves BYDAY entries over days first..last counted from
+// the first of month m; last may run past the month to cover a year.
+func byDayInRange(byDay []weekdayNum, y int, m time.Month, first, last int, at func(int, time.Month, int) time.Time) []time.Time {
+	var days []time.Time
+	for _, wd := range byDay {
+		var matches []int
+		for d := first; d <= last; d++ {
+			if time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Weekday() == wd.Day {
+				matches = append(matches, d)
+			}
+		}
+		switch {
+		case wd.N == 0:
+			for _, d := range matches {
+				days = append(days, at(y, m, d))
+			}
+		case wd.N > 0 && wd.N <= len(matches):
+			days = append(days, at(y, m, matches[wd.N-1]))
+		case wd.N < 0 && -wd.N <= len(matches):
+			days = append(days, at(y, m, matches[len(matches)+wd.N]))
+		}
+	}
+	return days
+}
+
+func (r *RRule) monthAllowed(m time.Month) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, bm := range r.ByMonth {
+		if bm == m {
+			return true
+		}
+	}
+	return false
+}
+
+// dayAllowed applies BYDAY and BYMONTHDAY as filters where they don't
+// expand: BYDAY for DAILY, BYMONTHDAY for DAILY and WEEKLY, and BYDAY
+// alongside BYMONTHDAY.
+func (r *RRule) dayAllowed(d time.Time) bool {
+	if len(r.ByDay) > 0 && (r.Freq == "DAILY" || len(r.ByMonthDay) > 0) {
+		ok := false
+		for _, wd := range r.ByDay {
+			if wd.Day == d.Weekday() {
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.ByMonthDay) > 0 && (r.Freq == "DAILY" || r.Freq == "WEEKLY") {
+		last := time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+		for _, md := range r.ByMonthDay {
+			if md == d.Day() || last+md+1 == d.Day() {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// parseICalTime reads an RFC 5545 DATE or DATE-TIME value, UTC when it
+// ends in Z and otherwise floating, which is taken as UTC here.
+func parseICalTime(s string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("некорректное время %q", s)
+}
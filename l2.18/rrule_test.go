@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func starts(t *testing.T, rule string, dtstart time.Time, n int) []string {
+	t.Helper()
+	r, err := ParseRRule(rule)
+	if err != nil {
+		t.Fatalf("ParseRRule(%q) error = %v", rule, err)
+	}
+	var got []string
+	r.Occurrences(dtstart, func(d time.Time) bool {
+		got = append(got, d.Format("2006-01-02 15:04"))
+		return len(got) < n
+	})
+	return got
+}
+
+func TestRRuleOccurrences(t *testing.T) {
+	// A Wednesday.
+	start := time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rule string
+		want []string
+	}{
+		{"FREQ=WEEKLY;BYDAY=MO", []string{"2024-01-08 09:00", "2024-01-15 09:00", "2024-01-22 09:00"}},
+		{"FREQ=MONTHLY;BYDAY=-1FR", []string{"2024-01-26 09:00", "2024-02-23 09:00", "2024-03-29 09:00"}},
+		{"FREQ=DAILY;INTERVAL=2;COUNT=2", []string{"2024-01-03 09:00", "2024-01-05 09:00"}},
+		{"FREQ=WEEKLY;UNTIL=20240117", []string{"2024-01-03 09:00", "2024-01-10 09:00", "2024-01-17 09:00"}},
+		{"FREQ=MONTHLY;BYMONTHDAY=31", []string{"2024-01-31 09:00", "2024-03-31 09:00", "2024-05-31 09:00"}},
+		{"FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=29", []string{"2024-02-29 09:00", "2028-02-29 09:00", "2032-02-29 09:00"}},
+	}
+	for _, tt := range tests {
+		got := starts(t, tt.rule, start, 3)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.rule, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.rule, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRRuleInvalid(t *testing.T) {
+	for _, rule := range []string{"", "FREQ=HOURLY", "FREQ=WEEKLY;BYDAY=1MO", "FREQ=DAILY;COUNT=2;UNTIL=20240101", "FREQ=DAILY;BYSETPOS=1"} {
+		if _, err := ParseRRule(rule); err == nil {
+			t.Errorf("ParseRRule(%q): expected an error", rule)
+		}
+	}
+}
+
+func TestRecurringEventKeepsWallClockAcrossDST(t *testing.T) {
+	c := NewCalendar()
+	ny, _ := time.LoadLocation("America/New_York")
+	_, err := c.Create(Event{UserID: 1, Text: "Standup", TimeZone: "America/New_York", RRule: "FREQ=DAILY",
+		Start: time.Date(2024, 3, 8, 9, 0, 0, 0, ny)})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	from, to := dayWindow(time.Date(2024, 3, 8, 0, 0, 0, 0, ny), 5, ny)
+	evts := c.EventsBetween(1, from, to)
+	if len(evts) != 5 {
+		t.Fatalf("expected 5 occurrences, got %d", len(evts))
+	}
+	for _, e := range evts {
+		if h := e.Start.In(ny).Hour(); h != 9 {
+			t.Errorf("occurrence %v starts at %d:00 in New York, want 9:00", e.Start, h)
+		}
+		if e.RecurrenceID == nil || e.End.Sub(e.Start) != time.Hour {
+			t.Errorf("occurrence %+v: expected a recurrence ID and an hour long", e)
+		}
+	}
+}
+
+func TestRecurringEventExceptions(t *testing.T) {
+	c := NewCalendar()
+	monday := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	e, err := c.Create(Event{UserID: 1, Text: "Planning", RRule: "FREQ=WEEKLY;BYDAY=MO;COUNT=4", Start: monday,
+		ExDates: []time.Time{monday.AddDate(0, 0, 7)}})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	third := monday.AddDate(0, 0, 14)
+	if _, err := c.OverrideOccurrence(e.ID, third, Override{Start: third.Add(2 * time.Hour), Text: "Planning, moved"}); err != nil {
+		t.Fatalf("OverrideOccurrence() error = %v", err)
+	}
+	if _, err := c.OverrideOccurrence(e.ID, third.Add(time.Hour), Override{Text: "x"}); !errors.Is(err, errNotFound) {
+		t.Errorf("expected errNotFound for a time that isn't an occurrence, got %v", err)
+	}
+
+	evts := c.EventsForMonth(2024, time.January)
+	// The cancelled second Monday doesn't move COUNT on to a fifth one.
+	if len(evts) != 3 {
+		t.Fatalf("expected 3 occurrences, got %v", evts)
+	}
+	moved := evts[1]
+	if moved.Text != "Planning, moved" || moved.Start.Hour() != 12 || !moved.RecurrenceID.Equal(third) {
+		t.Errorf("expected the override on January 15, got %+v", moved)
+	}
+
+	if _, err := c.CancelOccurrence(e.ID, third); err != nil {
+		t.Fatalf("CancelOccurrence() error = %v", err)
+	}
+	if evts := c.EventsForMonth(2024, time.January); len(evts) != 2 {
+		t.Errorf("expected the override to be cancelled too, got %v", evts)
+	}
+}
+
+func TestInfiniteSeriesFarAhead(t *testing.T) {
+	c := NewCalendar()
+	c.Create(Event{UserID: 1, Text: "Payday", AllDay: true, RRule: "FREQ=MONTHLY;BYMONTHDAY=-1",
+		Start: time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC)})
+	evts := c.EventsForMonth(2100, time.February)
+	if len(evts) != 1 || evts[0].Start.Day() != 28 {
+		t.Errorf("expected the last day of February 2100, got %v", evts)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxTags      = 20
+	maxTagLength = 50
+)
+
+// searchIndex finds events by the words of their text and by tag without
+// reading the store. Every stored event, series included, has an entry in
+// starts, which keeps them ordered for pagination.
+type searchIndex struct {
+	docs map[string]searchDoc
+	// terms maps a word to the IDs of the events containing it; vocab is
+	// its keys sorted, so a word typed in part finds all it begins.
+	terms map[string]map[string]bool
+	vocab []string
+	tags  map[string]map[string]bool
+	// starts is ordered by start, then ID.
+	starts []searchEntry
+}
+
+type searchDoc struct {
+	start time.Time
+	terms []string
+	tags  []string
+}
+
+type searchEntry struct {
+	start time.Time
+	id    string
+}
+
+func (a searchEntry) less(b searchEntry) bool {
+	if !a.start.Equal(b.start) {
+		return a.start.Before(b.start)
+	}
+	return a.id < b.id
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:  make(map[string]searchDoc),
+		terms: make(map[string]map[string]bool),
+		tags:  make(map[string]map[string]bool),
+	}
+}
+
+// tokenize splits s into lowercase words of letters and digits. Ё is
+// folded into е, as Russian text is written with either.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = strings.ReplaceAll(w, "ё", "е")
+	}
+	return words
+}
+
+func tagKey(tag string) string {
+	return strings.ReplaceAll(strings.ToLower(tag), "ё", "е")
+}
+
+// normalizeTags trims the tags of e and drops empty ones and repeats,
+// which differ only in case, keeping their order.
+func normalizeTags(e *Event) error {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range e.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tagKey(tag)] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return fmt.Errorf("%w: тег длиннее %d символов", errInvalidEvent, maxTagLength)
+		}
+		seen[tagKey(tag)] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("%w: больше %d тегов", errInvalidEvent, maxTags)
+	}
+	e.Tags = tags
+	return nil
+}
+
+// add indexes e, replacing what was indexed under its ID.
+func (s *searchIndex) add(e Event) {
+	s.remove(e.ID)
+	words := tokenize(e.Text)
+	for _, o := range e.Overrides {
+		words = append(words, tokenize(o.Text)...)
+	}
+	doc := searchDoc{start: e.Start}
+	seen := make(map[string]bool)
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			doc.terms = append(doc.terms, w)
+			link(s.terms, &s.vocab, w, e.ID)
+		}
+	}
+	for _, tag := range e.Tags {
+		doc.tags = append(doc.tags, tagKey(tag))
+		link(s.tags, nil, tagKey(tag), e.ID)
+	}
+	s.docs[e.ID] = doc
+
+	entry := searchEntry{e.Start, e.ID}
+	i := sort.Search(len(s.starts), func(i int) bool { return entry.less(s.starts[i]) })
+	s.starts = append(s.starts, searchEntry{})
+	copy(s.starts[i+1:], s.starts[i:])
+	s.starts[i] = entry
+}
+
+func (s *searchIndex) remove(id string) {
+	doc, ok := s.docs[id]
+	if !ok {
+		return
+	}
+	delete(s.docs, id)
+	for _, w := range doc.terms {
+		unlink(s.terms, &s.vocab, w, id)
+	}
+	for _, tag := range doc.tags {
+		unlink(s.tags, nil, tag, id)
+	}
+	entry := searchEntry{doc.start, id}
+	i := sort.Search(len(s.starts), func(i int) bool { return !s.starts[i].less(entry) })
+	if i < len(s.starts) && s.starts[i].id == id {
+		s.starts = append(s.starts[:i], s.starts[i+1:]...)
+	}
+}
+
+// link adds id under key of index, and key to vocab, if given, when it
+// is new.
+func link(index map[string]map[string]bool, vocab *[]string, key, id string) {
+	ids, ok := index[key]
+	if !ok {
+		ids = make(map[string]bool)
+		index[key] = ids
+		if vocab != nil {
+			i := sort.SearchStrings(*vocab, key)
+			*vocab = append(*vocab, "")
+			copy((*vocab)[i+1:], (*vocab)[i:])
+			(*vocab)[i] = key
+		}
+	}
+	ids[id] = true
+}
+
+func unlink(index map[string]map[string]bool, vocab *[]string, key, id string) {
+	ids := index[key]
+	delete(ids, id)
+	if len(ids) > 0 {
+		return
+	}
+	delete(index, key)
+	if vocab != nil {
+		i := sort.SearchStrings(*vocab, key)
+		*vocab = append((*vocab)[:i], (*vocab)[i+1:]...)
+	}
+}
+
+// prefixed returns the IDs of events with a word beginning with prefix.
+func (s *searchIndex) prefixed(prefix string) map[string]bool {
+	ids := make(map[string]bool)
+	for i := sort.SearchStrings(s.vocab, prefix); i < len(s.vocab) && strings.HasPrefix(s.vocab[i], prefix); i++ {
+		for id := range s.terms[s.vocab[i]] {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// candidates returns the entries of the events having every word of text,
+// each as a word or the beginning of one, and every tag, ordered as
+// starts. At least one word or tag must be given.
+func (s *searchIndex) candidates(text string, tags []string) []searchEntry {
+	var sets []map[string]bool
+	for _, w := range tokenize(text) {
+		sets = append(sets, s.prefixed(w))
+	}
+	for _, tag := range tags {
+		sets = append(sets, s.tags[tagKey(tag)])
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	var entries []searchEntry
+next:
+	for id := range sets[0] {
+		for _, set := range sets[1:] {
+			if !set[id] {
+				continue next
+			}
+		}
+		entries = append(entries, searchEntry{s.docs[id].start, id})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+	return entries
+}
+
+// SearchQuery selects events for Search. Zero values don't restrict: a
+// zero UserID means every owner, a zero Viewer every event whoever may
+// see it, zero From or To an open end.
+type SearchQuery struct {
+	// Text matches events having each of its words, typed in full or in
+	// part from the beginning, in their text or that of an occurrence.
+	Text string
+	// Tags matches events having all of them, whatever the case.
+	Tags   []string
+	UserID int
+	// Viewer keeps the events in the user's agenda, see Agenda.
+	Viewer   int
+	From, To time.Time
+	// Descending orders by start from the latest.
+	Descending bool
+	// After continues the results past this position.
+	After *SearchPosition
+	Limit int
+}
+
+// SearchPosition is where a page of search results ended.
+type SearchPosition struct {
+	Start time.Time
+	ID    string
+}
+
+// farFuture closes open-ended search ranges.
+var farFuture = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Search returns up to q.Limit events matching q, series unexpanded,
+// ordered by start and ID, and whether there are more. A series is
+// within the range if any of its occurrences is.
+func (c *Calendar) Search(q SearchQuery) (events []Event, more bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	visible := func(Event) bool { return true }
+	if q.Viewer != 0 {
+		visible = c.visibleTo(q.Viewer)
+	}
+	to := q.To
+	if to.IsZero() {
+		to = farFuture
+	}
+
+	var entries []searchEntry
+	// Text without a word, like "!!", doesn't restrict the search.
+	if len(tokenize(q.Text)) > 0 || len(q.Tags) > 0 {
+		entries = c.search.candidates(q.Text, q.Tags)
+	} else {
+		entries = c.searchWindow(q.From, to)
+	}
+	i, step := 0, 1
+	if q.Descending {
+		i, step = len(entries)-1, -1
+	}
+	if q.After != nil {
+		after := searchEntry{q.After.Start, q.After.ID}
+		if q.Descending {
+			i = sort.Search(len(entries), func(i int) bool { return !entries[i].less(after) }) - 1
+		} else {
+			i = sort.Search(len(entries), func(i int) bool { return after.less(entries[i]) })
+		}
+	}
+
+	events = []Event{}
+	for ; i >= 0 && i < len(entries); i += step {
+		if !entries[i].start.Before(to) {
+			if q.Descending {
+				continue
+			}
+			break
+		}
+		_, j, evts, err := c.find(entries[i].id)
+		if err != nil {
+			continue
+		}
+		e := evts[j]
+		if q.UserID != 0 && e.UserID != q.UserID || !visible(e) || !overlaps(e, q.From, to) {
+			continue
+		}
+		if len(events) == q.Limit {
+			return events, true
+		}
+		events = append(events, e)
+	}
+	return events, false
+}
+
+// searchWindow returns, ordered as starts, the entries of the events that
+// may overlap [from, to): those starting before to but no earlier than
+// the longest event before from, as in between, and series starting
+// earlier still. The result may share starts, so it mustn't be modified.
+// Must be called with c.mu held.
+func (c *Calendar) searchWindow(from, to time.Time) []searchEntry {
+	starts := c.search.starts
+	hi := sort.Search(len(starts), func(i int) bool { return !starts[i].start.Before(to) })
+	if from.IsZero() {
+		return starts[:hi]
+	}
+	first := from.Add(-c.longest)
+	lo := sort.Search(hi, func(i int) bool { return !starts[i].start.Before(first) })
+	var entries []searchEntry
+	for id := range c.recurring {
+		if start := c.search.docs[id].start; start.Before(first) {
+			entries = append(entries, searchEntry{start, id})
+		}
+	}
+	if len(entries) == 0 {
+		return starts[lo:hi]
+	}
+	// The earlier series all come before starts[lo].
+	sort.Slice(entries, func(i, j int) bool { return entries[i].less(entries[j]) })
+	return append(entries, starts[lo:hi]...)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchEvents(t *testing.T) {
+	c := NewCalendar()
+	h := makeHandlers(c)
+	create := func(userID int, body string) Event {
+		rec := doRequest(t, h, http.MethodPost, fmt.Sprintf("/v2/users/%d/events", userID), body)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create: status %d, body %s", rec.Code, rec.Body)
+		}
+		var e Event
+		json.Unmarshal(rec.Body.Bytes(), &e)
+		return e
+	}
+	search := func(query string) searchResult {
+		t.Helper()
+		rec := doRequest(t, h, http.MethodGet, "/events?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("search %s: status %d, body %s", query, rec.Code, rec.Body)
+		}
+		var result searchResult
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return result
+	}
+	texts := func(events []Event) string {
+		var s []string
+		for _, e := range events {
+			s = append(s, e.Text)
+		}
+		return strings.Join(s, ", ")
+	}
+
+	create(1, `{"start":"2024-03-04T10:00:00Z","event":"Ёлка в офисе","tags":["Праздник","праздник "," "]}`)
+	create(1, `{"start":"2024-03-05T10:00:00Z","event":"Отчёт за квартал","tags":["работа"]}`)
+	standup := create(1, `{"start":"2024-03-01T09:00:00Z","event":"Стендап","rrule":"FREQ=WEEKLY","tags":["Работа"]}`)
+	create(2, `{"start":"2024-03-06T10:00:00Z","event":"Квартальный отчёт","tags":["работа"]}`)
+	gone := create(2, `{"start":"2024-03-07T10:00:00Z","event":"Отчёт удалён"}`)
+	doRequest(t, h, http.MethodDelete, "/v2/users/2/events/"+gone.ID, "")
+
+	tests := []struct {
+		query, want string
+	}{
+		{"", "Стендап, Ёлка в офисе, Отчёт за квартал, Квартальный отчёт"},
+		{"q=елка", "Ёлка в офисе"},
+		{"q=!!", "Стендап, Ёлка в офисе, Отчёт за квартал, Квартальный отчёт"},
+		{"q=%E2%80%94&from=2024-03-05&to=2024-03-05", "Отчёт за квартал"},
+		{"q=отч+кварт", "Отчёт за квартал, Квартальный отчёт"},
+		{"q=отчет&user=2", "Квартальный отчёт"},
+		{"tags=РАБОТА", "Стендап, Отчёт за квартал, Квартальный отчёт"},
+		{"tags=работа,праздник", ""},
+		{"tags=работа&sort=-start", "Квартальный отчёт, Отчёт за квартал, Стендап"},
+		// The weekly standup recurs within any week after it starts.
+		{"from=2024-04-08&to=2024-04-14", "Стендап"},
+		{"from=2024-03-05&to=2024-03-05", "Отчёт за квартал"},
+		{"from=2024-03-06&to=2024-03-08", "Стендап, Квартальный отчёт"},
+	}
+	for _, tt := range tests {
+		if got := texts(search(tt.query).Events); got != tt.want {
+			t.Errorf("search %q = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if result := search("q=елка"); len(result.Events[0].Tags) != 1 || result.Events[0].Tags[0] != "Праздник" {
+		t.Errorf("tags = %q", result.Events[0].Tags)
+	}
+
+	// Edits and overrides of occurrences are searchable at once.
+	doRequest(t, h, http.MethodPatch, "/v2/users/1/events/"+standup.ID, `{"event":"Планёрка"}`)
+	if got := texts(search("q=стендап").Events); got != "" {
+		t.Errorf("old text still found: %q", got)
+	}
+	c.OverrideOccurrence(standup.ID, standup.Start.AddDate(0, 0, 7), Override{Text: "Ретро"})
+	if got := texts(search("q=ретро").Events); got != "Планёрка" {
+		t.Errorf("override text: %q", got)
+	}
+
+	// Pages follow each other without gaps or repeats, in either order.
+	for _, order := range []string{"start", "-start"} {
+		var pages []string
+		cursor := ""
+		for range 5 {
+			result := search("limit=3&sort=" + order + "&cursor=" + cursor)
+			pages = append(pages, texts(result.Events))
+			if cursor = result.NextCursor; cursor == "" {
+				break
+			}
+		}
+		all := texts(search("sort=" + order).Events)
+		if len(pages) != 2 || strings.Join(pages, ", ") != all {
+			t.Errorf("sort=%s pages %q, want %q", order, pages, all)
+		}
+	}
+
+	for _, query := range []string{"cursor=nope", "sort=text", "limit=0", "from=03-01", "from=2024-03-02&to=2024-03-01", "user=x"} {
+		rec := doRequest(t, h, http.MethodGet, "/events?"+query, "")
+		var failed apiErrorBody
+		json.Unmarshal(rec.Body.Bytes(), &failed)
+		if rec.Code != http.StatusBadRequest || failed.Error.Code != "invalid_request" {
+			t.Errorf("%s: status %d, body %s", query, rec.Code, rec.Body)
+		}
+	}
+	if rec := doRequest(t, h, http.MethodPost, "/v2/users/1/events", `{"start":"2024-03-04T10:00:00Z","event":"x","tags":["`+strings.Repeat("a", maxTagLength+1)+`"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("long tag: status %d", rec.Code)
+	}
+}
+
+func TestSearchWindow(t *testing.T) {
+	c := NewCalendar()
+	day := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i := range 100 {
+		c.Create(Event{UserID: 1, Text: "Past", Start: day.AddDate(0, 0, -i-10)})
+	}
+	weekly, _ := c.Create(Event{UserID: 1, Text: "Weekly", Start: day.AddDate(0, 0, -364), RRule: "FREQ=WEEKLY"})
+	running, _ := c.Create(Event{UserID: 1, Text: "Trip", Start: day.AddDate(0, 0, -3), End: day.AddDate(0, 0, 3)})
+	today, _ := c.Create(Event{UserID: 1, Text: "Today", Start: day})
+
+	// Only the series and what may still be running are looked at, not
+	// the events long past.
+	c.mu.Lock()
+	entries := c.searchWindow(day, day.AddDate(0, 0, 1))
+	c.mu.Unlock()
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.id)
+	}
+	if want := []string{weekly.ID, running.ID, today.ID}; strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("window entries = %v, want %v", ids, want)
+	}
+	events, _ := c.Search(SearchQuery{From: day, To: day.AddDate(0, 0, 1), Limit: 10})
+	if len(events) != 3 {
+		t.Errorf("search in window = %+v", events)
+	}
+}
+
+func TestSearchTagsInICal(t *testing.T) {
+	e := Event{ID: "1", Start: time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC), End: time.Date(2024, 3, 4, 11, 0, 0, 0, time.UTC), Text: "Обед", Tags: []string{"еда, напитки", "личное"}}
+	var buf bytes.Buffer
+	if err := writeICS(&buf, "test", []Event{e}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `CATEGORIES:еда\, напитки,личное`) {
+		t.Fatalf("no categories in\n%s", buf.String())
+	}
+	events, _, err := decodeICS(&buf, time.UTC)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("decode: %v, %d events", err, len(events))
+	}
+	if got := strings.Join(events[0].Tags, "|"); got != "еда, напитки|личное" {
+		t.Errorf("tags = %q", got)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// normalizeSeries checks the recurrence rule of e and brings its
+// exceptions in line with normalize: all-day exceptions become local
+// midnights. Exceptions that aren't occurrences of the series, such as
+// those left behind when its start or rule changes, are dropped.
+func normalizeSeries(e *Event) error {
+	if e.RRule == "" {
+		if len(e.ExDates) > 0 || len(e.Overrides) > 0 {
+			return fmt.Errorf("%w: исключения бывают только у повторяющихся событий", errInvalidEvent)
+		}
+		return nil
+	}
+	rule, err := ParseRRule(e.RRule)
+	if err != nil {
+		return fmt.Errorf("%w: rrule: %v", errInvalidEvent, err)
+	}
+	e.RRule = rule.String()
+	loc := e.Start.Location()
+	local := func(t time.Time) time.Time {
+		if !e.AllDay || t.IsZero() {
+			return t.In(loc)
+		}
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+
+	var exDates []time.Time
+	seen := make(map[int64]bool)
+	for _, d := range e.ExDates {
+		d = local(d)
+		if !seen[d.Unix()] && isOccurrence(rule, e.Start, d) {
+			seen[d.Unix()] = true
+			exDates = append(exDates, d)
+		}
+	}
+	sort.Slice(exDates, func(i, j int) bool { return exDates[i].Before(exDates[j]) })
+	e.ExDates = exDates
+
+	var overrides []Override
+	for _, o := range e.Overrides {
+		o.RecurrenceID, o.Start, o.End = local(o.RecurrenceID), local(o.Start), local(o.End)
+		if seen[o.RecurrenceID.Unix()] || !isOccurrence(rule, e.Start, o.RecurrenceID) {
+			continue
+		}
+		seen[o.RecurrenceID.Unix()] = true
+		if occ := occurrence(*e, o.RecurrenceID, o); !occ.End.After(occ.Start) {
+			return fmt.Errorf("%w: окончание повторения должно быть позже начала", errInvalidEvent)
+		}
+		overrides = append(overrides, o)
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].RecurrenceID.Before(overrides[j].RecurrenceID) })
+	e.Overrides = overrides
+	return nil
+}
+
+// isOccurrence reports whether the series starting at dtstart has an
+// occurrence starting at t.
+func isOccurrence(rule *RRule, dtstart, t time.Time) bool {
+	found := false
+	rule.occurrences(dtstart, t, func(d time.Time) bool {
+		found = d.Equal(t)
+		return d.Before(t)
+	})
+	return found
+}
+
+// wholeDays is the length of an all-day event in days, rounded so that a
+// 23 or 25 hour DST day still counts as one.
+func wholeDays(d time.Duration) int {
+	return int((d + 12*time.Hour) / (24 * time.Hour))
+}
+
+// occurrence is the instance of series e starting at recurrenceID, with
+// the override o applied.
+func occurrence(e Event, recurrenceID time.Time, o Override) Event {
+	loc := eventLocation(e)
+	length := e.End.Sub(e.Start)
+	end := func(start time.Time) time.Time {
+		if e.AllDay {
+			return start.AddDate(0, 0, wholeDays(length))
+		}
+		return start.Add(length)
+	}
+
+	inst := e
+	inst.ExDates, inst.Overrides = nil, nil
+	inst.Start = recurrenceID.In(loc)
+	if !o.Start.IsZero() {
+		inst.Start = o.Start.In(loc)
+	}
+	inst.End = end(inst.Start)
+	if !o.End.IsZero() {
+		inst.End = o.End.In(loc)
+	}
+	if o.Text != "" {
+		inst.Text = o.Text
+	}
+	inst.Date = inst.Start
+	id := recurrenceID.In(loc)
+	inst.RecurrenceID = &id
+	return inst
+}
+
+// expand returns the occurrences of series e overlapping [from, to).
+func expand(e Event, from, to time.Time) []Event {
+	var result []Event
+	eachOccurrence(e, from, to, func(inst Event) bool {
+		result = append(result, inst)
+		return true
+	})
+	return result
+}
+
+// overlaps reports whether e, or any occurrence of it, overlaps [from, to).
+func overlaps(e Event, from, to time.Time) bool {
+	if e.RRule == "" {
+		return e.Start.Before(to) && e.End.After(from)
+	}
+	found := false
+	eachOccurrence(e, from, to, func(Event) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// eachOccurrence calls fn with the occurrences of series e overlapping
+// [from, to) until it returns false. Only the periods of the rule around
+// the window are generated, so series without an end cost no more than
+// bounded ones.
+func eachOccurrence(e Event, from, to time.Time, fn func(Event) bool) {
+	rule, err := ParseRRule(e.RRule)
+	if err != nil {
+		logger.Printf("событие %s: rrule: %v", e.ID, err)
+		return
+	}
+	skip := make(map[int64]bool)
+	for _, d := range e.ExDates {
+		skip[d.Unix()] = true
+	}
+	for _, o := range e.Overrides {
+		skip[o.RecurrenceID.Unix()] = true
+	}
+
+	for _, o := range e.Overrides {
+		if inst := occurrence(e, o.RecurrenceID, o); inst.Start.Before(to) && inst.End.After(from) {
+			if !fn(inst) {
+				return
+			}
+		}
+	}
+	// COUNT is applied before exceptions: cancelling an occurrence doesn't
+	// add one at the end.
+	rule.occurrences(e.Start.In(eventLocation(e)), from.Add(-e.End.Sub(e.Start)), func(d time.Time) bool {
+		if !d.Before(to) {
+			return false
+		}
+		if skip[d.Unix()] {
+			return true
+		}
+		if inst := occurrence(e, d, Override{}); inst.End.After(from) {
+			return fn(inst)
+		}
+		return true
+	})
+}
+
+// OverrideOccurrence replaces the occurrence of series id starting at
+// recurrenceID with o and returns the updated series.
+func (c *Calendar) OverrideOccurrence(id string, recurrenceID time.Time, o Override) (Event, error) {
+	return c.updateSeries(id, recurrenceID, func(e *Event, rid time.Time) {
+		o.RecurrenceID = rid
+		e.Overrides = append(withoutOverride(e.Overrides, rid), o)
+	})
+}
+
+// CancelOccurrence removes the occurrence of series id starting at
+// recurrenceID, dropping its override if it had one.
+func (c *Calendar) CancelOccurrence(id string, recurrenceID time.Time) (Event, error) {
+	return c.updateSeries(id, recurrenceID, func(e *Event, rid time.Time) {
+		e.Overrides = withoutOverride(e.Overrides, rid)
+		e.ExDates = append(e.ExDates, rid)
+	})
+}
+
+func withoutOverride(overrides []Override, rid time.Time) []Override {
+	var kept []Override
+	for _, o := range overrides {
+		if !o.RecurrenceID.Equal(rid) {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+func (c *Calendar) updateSeries(id string, recurrenceID time.Time, change func(e *Event, rid time.Time)) (Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, i, evts, err := c.find(id)
+	if err != nil {
+		return Event{}, err
+	}
+	e := evts[i]
+	if e.RRule == "" {
+		return Event{}, fmt.Errorf("%w: событие не повторяется", errInvalidEvent)
+	}
+	rule, err := ParseRRule(e.RRule)
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: rrule: %v", errInvalidEvent, err)
+	}
+	loc := eventLocation(e)
+	e.Start, e.End = e.Start.In(loc), e.End.In(loc)
+	rid := recurrenceID.In(loc)
+	if e.AllDay {
+		y, m, d := recurrenceID.Date()
+		rid = time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+	if !isOccurrence(rule, e.Start, rid) {
+		return Event{}, fmt.Errorf("%w: у события нет повторения %s", errNotFound, rid.Format(time.RFC3339))
+	}
+
+	// The slices are shared with the store's copy.
+	e.ExDates = append([]time.Time(nil), e.ExDates...)
+	e.Overrides = append([]Override(nil), e.Overrides...)
+	change(&e, rid)
+	if err := normalizeSeries(&e); err != nil {
+		return Event{}, err
+	}
+	if err := c.checkOverlaps(e, &evts[i], false); err != nil {
+		return Event{}, err
+	}
+	e.Version++
+	if e.Seq, err = c.recordChange(e.UserID, resourceUID(e), false); err != nil {
+		return Event{}, err
+	}
+	evts[i] = e
+	if err := c.put(map[string][]Event{key: evts}); err != nil {
+		return Event{}, err
+	}
+	c.index(e, key)
+	c.publish(e.UserID, eventChange(e))
+	return e, nil
+}
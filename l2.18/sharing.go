@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CalendarInfo is one of a user's named calendars. Every user has a
+// default calendar, with the ID "default", holding the events without a
+// CalendarID; it is only stored once changed or shared. An
+// OverlapPolicy limits overlaps to within the calendar, as for a room
+// that can only be booked once at a time, and takes precedence over the
+// owner's.
+type CalendarInfo struct {
+	ID            string  `json:"id"`
+	UserID        int     `json:"user_id"`
+	Name          string  `json:"name"`
+	OverlapPolicy string  `json:"overlap_policy,omitempty"`
+	Shares        []Share `json:"shares,omitempty"`
+}
+
+// Share gives another user read or write access to a calendar.
+type Share struct {
+	UserID int    `json:"user_id"`
+	Access string `json:"access"`
+}
+
+// Attendee is a user invited to an event and their answer.
+type Attendee struct {
+	UserID int    `json:"user_id"`
+	Status string `json:"status"`
+}
+
+const (
+	defaultCalendarID   = "default"
+	defaultCalendarName = "Основной"
+
+	accessRead  = "read"
+	accessWrite = "write"
+
+	statusNeedsAction = "needs-action"
+	statusAccepted    = "accepted"
+	statusDeclined    = "declined"
+	statusTentative   = "tentative"
+)
+
+var attendeeStatuses = map[string]bool{statusNeedsAction: true, statusAccepted: true, statusDeclined: true, statusTentative: true}
+
+// calendarsKey holds every user's calendars in one document, so a user's
+// shared calendars are found without a reverse index.
+const calendarsKey = "calendars"
+
+// loadCalendars must be called with c.mu held.
+func (c *Calendar) loadCalendars() {
+	c.calendars = make(map[int][]CalendarInfo)
+	raw := c.store.Meta(calendarsKey)
+	if raw == nil {
+		return
+	}
+	var byUser map[string][]CalendarInfo
+	if err := json.Unmarshal(raw, &byUser); err != nil {
+		logger.Printf("не удалось прочитать календари: %v", err)
+		return
+	}
+	for user, cals := range byUser {
+		if userID, err := strconv.Atoi(user); err == nil {
+			c.calendars[userID] = cals
+		}
+	}
+}
+
+// putCalendars stores cals as the calendars of userID. Must be called
+// with c.mu held.
+func (c *Calendar) putCalendars(userID int, cals []CalendarInfo) error {
+	byUser := make(map[string][]CalendarInfo, len(c.calendars)+1)
+	for user, cs := range c.calendars {
+		byUser[strconv.Itoa(user)] = cs
+	}
+	if len(cals) == 0 {
+		delete(byUser, strconv.Itoa(userID))
+	} else {
+		byUser[strconv.Itoa(userID)] = cals
+	}
+	raw, _ := json.Marshal(byUser)
+	if err := c.store.PutMeta(calendarsKey, raw); err != nil {
+		return fmt.Errorf("%w: %v", errStorage, err)
+	}
+	if len(cals) == 0 {
+		delete(c.calendars, userID)
+	} else {
+		c.calendars[userID] = cals
+	}
+	return nil
+}
+
+// calendarOf is the ID of the calendar e is in.
+func calendarOf(e Event) string {
+	if e.CalendarID == "" {
+		return defaultCalendarID
+	}
+	return e.CalendarID
+}
+
+// calendarsOf returns the calendars of userID, the default one first.
+// Must be called with c.mu held.
+func (c *Calendar) calendarsOf(userID int) []CalendarInfo {
+	stored := c.calendars[userID]
+	result := make([]CalendarInfo, 0, len(stored)+1)
+	if i := findCalendar(stored, defaultCalendarID); i >= 0 {
+		result = append(result, stored[i])
+	} else {
+		result = append(result, CalendarInfo{ID: defaultCalendarID, UserID: userID, Name: defaultCalendarName})
+	}
+	for _, cal := range stored {
+		if cal.ID != defaultCalendarID {
+			result = append(result, cal)
+		}
+	}
+	return result
+}
+
+func findCalendar(cals []CalendarInfo, id string) int {
+	for i, cal := range cals {
+		if cal.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Calendars returns the calendars of userID and those others share with
+// them. The shares of the latter are limited to userID's own.
+func (c *Calendar) Calendars(userID int) (own, shared []CalendarInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	own = c.calendarsOf(userID)
+	shared = []CalendarInfo{}
+	for owner, cals := range c.calendars {
+		if owner == userID {
+			continue
+		}
+		for _, cal := range cals {
+			for _, s := range cal.Shares {
+				if s.UserID == userID {
+					cal.Shares = []Share{s}
+					shared = append(shared, cal)
+				}
+			}
+		}
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		if shared[i].UserID != shared[j].UserID {
+			return shared[i].UserID < shared[j].UserID
+		}
+		return shared[i].Name < shared[j].Name
+	})
+	return own, shared
+}
+
+// CreateCalendar adds a calendar named name to userID's.
+func (c *Calendar) CreateCalendar(userID int, name, policy string) (CalendarInfo, error) {
+	name = strings.TrimSpace(name)
+	if userID <= 0 || name == "" {
+		return CalendarInfo{}, fmt.Errorf("%w: не указано название календаря", errInvalidEvent)
+	}
+	if err := checkPolicy(policy); err != nil {
+		return CalendarInfo{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cal := CalendarInfo{ID: newEventID(), UserID: userID, Name: name, OverlapPolicy: policy}
+	cals := append(append([]CalendarInfo(nil), c.calendars[userID]...), cal)
+	if err := c.putCalendars(userID, cals); err != nil {
+		return CalendarInfo{}, err
+	}
+	return cal, nil
+}
+
+// changeCalendar applies change to calendar id of userID and stores it.
+// Must be called with c.mu held.
+func (c *Calendar) changeCalendar(userID int, id string, change func(cal *CalendarInfo) error) (CalendarInfo, error) {
+	cals := c.calendarsOf(userID)
+	i := findCalendar(cals, id)
+	if i < 0 {
+		return CalendarInfo{}, fmt.Errorf("%w: нет календаря %q", errNotFound, id)
+	}
+	cal := cals[i]
+	cal.Shares = append([]Share(nil), cal.Shares...)
+	if err := change(&cal); err != nil {
+		return CalendarInfo{}, err
+	}
+	cals[i] = cal
+	if err := c.putCalendars(userID, cals); err != nil {
+		return CalendarInfo{}, err
+	}
+	return cal, nil
+}
+
+// UpdateCalendar renames calendar id of userID and sets its overlap
+// policy.
+func (c *Calendar) UpdateCalendar(userID int, id, name, policy string) (CalendarInfo, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return CalendarInfo{}, fmt.Errorf("%w: не указано название календаря", errInvalidEvent)
+	}
+	if err := checkPolicy(policy); err != nil {
+		return CalendarInfo{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changeCalendar(userID, id, func(cal *CalendarInfo) error {
+		cal.Name, cal.OverlapPolicy = name, policy
+		return nil
+	})
+}
+
+// DeleteCalendar removes an empty calendar. The default one can't be
+// removed.
+func (c *Calendar) DeleteCalendar(userID int, id string) error {
+	if id == defaultCalendarID {
+		return fmt.Errorf("%w: основной календарь удалить нельзя", errInvalidEvent)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cals := append([]CalendarInfo(nil), c.calendars[userID]...)
+	i := findCalendar(cals, id)
+	if i < 0 {
+		return fmt.Errorf("%w: нет календаря %q", errNotFound, id)
+	}
+	for _, date := range c.store.Dates() {
+		for _, e := range c.store.Day(date) {
+			if e.UserID == userID && e.CalendarID == id {
+				return fmt.Errorf("%w: в календаре есть события", errConflict)
+			}
+		}
+	}
+	return c.putCalendars(userID, append(cals[:i], cals[i+1:]...))
+}
+
+// ShareCalendar gives grantee access to calendar id of userID, replacing
+// what they had. An empty access revokes it.
+func (c *Calendar) ShareCalendar(userID int, id string, grantee int, access string) (CalendarInfo, error) {
+	switch {
+	case grantee <= 0 || grantee == userID:
+		return CalendarInfo{}, fmt.Errorf("%w: некорректный пользователь %d", errInvalidEvent, grantee)
+	case access != "" && access != accessRead && access != accessWrite:
+		return CalendarInfo{}, fmt.Errorf("%w: доступ должен быть read или write", errInvalidEvent)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.changeCalendar(userID, id, func(cal *CalendarInfo) error {
+		kept := cal.Shares[:0]
+		for _, s := range cal.Shares {
+			if s.UserID != grantee {
+				kept = append(kept, s)
+			}
+		}
+		cal.Shares = kept
+		if access != "" {
+			cal.Shares = append(cal.Shares, Share{UserID: grantee, Access: access})
+			sort.Slice(cal.Shares, func(i, j int) bool { return cal.Shares[i].UserID < cal.Shares[j].UserID })
+		}
+		return nil
+	})
+}
+
+type calendarRef struct {
+	owner int
+	id    string
+}
+
+// sharedWith maps the calendars others share with userID to the access
+// given. Must be called with c.mu held.
+func (c *Calendar) sharedWith(userID int) map[calendarRef]string {
+	shared := make(map[calendarRef]string)
+	for owner, cals := range c.calendars {
+		for _, cal := range cals {
+			for _, s := range cal.Shares {
+				if s.UserID == userID && owner != userID {
+					shared[calendarRef{owner, cal.ID}] = s.Access
+				}
+			}
+		}
+	}
+	return shared
+}
+
+// Access returns what userID may do with e: accessWrite for its owner
+// and writers of its calendar, accessRead for readers and attendees, and
+// "" for anyone else.
+func (c *Calendar) Access(userID int, e Event) string {
+	if e.UserID == userID {
+		return accessWrite
+	}
+	c.mu.Lock()
+	access := c.sharedWith(userID)[calendarRef{e.UserID, calendarOf(e)}]
+	c.mu.Unlock()
+	if access == "" && attendeeIndex(e, userID) >= 0 {
+		access = accessRead
+	}
+	return access
+}
+
+func attendeeIndex(e Event, userID int) int {
+	for i, a := range e.Attendees {
+		if a.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// attending reports whether e belongs in the agenda of userID as an
+// attendee: invited and not declined.
+func attending(e Event, userID int) bool {
+	i := attendeeIndex(e, userID)
+	return i >= 0 && e.Attendees[i].Status != statusDeclined
+}
+
+// normalizeInvitations checks the calendar of e exists and cleans up its
+// attendees: the owner isn't one of them, each is listed once, in order
+// of ID, and an attendee without an answer yet needs to give one. Must
+// be called with c.mu held.
+func (c *Calendar) normalizeInvitations(e *Event) error {
+	if e.CalendarID == defaultCalendarID {
+		e.CalendarID = ""
+	}
+	if e.CalendarID != "" && findCalendar(c.calendars[e.UserID], e.CalendarID) < 0 {
+		return fmt.Errorf("%w: нет календаря %q", errInvalidEvent, e.CalendarID)
+	}
+	seen := make(map[int]bool)
+	var attendees []Attendee
+	for _, a := range e.Attendees {
+		if a.UserID <= 0 {
+			return fmt.Errorf("%w: некорректный участник %d", errInvalidEvent, a.UserID)
+		}
+		if a.Status == "" {
+			a.Status = statusNeedsAction
+		}
+		if !attendeeStatuses[a.Status] {
+			return fmt.Errorf("%w: неизвестный ответ %q", errInvalidEvent, a.Status)
+		}
+		if a.UserID != e.UserID && !seen[a.UserID] {
+			seen[a.UserID] = true
+			attendees = append(attendees, a)
+		}
+	}
+	sort.Slice(attendees, func(i, j int) bool { return attendees[i].UserID < attendees[j].UserID })
+	e.Attendees = attendees
+	return nil
+}
+
+// Respond records the answer of attendee userID to the invitation to
+// event id, for every occurrence of a series.
+func (c *Calendar) Respond(id string, userID int, status string) (Event, error) {
+	if !attendeeStatuses[status] {
+		return Event{}, fmt.Errorf("%w: неизвестный ответ %q", errInvalidEvent, status)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, i, evts, err := c.find(id)
+	if err != nil {
+		return Event{}, err
+	}
+	e := evts[i]
+	j := attendeeIndex(e, userID)
+	if j < 0 {
+		return Event{}, fmt.Errorf("%w: пользователь %d не приглашён", errNotFound, userID)
+	}
+	e.Attendees = append([]Attendee(nil), e.Attendees...)
+	e.Attendees[j].Status = status
+	e.Version++
+	if e.Seq, err = c.recordChange(e.UserID, resourceUID(e), false); err != nil {
+		return Event{}, err
+	}
+	evts[i] = e
+	if err := c.put(map[string][]Event{key: evts}); err != nil {
+		return Event{}, err
+	}
+	c.publish(e.UserID, eventChange(e))
+	return e, nil
+}
+
+// Invitations returns the events userID is invited to, series
+// unexpanded, ordered by start. A non-empty status keeps only those
+// answered so.
+func (c *Calendar) Invitations(userID int, status string) []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := []Event{}
+	for _, date := range c.store.Dates() {
+		for _, e := range c.store.Day(date) {
+			if i := attendeeIndex(e, userID); i >= 0 && (status == "" || e.Attendees[i].Status == status) {
+				result = append(result, e)
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSharedCalendarsAndInvitations(t *testing.T) {
+	var cfg authConfig
+	for id := 1; id <= 5; id++ {
+		cfg.APIKeys = append(cfg.APIKeys, apiKeyConfig{Key: fmt.Sprintf("key-%d", id), UserID: id})
+	}
+	auth, err := NewAuthenticator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := makeHandlersWithAuth(NewCalendar(), auth)
+	as := func(userID int, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-API-Key", fmt.Sprintf("key-%d", userID))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	agenda := func(userID int) []Event {
+		rec := as(userID, http.MethodGet, fmt.Sprintf("/v2/users/%d/events?from=2024-03-01&to=2024-03-31", userID), "")
+		var list eventList
+		json.Unmarshal(rec.Body.Bytes(), &list)
+		return list.Events
+	}
+
+	rec := as(1, http.MethodPost, "/v2/users/1/calendars", `{"name":"Команда"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create calendar: status %d, body %s", rec.Code, rec.Body)
+	}
+	var team CalendarInfo
+	json.Unmarshal(rec.Body.Bytes(), &team)
+	calendar := "/v2/users/1/calendars/" + team.ID
+	if rec := as(2, http.MethodPut, calendar+"/shares/2", `{"access":"write"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("sharing another user's calendar: status %d, want 403", rec.Code)
+	}
+	as(1, http.MethodPut, calendar+"/shares/2", `{"access":"read"}`)
+	as(1, http.MethodPut, calendar+"/shares/3", `{"access":"write"}`)
+
+	rec = as(3, http.MethodPost, "/v2/users/1/events", `{"start":"2024-03-05T10:00:00Z","event":"Planning","calendar_id":"`+team.ID+`","attendees":[4]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("writer creates event: status %d, body %s", rec.Code, rec.Body)
+	}
+	var planning Event
+	json.Unmarshal(rec.Body.Bytes(), &planning)
+	if planning.UserID != 1 || len(planning.Attendees) != 1 || planning.Attendees[0].Status != statusNeedsAction {
+		t.Errorf("created = %+v", planning)
+	}
+	if rec := as(2, http.MethodPost, "/v2/users/1/events", `{"start":"2024-03-05T10:00:00Z","event":"x","calendar_id":"`+team.ID+`"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("reader creates event: status %d, want 403", rec.Code)
+	}
+
+	item := "/v2/users/1/events/" + planning.ID
+	if rec := as(2, http.MethodGet, item, ""); rec.Code != http.StatusOK {
+		t.Errorf("reader gets event: status %d", rec.Code)
+	}
+	if rec := as(2, http.MethodPatch, item, `{"event":"x"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("reader patches event: status %d, want 403", rec.Code)
+	}
+	if rec := as(3, http.MethodPatch, item, `{"calendar_id":"default"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("writer moves event out of the shared calendar: status %d, want 403", rec.Code)
+	}
+	if rec := as(5, http.MethodGet, item, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("stranger gets event: status %d, want 404", rec.Code)
+	}
+	if rec := as(1, http.MethodDelete, calendar, ""); rec.Code != http.StatusConflict {
+		t.Errorf("delete calendar with events: status %d, want 409", rec.Code)
+	}
+
+	for _, userID := range []int{1, 2, 3, 4} {
+		if evts := agenda(userID); len(evts) != 1 || evts[0].ID != planning.ID {
+			t.Errorf("agenda of %d = %+v", userID, evts)
+		}
+	}
+	if evts := agenda(5); len(evts) != 0 {
+		t.Errorf("agenda of 5 = %+v", evts)
+	}
+
+	rec = as(4, http.MethodPut, "/v2/users/4/invitations/"+planning.ID, `{"status":"declined"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("decline: status %d, body %s", rec.Code, rec.Body)
+	}
+	if evts := agenda(4); len(evts) != 0 {
+		t.Errorf("declined event still in agenda: %+v", evts)
+	}
+	var invited eventList
+	json.Unmarshal(as(4, http.MethodGet, "/v2/users/4/invitations?status=declined", "").Body.Bytes(), &invited)
+	if len(invited.Events) != 1 {
+		t.Errorf("declined invitations = %+v", invited.Events)
+	}
+	if rec := as(5, http.MethodPut, "/v2/users/5/invitations/"+planning.ID, `{"status":"accepted"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("answering without an invitation: status %d, want 404", rec.Code)
+	}
+
+	// Editing the event keeps the answers already given.
+	rec = as(1, http.MethodPatch, item, `{"attendees":[4,5]}`)
+	var edited Event
+	json.Unmarshal(rec.Body.Bytes(), &edited)
+	if len(edited.Attendees) != 2 || edited.Attendees[0].Status != statusDeclined || edited.Attendees[1].Status != statusNeedsAction {
+		t.Errorf("attendees after edit = %+v", edited.Attendees)
+	}
+
+	as(1, http.MethodDelete, calendar+"/shares/2", "")
+	if evts := agenda(2); len(evts) != 0 {
+		t.Errorf("agenda of 2 after unsharing = %+v", evts)
+	}
+	var lists calendarList
+	json.Unmarshal(as(3, http.MethodGet, "/v2/users/3/calendars", "").Body.Bytes(), &lists)
+	if len(lists.Calendars) != 1 || lists.Calendars[0].ID != defaultCalendarID || len(lists.Shared) != 1 || lists.Shared[0].Shares[0].Access != accessWrite {
+		t.Errorf("calendars of 3 = %+v", lists)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// EventStore keeps the events of each day, keyed by "2006-01-02".
+// Calendar holds its own lock around every read-modify-write, so a store
+// only has to make each Put atomic and durable.
+type EventStore interface {
+	// Day returns a copy of the events stored for date.
+	Day(date string) []Event
+	// Put replaces the events of every date in days in one step. An empty
+	// slice removes the date.
+	Put(days map[string][]Event) error
+	// Dates lists every date that has events, in no particular order.
+	Dates() []string
+	// Meta and PutMeta keep small JSON documents that aren't events, such
+	// as user settings. Meta returns nil for an unknown key; PutMeta with
+	// nil deletes it.
+	Meta(key string) json.RawMessage
+	PutMeta(key string, value json.RawMessage) error
+	Close() error
+}
+
+var errStorage = errors.New("ошибка хранилища")
+
+// MemoryStore is the original in-memory map; everything is lost on restart.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	days map[string][]Event
+	meta map[string]json.RawMessage
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{days: make(map[string][]Event), meta: make(map[string]json.RawMessage)}
+}
+
+func (s *MemoryStore) Day(date string) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Event(nil), s.days[date]...)
+}
+
+func (s *MemoryStore) Put(days map[string][]Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(days)
+	return nil
+}
+
+func (s *MemoryStore) Dates() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dates := make([]string, 0, len(s.days))
+	for date := range s.days {
+		dates = append(dates, date)
+	}
+	return dates
+}
+
+func (s *MemoryStore) Meta(key string) json.RawMessage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append(json.RawMessage(nil), s.meta[key]...)
+}
+
+func (s *MemoryStore) PutMeta(key string, value json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applyMeta(map[string]json.RawMessage{key: value})
+	return nil
+}
+
+func (s *MemoryStore) applyMeta(meta map[string]json.RawMessage) {
+	for key, value := range meta {
+		if value == nil {
+			delete(s.meta, key)
+			continue
+		}
+		s.meta[key] = append(json.RawMessage(nil), value...)
+	}
+}
+
+func (s *MemoryStore) apply(days map[string][]Event) {
+	for date, evts := range days {
+		if len(evts) == 0 {
+			delete(s.days, date)
+			continue
+		}
+		s.days[date] = append([]Event(nil), evts...)
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.log"
+
+	// storeVersion is written into every snapshot and log record. Bump it
+	// together with a new entry in migrations when the format changes.
+	storeVersion = 1
+
+	compactEvery = 1000
+)
+
+// migrations upgrade a snapshot written by an older version, indexed by
+// the version they read. Version 0 is a bare JSON array of events, as
+// returned by the events_for_* endpoints, so data pulled out of a running
+// in-memory server can be dropped in as snapshot.json.
+var migrations = map[int]func(json.RawMessage) (map[string][]Event, error){
+	0: func(raw json.RawMessage) (map[string][]Event, error) {
+		var evts []Event
+		if err := json.Unmarshal(raw, &evts); err != nil {
+			return nil, err
+		}
+		days := make(map[string][]Event)
+		for _, e := range evts {
+			key := e.Date.Format("2006-01-02")
+			days[key] = append(days[key], e)
+		}
+		return days, nil
+	},
+}
+
+type snapshot struct {
+	Version int                        `json:"version"`
+	Days    map[string][]Event         `json:"days"`
+	Meta    map[string]json.RawMessage `json:"meta,omitempty"`
+}
+
+// walRecord is one Put or PutMeta. A meta value of null deletes the key.
+type walRecord struct {
+	Version int                        `json:"v"`
+	Days    map[string][]Event         `json:"days,omitempty"`
+	Meta    map[string]json.RawMessage `json:"meta,omitempty"`
+}
+
+// FileStore is a MemoryStore backed by a directory holding a snapshot and
+// an append-only log of Put calls. Each record is fsynced before Put
+// returns; a record torn by a crash is dropped on the next open. The log
+// is folded into a new snapshot, written aside and renamed into place,
+// every compactEvery records and on Close.
+type FileStore struct {
+	mem     *MemoryStore
+	dir     string
+	mu      sync.Mutex
+	wal     *os.File
+	size    int64
+	records int
+}
+
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileStore{mem: NewMemoryStore(), dir: dir}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.wal = wal
+	return s, nil
+}
+
+func (s *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var head struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal(data, &head); err != nil {
+			return fmt.Errorf("%s: %w", snapshotFile, err)
+		}
+		version = head.Version
+	}
+
+	switch {
+	case version == storeVersion:
+		var snap snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("%s: %w", snapshotFile, err)
+		}
+		s.mem.apply(snap.Days)
+		s.mem.applyMeta(snap.Meta)
+	case version > storeVersion:
+		return fmt.Errorf("%s: версия %d новее поддерживаемой %d", snapshotFile, version, storeVersion)
+	default:
+		migrate, ok := migrations[version]
+		if !ok {
+			return fmt.Errorf("%s: нет миграции с версии %d", snapshotFile, version)
+		}
+		days, err := migrate(data)
+		if err != nil {
+			return fmt.Errorf("%s: миграция с версии %d: %w", snapshotFile, version, err)
+		}
+		s.mem.apply(days)
+		logger.Printf("хранилище: snapshot.json обновлён с версии %d до %d", version, storeVersion)
+		return s.writeSnapshot()
+	}
+	return nil
+}
+
+// replay applies the log on top of the snapshot. Reading stops at the
+// first incomplete or unparsable line, which can only be the tail left by
+// a crash mid-write; the file is cut there so new records follow a
+// clean line.
+func (s *FileStore) replay() error {
+	path := filepath.Join(s.dir, walFile)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var rec walRecord
+		if json.Unmarshal(line, &rec) != nil || rec.Version != storeVersion {
+			break
+		}
+		s.mem.apply(rec.Days)
+		s.mem.applyMeta(nullsToNil(rec.Meta))
+		s.records++
+		good += int64(len(line))
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = good
+	if info.Size() != good {
+		logger.Printf("хранилище: отброшен повреждённый хвост %s (%d байт)", walFile, info.Size()-good)
+		if err := f.Truncate(good); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	return nil
+}
+
+func (s *FileStore) Day(date string) []Event {
+	return s.mem.Day(date)
+}
+
+func (s *FileStore) Dates() []string {
+	return s.mem.Dates()
+}
+
+func (s *FileStore) Put(days map[string][]Event) error {
+	return s.append(walRecord{Version: storeVersion, Days: days})
+}
+
+func (s *FileStore) Meta(key string) json.RawMessage {
+	return s.mem.Meta(key)
+}
+
+func (s *FileStore) PutMeta(key string, value json.RawMessage) error {
+	v := value
+	if v == nil {
+		v = json.RawMessage("null")
+	}
+	return s.append(walRecord{Version: storeVersion, Meta: map[string]json.RawMessage{key: v}})
+}
+
+// nullsToNil turns the JSON nulls of a log record back into deletions.
+func nullsToNil(meta map[string]json.RawMessage) map[string]json.RawMessage {
+	for key, value := range meta {
+		if string(value) == "null" {
+			meta[key] = nil
+		}
+	}
+	return meta
+}
+
+func (s *FileStore) append(rec walRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.wal.Write(line); err != nil {
+		// Cut off the partial record so later ones aren't lost behind it
+		// on replay.
+		s.wal.Truncate(s.size)
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		s.wal.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(line))
+	s.mem.mu.Lock()
+	s.mem.apply(rec.Days)
+	s.mem.applyMeta(nullsToNil(rec.Meta))
+	s.mem.mu.Unlock()
+
+	if s.records++; s.records >= compactEvery {
+		if err := s.compact(); err != nil {
+			logger.Printf("хранилище: не удалось сжать журнал: %v", err)
+		}
+	}
+	return nil
+}
+
+// compact must be called with s.mu held. A crash between the rename and
+// the truncate only replays records the snapshot already holds, which is
+// harmless since Put replaces whole days.
+func (s *FileStore) compact() error {
+	if err := s.writeSnapshot(); err != nil {
+		return err
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	s.size, s.records = 0, 0
+	return s.wal.Sync()
+}
+
+func (s *FileStore) writeSnapshot() error {
+	s.mem.mu.RLock()
+	data, err := json.Marshal(snapshot{Version: storeVersion, Days: s.mem.days, Meta: s.mem.meta})
+	s.mem.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, snapshotFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	err := s.compact()
+	if cerr := s.wal.Close(); err == nil {
+		err = cerr
+	}
+	s.wal = nil
+	return err
+}
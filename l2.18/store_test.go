@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorePersists(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	c := NewCalendarWithStore(store)
+	date := time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)
+	c.Create(Event{UserID: 1, Date: date, Text: "Party"})
+	dinner, _ := c.Create(Event{UserID: 2, Date: date, Text: "Dinner"})
+	c.Delete(dinner.ID)
+
+	// No Close: reopening must recover from the log alone, as after a crash.
+	reopened, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	evts := reopened.Day("2023-12-31")
+	if len(evts) != 1 || evts[0].Text != "Party" {
+		t.Errorf("expected only 'Party' after reopen, got %v", evts)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// After Close everything lives in the snapshot.
+	if data, _ := os.ReadFile(filepath.Join(dir, walFile)); len(data) != 0 {
+		t.Errorf("expected empty log after Close, got %q", data)
+	}
+	again, _ := OpenFileStore(dir)
+	if evts := again.Day("2023-12-31"); len(evts) != 1 {
+		t.Errorf("expected 1 event from snapshot, got %v", evts)
+	}
+}
+
+func TestFileStoreDropsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := OpenFileStore(dir)
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	NewCalendarWithStore(store).Create(Event{UserID: 1, Date: date, Text: "Kept"})
+
+	f, _ := os.OpenFile(filepath.Join(dir, walFile), os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"v":1,"days":{"2024-01-02":[{"user_id":1,`)
+	f.Close()
+
+	reopened, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	if evts := reopened.Day("2024-01-01"); len(evts) != 1 {
+		t.Errorf("expected the complete record to survive, got %v", evts)
+	}
+	c := NewCalendarWithStore(reopened)
+	if _, err := c.Create(Event{UserID: 2, Date: date, Text: "After"}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	last, _ := OpenFileStore(dir)
+	if evts := last.Day("2024-01-01"); len(evts) != 2 {
+		t.Errorf("expected records after the torn one to be kept, got %v", evts)
+	}
+}
+
+func TestFileStoreMigratesEventList(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `[{"user_id":1,"date":"2023-12-31T00:00:00Z","event":"Old"}]`
+	os.WriteFile(filepath.Join(dir, snapshotFile), []byte(legacy), 0644)
+
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatalf("OpenFileStore() error = %v", err)
+	}
+	if evts := store.Day("2023-12-31"); len(evts) != 1 || evts[0].Text != "Old" {
+		t.Errorf("expected migrated event, got %v", evts)
+	}
+	c := NewCalendarWithStore(store)
+	if evts, _ := c.EventsForDay("2023-12-31"); evts[0].ID == "" {
+		t.Errorf("expected legacy event to be given an ID")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if data[0] != '{' {
+		t.Errorf("snapshot was not rewritten in the current format: %s", data)
+	}
+}
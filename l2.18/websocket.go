@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server side of RFC 6455, as much as the change feed needs: it
+// sends text messages and answers pings and closes. Messages from the
+// client are read and dropped.
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+
+	// wsMaxFrame bounds the frames read from clients, which have nothing
+	// to say to the feed.
+	wsMaxFrame     = 64 << 10
+	wsWriteTimeout = 10 * time.Second
+	wsAcceptGUID   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWSClosed = errors.New("websocket закрыт клиентом")
+
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// mu serializes writes, which the reader makes too when answering
+	// pings.
+	mu sync.Mutex
+}
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkWebSocket tells why r can't be upgraded, if it can't.
+func checkWebSocket(r *http.Request) error {
+	if r.Header.Get("Sec-WebSocket-Key") == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return errors.New("нужны заголовки Sec-WebSocket-Key и Sec-WebSocket-Version: 13")
+	}
+	return nil
+}
+
+// upgradeWebSocket completes the opening handshake of a request passing
+// checkWebSocket and takes the connection over from the HTTP server. If
+// that isn't possible it answers with an error itself.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		err = fmt.Errorf("соединение нельзя перехватить: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsAcceptGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// writeFrame sends one unfragmented, unmasked frame.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+// readFrame reads one frame from the client, unmasking it.
+func (ws *wsConn) readFrame() (opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		return 0, nil, errors.New("кадр клиента без маски")
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxFrame {
+		return 0, nil, fmt.Errorf("кадр клиента больше %d байт", wsMaxFrame)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop answers the client's pings and close until the connection
+// ends, returning why it did.
+func (ws *wsConn) readLoop() error {
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		case wsClose:
+			// Echo the status code, if any, as the closing handshake asks.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.writeFrame(wsClose, payload)
+			return errWSClosed
+		}
+	}
+}
+
+// close sends a close frame with status and drops the connection.
+func (ws *wsConn) close(status uint16) {
+	ws.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, status))
+	ws.conn.Close()
+}